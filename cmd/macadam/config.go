@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/containers/common/pkg/completion"
+	"github.com/crc-org/macadam/cmd/macadam/registry"
+	"github.com/crc-org/macadam/pkg/env"
+	provider2 "github.com/crc-org/macadam/pkg/machinedriver/provider"
+	"github.com/spf13/cobra"
+)
+
+var (
+	configCmd = &cobra.Command{
+		Use:   "config",
+		Short: "Manage macadam configuration",
+		Long: `Manage the defaults stored in macadam.conf.
+
+Values can also be overridden with the MACADAM_PROVIDER, MACADAM_NAME, MACADAM_CPUS,
+MACADAM_MEMORY, MACADAM_DISK_SIZE and MACADAM_USERNAME environment variables.`,
+		PersistentPreRunE: noPreRunE,
+		RunE:              validateSubcommand,
+	}
+
+	configGetCmd = &cobra.Command{
+		Use:               "get KEY",
+		Short:             "Print the value of a configuration key",
+		Long:              "Print the effective value of a configuration key",
+		RunE:              configGet,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: autocompleteConfigKey,
+		Example: `macadam config get machine.cpus
+  macadam config get providers.qemu.memory`,
+	}
+
+	configSetCmd = &cobra.Command{
+		Use:               "set KEY VALUE",
+		Short:             "Set the value of a configuration key",
+		Long:              "Set the value of a configuration key in macadam.conf, an empty value removes the key",
+		RunE:              configSet,
+		Args:              cobra.ExactArgs(2),
+		ValidArgsFunction: autocompleteConfigKey,
+		Example: `macadam config set machine.memory 8192
+  macadam config set providers.applehv.cpus 4
+  macadam config set provider libkrun`,
+	}
+
+	configListCmd = &cobra.Command{
+		Use:               "list",
+		Aliases:           []string{"ls"},
+		Short:             "List configuration values",
+		Long:              "List the effective value of all configuration keys",
+		RunE:              configList,
+		Args:              cobra.NoArgs,
+		ValidArgsFunction: completion.AutocompleteNone,
+		Example:           `macadam config list`,
+	}
+)
+
+func init() {
+	registry.Commands = append(registry.Commands, registry.CliCommand{
+		Command: configCmd,
+	})
+	for _, c := range []*cobra.Command{configGetCmd, configSetCmd, configListCmd} {
+		registry.Commands = append(registry.Commands, registry.CliCommand{
+			Command: c,
+			Parent:  configCmd,
+		})
+	}
+}
+
+// noPreRunE is used by commands which do not operate on machines and thus do
+// not need the machine environment to be set up
+func noPreRunE(_ *cobra.Command, _ []string) error {
+	return nil
+}
+
+// validateSubcommand is used by commands which only group subcommands
+func validateSubcommand(cmd *cobra.Command, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unrecognized command `%s %s`\nTry '%s --help' for more information", cmd.CommandPath(), args[0], cmd.CommandPath())
+	}
+	return cmd.Help()
+}
+
+func configGet(_ *cobra.Command, args []string) error {
+	cfg, err := env.LoadConfig()
+	if err != nil {
+		return err
+	}
+	value, err := cfg.Get(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Println(value)
+	return nil
+}
+
+func configSet(_ *cobra.Command, args []string) error {
+	cfg, err := env.LoadConfig()
+	if err != nil {
+		return err
+	}
+	if err := cfg.Set(args[0], args[1]); err != nil {
+		return err
+	}
+	return cfg.Write()
+}
+
+func configList(_ *cobra.Command, _ []string) error {
+	cfg, err := env.LoadConfig()
+	if err != nil {
+		return err
+	}
+	for _, key := range env.Keys(provider2.GetProviders()) {
+		value, err := cfg.Get(key)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s=%s\n", key, value)
+	}
+	return nil
+}
+
+func autocompleteConfigKey(_ *cobra.Command, args []string, _ string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	return env.Keys(provider2.GetProviders()), cobra.ShellCompDirectiveNoFileComp
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/containers/common/pkg/completion"
+	"github.com/containers/common/pkg/report"
+	"github.com/crc-org/macadam/cmd/macadam/common"
+	"github.com/crc-org/macadam/cmd/macadam/registry"
+	"github.com/crc-org/macadam/pkg/events"
+	"github.com/spf13/cobra"
+)
+
+var (
+	eventsCmd = &cobra.Command{
+		Use:               "events [options]",
+		Short:             "Show machine events",
+		Long:              "Show the lifecycle events of the machines, such as init, start, ready, stop, remove, set and error",
+		PersistentPreRunE: noPreRunE,
+		RunE:              eventsRun,
+		Args:              cobra.NoArgs,
+		ValidArgsFunction: completion.AutocompleteNone,
+		Example: `macadam events
+  macadam events --follow --filter machine=myvm
+  macadam events --filter event=start --filter event=stop --format json`,
+	}
+	eventsOpts = eventsFlagType{}
+)
+
+type eventsFlagType struct {
+	follow  bool
+	filters []string
+	format  string
+}
+
+func init() {
+	registry.Commands = append(registry.Commands, registry.CliCommand{
+		Command: eventsCmd,
+	})
+
+	flags := eventsCmd.Flags()
+	flags.BoolVarP(&eventsOpts.follow, "follow", "f", false, "Wait for new events after showing the past events")
+
+	filterFlagName := "filter"
+	flags.StringArrayVar(&eventsOpts.filters, filterFlagName, []string{}, "Show the events matching a filter: event=TYPE, machine=NAME or provider=NAME")
+	_ = eventsCmd.RegisterFlagCompletionFunc(filterFlagName, completion.AutocompleteNone)
+
+	formatFlagName := "format"
+	flags.StringVar(&eventsOpts.format, formatFlagName, "", "Format events output using JSON or a Go template")
+	_ = eventsCmd.RegisterFlagCompletionFunc(formatFlagName, common.AutocompleteFormat(&events.Event{}))
+}
+
+func eventsRun(cmd *cobra.Command, _ []string) error {
+	filter, err := events.ParseFilter(eventsOpts.filters)
+	if err != nil {
+		return err
+	}
+
+	var printEvent func(*events.Event) error
+	switch {
+	case eventsOpts.format == "" && !jsonOutput():
+		printEvent = func(event *events.Event) error {
+			fmt.Println(event.String())
+			return nil
+		}
+	case report.IsJSON(eventsOpts.format) || jsonOutput():
+		printEvent = func(event *events.Event) error {
+			b, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(b))
+			return nil
+		}
+	default:
+		rpt, err := report.New(os.Stdout, cmd.Name()).Parse(report.OriginUser, eventsOpts.format)
+		if err != nil {
+			return err
+		}
+		printEvent = func(event *events.Event) error {
+			if err := rpt.Execute([]*events.Event{event}); err != nil {
+				return err
+			}
+			return rpt.Flush()
+		}
+	}
+
+	return events.Read(cmd.Context(), events.ReadOptions{
+		Follow: eventsOpts.follow,
+		Filter: filter,
+	}, printEvent)
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/containers/common/pkg/completion"
+	"github.com/containers/podman/v5/libpod/define"
+	"github.com/crc-org/macadam/cmd/macadam/registry"
+	"github.com/crc-org/macadam/pkg/client"
+	"github.com/crc-org/macadam/pkg/sshclient"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// execTimeoutExitCode is the exit code when --timeout expires, as with
+	// timeout(1)
+	execTimeoutExitCode = 124
+	// execManyExitCode is the exit code when the command failed on some of
+	// the machines selected with --all or --filter
+	execManyExitCode = 1
+)
+
+var (
+	execCmd = &cobra.Command{
+		Use:   "exec [options] -- COMMAND [ARG...]",
+		Short: "Run a command in machines",
+		Long:  "Run a command in a running machine, or in all the running machines matching --all or --filter, passing its arguments as is",
+		RunE:  execCommand,
+		Args:  cobra.MinimumNArgs(1),
+		Example: `macadam exec -- uname -a
+  macadam exec --machine myvm --timeout 5m -- make -C /srv/app check
+  macadam exec --json -- cat /etc/os-release
+  macadam exec --filter label=env=ci --parallel 4 -- systemctl is-system-running`,
+		ValidArgsFunction: completion.AutocompleteNone,
+	}
+
+	execOpts     client.ExecOptions
+	execMachine  string
+	execTimeout  time.Duration
+	execJSON     bool
+	execAll      bool
+	execFilters  []string
+	execParallel int
+)
+
+// execResult is printed by exec --json
+type execResult struct {
+	// Machine is only set with --all and --filter
+	Machine  string `json:"machine,omitempty"`
+	ExitCode int    `json:"exitCode"`
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+	// Duration is in seconds
+	Duration float64 `json:"duration"`
+	// Error is set when the command could not be run, or timed out
+	Error     string `json:"error,omitempty"`
+	ErrorCode string `json:"errorCode,omitempty"`
+}
+
+func init() {
+	// the flags after the command are arguments of the command
+	execCmd.Flags().SetInterspersed(false)
+	registry.Commands = append(registry.Commands, registry.CliCommand{
+		Command: execCmd,
+	})
+
+	flags := execCmd.Flags()
+	machineFlagName := "machine"
+	flags.StringVarP(&execMachine, machineFlagName, "m", "", "Machine to run the command in (default machine if not set)")
+	_ = execCmd.RegisterFlagCompletionFunc(machineFlagName, autocompleteMachine)
+
+	userFlagName := "user"
+	flags.StringVarP(&execOpts.Username, userFlagName, "u", "", "User to run the command as (default user of the machine if not set)")
+	_ = execCmd.RegisterFlagCompletionFunc(userFlagName, completion.AutocompleteNone)
+
+	ttyFlagName := "tty"
+	flags.BoolVarP(&execOpts.TTY, ttyFlagName, "t", false, "Allocate a pseudo-terminal for the command")
+
+	timeoutFlagName := "timeout"
+	flags.DurationVar(&execTimeout, timeoutFlagName, 0, fmt.Sprintf("Stop the command if it is still running after this duration and exit with %d, 0 for no timeout", execTimeoutExitCode))
+
+	jsonFlagName := "json"
+	flags.BoolVar(&execJSON, jsonFlagName, false, "Print the exit code, output and duration of the command as JSON")
+
+	allFlagName := "all"
+	flags.BoolVarP(&execAll, allFlagName, "a", false, "Run the command in all the running machines")
+
+	filterFlagName := "filter"
+	flags.StringArrayVar(&execFilters, filterFlagName, []string{}, "Run the command in the running machines matching a filter: name=NAME, label=KEY[=VALUE] or profile=NAME")
+	_ = execCmd.RegisterFlagCompletionFunc(filterFlagName, completion.AutocompleteNone)
+
+	parallelFlagName := "parallel"
+	flags.IntVar(&execParallel, parallelFlagName, 8, "Maximum number of machines the command runs in at the same time, with --all or --filter")
+	_ = execCmd.RegisterFlagCompletionFunc(parallelFlagName, completion.AutocompleteNone)
+}
+
+func execCommand(cmd *cobra.Command, args []string) error {
+	asJSON := execJSON || jsonOutput()
+	many := execAll || len(execFilters) > 0
+	switch {
+	case asJSON && execOpts.TTY:
+		return newCommandError(codeInvalidArgument, errors.New("--tty cannot be used with JSON output"))
+	case many && execMachine != "":
+		return newCommandError(codeInvalidArgument, errors.New("--machine cannot be used with --all or --filter"))
+	case many && execOpts.TTY:
+		return newCommandError(codeInvalidArgument, errors.New("--tty cannot be used with --all or --filter"))
+	case execParallel < 1:
+		return newCommandError(codeInvalidArgument, errors.New("--parallel must be at least 1"))
+	}
+	filter, err := client.ParseMachineFilter(execFilters)
+	if err != nil {
+		return newCommandError(codeInvalidArgument, err)
+	}
+
+	ctx, cancel := contextWithTimeout(cmd.Context(), execTimeout)
+	defer cancel()
+	execOpts.Command = args
+	if many {
+		return execMany(ctx, filter, asJSON)
+	}
+
+	execOpts.Stdin = os.Stdin
+	execOpts.Stdout = os.Stdout
+	execOpts.Stderr = os.Stderr
+	if !asJSON {
+		return handleExecError(macadamClient.Exec(ctx, execMachine, execOpts))
+	}
+
+	res := execCapture(ctx, execMachine, execOpts)
+	registry.SetExitCode(res.ExitCode)
+	return printExecJSON(res)
+}
+
+// execMany runs the command in the running machines matching filter, with
+// at most execParallel commands at the same time
+func execMany(ctx context.Context, filter client.MachineFilter, asJSON bool) error {
+	machines, err := macadamClient.List(ctx)
+	if err != nil {
+		return err
+	}
+	machines = slices.DeleteFunc(machines, func(m *client.Machine) bool {
+		return !m.Running() || !filter.Match(m)
+	})
+	if len(machines) == 0 {
+		return newCommandError(client.ErrorCode(client.ErrMachineNotRunning), errors.New("no running machine matches --all or --filter"))
+	}
+	slices.SortFunc(machines, func(a, b *client.Machine) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	// the lines of the machines are prefixed with their name, aligned
+	nameWidth := 0
+	for _, m := range machines {
+		nameWidth = max(nameWidth, len(m.Name))
+	}
+	var outputLock sync.Mutex
+
+	results := make([]execResult, len(machines))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for range min(execParallel, len(machines)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				name := machines[i].Name
+				opts := execOpts
+				// stdin cannot be shared by the machines
+				opts.Stdin = nil
+				if asJSON {
+					results[i] = execCapture(ctx, name, opts)
+					results[i].Machine = name
+					continue
+				}
+
+				prefix := fmt.Sprintf("%-*s | ", nameWidth, name)
+				stdout := &prefixWriter{w: os.Stdout, prefix: prefix, lock: &outputLock}
+				stderr := &prefixWriter{w: os.Stderr, prefix: prefix, lock: &outputLock}
+				opts.Stdout, opts.Stderr = stdout, stderr
+				start := time.Now()
+				err := macadamClient.Exec(ctx, name, opts)
+				stdout.Flush()
+				stderr.Flush()
+				results[i] = newExecResult(err, time.Since(start))
+				results[i].Machine = name
+			}
+		}()
+	}
+	for i := range machines {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	if slices.ContainsFunc(results, func(res execResult) bool { return res.ExitCode != 0 }) {
+		registry.SetExitCode(execManyExitCode)
+	}
+	if asJSON {
+		return printExecJSON(results)
+	}
+	return printExecSummary(os.Stderr, results)
+}
+
+// execCapture runs the command in the machine called name, and returns its
+// output in the result
+func execCapture(ctx context.Context, name string, opts client.ExecOptions) execResult {
+	var stdout, stderr strings.Builder
+	opts.Stdout = &stdout
+	opts.Stderr = &stderr
+	start := time.Now()
+	err := macadamClient.Exec(ctx, name, opts)
+	res := newExecResult(err, time.Since(start))
+	res.Stdout = stdout.String()
+	res.Stderr = stderr.String()
+	return res
+}
+
+// newExecResult returns the result of a command which returned err
+func newExecResult(err error, duration time.Duration) execResult {
+	res := execResult{
+		Duration: duration.Seconds(),
+	}
+	var exitErr *sshclient.ExitError
+	switch {
+	case err == nil:
+	case errors.As(err, &exitErr):
+		res.ExitCode = exitErr.Code
+	default:
+		res.ExitCode = define.ExecErrorCodeGeneric
+		if errors.Is(err, context.DeadlineExceeded) {
+			res.ExitCode = execTimeoutExitCode
+			err = timeoutError(err)
+		}
+		res.Error = err.Error()
+		res.ErrorCode = errorCode(err)
+	}
+	return res
+}
+
+func printExecJSON(v any) error {
+	b, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	// the errors of the command are part of the JSON output
+	return nil
+}
+
+// printExecSummary prints the exit code of the command in each machine
+func printExecSummary(w io.Writer, results []execResult) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "MACHINE\tEXIT CODE\tERROR")
+	for _, res := range results {
+		fmt.Fprintf(tw, "%s\t%d\t%s\n", res.Machine, res.ExitCode, res.Error)
+	}
+	return tw.Flush()
+}
+
+// handleExecError sets the exit code of macadam to the exit status of the
+// command, or to execTimeoutExitCode when --timeout expired
+func handleExecError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		registry.SetExitCode(execTimeoutExitCode)
+		return timeoutError(err)
+	}
+	return handleSSHError(err)
+}
+
+func timeoutError(err error) error {
+	return fmt.Errorf("command timed out after %s: %w", execTimeout, err)
+}
+
+// prefixWriter writes the lines written to it to w, prefixed with prefix.
+// The writers sharing lock do not interleave their lines.
+type prefixWriter struct {
+	w      io.Writer
+	prefix string
+	lock   *sync.Mutex
+	// buf holds the last line until it is complete
+	buf []byte
+}
+
+func (pw *prefixWriter) Write(p []byte) (int, error) {
+	pw.buf = append(pw.buf, p...)
+	for {
+		i := bytes.IndexByte(pw.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if err := pw.writeLine(pw.buf[:i+1]); err != nil {
+			return 0, err
+		}
+		pw.buf = pw.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush writes the last line, if it does not end with a newline
+func (pw *prefixWriter) Flush() {
+	if len(pw.buf) > 0 {
+		_ = pw.writeLine(append(pw.buf, '\n'))
+		pw.buf = nil
+	}
+}
+
+func (pw *prefixWriter) writeLine(line []byte) error {
+	pw.lock.Lock()
+	defer pw.lock.Unlock()
+	_, err := fmt.Fprintf(pw.w, "%s%s", pw.prefix, line)
+	return err
+}
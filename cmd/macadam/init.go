@@ -4,20 +4,13 @@ package main
 
 import (
 	"fmt"
-	"log/slog"
-	"os"
+	"strings"
 
 	"github.com/containers/common/pkg/completion"
-	"github.com/containers/common/pkg/strongunits"
-	ldefine "github.com/containers/podman/v5/libpod/define"
-	"github.com/containers/podman/v5/pkg/machine/define"
-	"github.com/containers/podman/v5/pkg/machine/shim"
 	"github.com/crc-org/macadam/cmd/macadam/registry"
-	"github.com/crc-org/macadam/pkg/imagepullers"
-	macadam "github.com/crc-org/macadam/pkg/machinedriver"
-	provider2 "github.com/crc-org/macadam/pkg/machinedriver/provider"
+	"github.com/crc-org/macadam/pkg/client"
+	"github.com/crc-org/macadam/pkg/env"
 	"github.com/crc-org/macadam/pkg/preflights"
-	"github.com/docker/go-units"
 	"github.com/spf13/cobra"
 )
 
@@ -32,9 +25,10 @@ var (
 		ValidArgsFunction: completion.AutocompleteNone,
 	}
 
-	initOptsFromFlags = define.InitOptions{}
+	initOptsFromFlags = client.InitOptions{}
+	initLabels        []string
+	initSkipChecks    []string
 	// initOptionalFlags  = InitOptionalFlags{}
-	defaultMachineName = "macadam"
 	// now                bool
 )
 
@@ -43,10 +37,6 @@ type InitOptionalFlags struct {
 	UserModeNetworking bool
 }
 
-// maxMachineNameSize is set to thirty to limit huge machine names primarily
-// because macOS has a much smaller file size limit.
-const maxMachineNameSize = 30
-
 func init() {
 	registry.Commands = append(registry.Commands, registry.CliCommand{
 		Command: initCmd,
@@ -55,33 +45,50 @@ func init() {
 	flags := initCmd.Flags()
 
 	MachineNameFlagName := "name"
-	flags.StringVar(&initOptsFromFlags.Name, MachineNameFlagName, defaultMachineName, "Name for the machine")
+	flags.StringVar(&initOptsFromFlags.Name, MachineNameFlagName, env.DefaultMachineName, "Name for the machine")
 	_ = initCmd.RegisterFlagCompletionFunc(MachineNameFlagName, completion.AutocompleteDefault)
 
 	SSHIdentityPathFlagName := "ssh-identity-path"
-	flags.StringVar(&initOptsFromFlags.SSHIdentityPath, SSHIdentityPathFlagName, "", "Path to the SSH private key to use to access the machine")
+	flags.StringVar(&initOptsFromFlags.SSHIdentityPath, SSHIdentityPathFlagName, "", "Path to the SSH private key to use to access the machine (default: a key generated for the machine)")
 	_ = initCmd.RegisterFlagCompletionFunc(SSHIdentityPathFlagName, completion.AutocompleteDefault)
 
 	UsernameFlagName := "username"
-	flags.StringVar(&initOptsFromFlags.Username, UsernameFlagName, "core", "Username used in image")
+	flags.StringVar(&initOptsFromFlags.Username, UsernameFlagName, env.DefaultUsername, "Username used in image")
 	_ = initCmd.RegisterFlagCompletionFunc(UsernameFlagName, completion.AutocompleteDefault)
 
 	cpusFlagName := "cpus"
-	flags.Uint64Var(&initOptsFromFlags.CPUS, cpusFlagName, 2, "Number of CPUs")
+	flags.Uint64Var(&initOptsFromFlags.CPUs, cpusFlagName, env.DefaultCPUs, "Number of CPUs")
 	_ = initCmd.RegisterFlagCompletionFunc(cpusFlagName, completion.AutocompleteNone)
 
 	diskSizeFlagName := "disk-size"
-	flags.Uint64Var(&initOptsFromFlags.DiskSize, diskSizeFlagName, 20, "Disk size in GiB")
+	flags.Uint64Var(&initOptsFromFlags.DiskSize, diskSizeFlagName, env.DefaultDiskSize, "Disk size in GiB")
 	_ = initCmd.RegisterFlagCompletionFunc(diskSizeFlagName, completion.AutocompleteNone)
 
 	memoryFlagName := "memory"
-	flags.Uint64VarP(&initOptsFromFlags.Memory, memoryFlagName, "m", 4096, "Memory in MiB")
+	flags.Uint64VarP(&initOptsFromFlags.Memory, memoryFlagName, "m", env.DefaultMemory, "Memory in MiB")
 	_ = initCmd.RegisterFlagCompletionFunc(memoryFlagName, completion.AutocompleteNone)
 
 	CloudInitPathFlagName := "cloud-init"
 	flags.StringSliceVarP(&initOptsFromFlags.CloudInitPaths, CloudInitPathFlagName, "", []string{}, "Path to user-data, meta-data and network-config cloud-init configuration files")
 	_ = initCmd.RegisterFlagCompletionFunc(CloudInitPathFlagName, completion.AutocompleteDefault)
 
+	VolumeFlagName := "volume"
+	flags.StringArrayVarP(&initOptsFromFlags.Volumes, VolumeFlagName, "v", []string{}, "Volumes to mount, source:target")
+	_ = initCmd.RegisterFlagCompletionFunc(VolumeFlagName, completion.AutocompleteDefault)
+
+	SetDefaultFlagName := "set-default"
+	flags.BoolVar(&initOptsFromFlags.SetDefault, SetDefaultFlagName, false, "Make this machine the default machine")
+
+	ProfileFlagName := "profile"
+	flags.StringVar(&initOptsFromFlags.Profile, ProfileFlagName, "", "Profile to use for the machine settings, flags take precedence over the profile values")
+	_ = initCmd.RegisterFlagCompletionFunc(ProfileFlagName, autocompleteProfiles)
+
+	LabelFlagName := "label"
+	flags.StringArrayVarP(&initLabels, LabelFlagName, "l", []string{}, "Labels to select the machine with, key=value")
+	_ = initCmd.RegisterFlagCompletionFunc(LabelFlagName, completion.AutocompleteNone)
+
+	addSkipCheckFlag(initCmd, &initSkipChecks)
+
 	/* flags := initCmd.Flags()
 	cfg := registry.PodmanConfig()
 
@@ -150,76 +157,72 @@ func init() {
 }
 
 func initMachine(cmd *cobra.Command, args []string) error {
-	vmProvider, err := provider2.GetProviderOrDefault(provider)
-	if err != nil {
-		return err
-	}
-
-	if err := preflights.RunPreflights(vmProvider); err != nil {
-		slog.Error(err.Error())
-		os.Exit(1)
+	if err := preflights.ValidateSkip(initSkipChecks); err != nil {
+		return newCommandError(codeInvalidArgument, err)
 	}
 
-	/*
-		dirs, err := env.GetMachineDirs(provider.VMType())
-		if err != nil {
-			return err
-		}
-	*/
-
-	diskImage := ""
+	opts := initOptsFromFlags
 	if len(args) > 0 {
-		diskImage = args[0]
+		opts.Image = args[0]
 	}
-
-	machineName := initOptsFromFlags.Name
-	if len(machineName) > maxMachineNameSize {
-		return fmt.Errorf("machine name %q must be %d characters or less", machineName, maxMachineNameSize)
+	// the flags which were not specified on the command line use the value
+	// from the profile, or from macadam.conf
+	flags := cmd.Flags()
+	if !flags.Changed("name") {
+		opts.Name = ""
 	}
-
-	if !ldefine.NameRegex.MatchString(machineName) {
-		return fmt.Errorf("invalid name %q: %w", machineName, ldefine.RegexError)
+	if !flags.Changed("username") {
+		opts.Username = ""
+	}
+	if !flags.Changed("cpus") {
+		opts.CPUs = 0
+	}
+	if !flags.Changed("disk-size") {
+		opts.DiskSize = 0
+	}
+	if !flags.Changed("memory") {
+		opts.Memory = 0
 	}
+	labels, err := parseLabels(initLabels)
+	if err != nil {
+		return newCommandError(codeInvalidArgument, err)
+	}
+	opts.Labels = labels
 
-	// Check if the disk image exists and is not larger than the specified disk size
-	if diskImage == "" {
-		return fmt.Errorf("disk image is required")
+	// the preflight checks need the memory and disk size of the machine
+	resolved := opts
+	if err := macadamClient.ApplyDefaults(&resolved); err != nil {
+		return err
+	}
+	if err := preflights.RunPreflights(macadamClient.VMProvider(), preflights.Options{
+		Skip:     initSkipChecks,
+		Memory:   resolved.Memory,
+		DiskSize: resolved.DiskSize,
+	}); err != nil {
+		registry.SetExitCode(1)
+		return newCommandError(codePreflightFailed, err)
 	}
 
-	fileInfo, err := os.Stat(diskImage)
+	m, err := macadamClient.Init(cmd.Context(), opts)
 	if err != nil {
-		return fmt.Errorf("failed to stat disk image %q: %w", diskImage, err)
-	}
-
-	diskSizeInBytes := int64(strongunits.GiB(initOptsFromFlags.DiskSize).ToBytes())
-	if fileInfo.Size() > diskSizeInBytes {
-		return fmt.Errorf("disk image %s (size: %s) is larger than the expected maximum size of %s",
-			diskImage, units.HumanSize(float64(fileInfo.Size())), units.HumanSize(float64(diskSizeInBytes)))
-	}
-
-	puller := imagepullers.NewNoopImagePuller(machineName, vmProvider.VMType())
-
-	initOpts := macadam.DefaultInitOpts(machineName)
-	initOpts.ImagePuller = puller
-	initOpts.ImagePuller.SetSourceURI(diskImage)
-	initOpts.Name = machineName
-	initOpts.Image = diskImage
-	initOpts.CPUS = initOptsFromFlags.CPUS
-	initOpts.DiskSize = initOptsFromFlags.DiskSize
-	initOpts.Memory = initOptsFromFlags.Memory
-	initOpts.SSHIdentityPath = initOptsFromFlags.SSHIdentityPath
-	initOpts.Username = initOptsFromFlags.Username
-	initOpts.CloudInit = true // this should be calculated based on the image we want to start ??
-	initOpts.CloudInitPaths = initOptsFromFlags.CloudInitPaths
-	initOpts.Capabilities = &define.MachineCapabilities{
-		HasReadyUnit:   false,
-		ForwardSockets: false,
-	}
-	/*
-		_, _, err = shim.VMExists(machineName, []vmconfigs.VMProvider{provider})
-		if err == nil {
-			return fmt.Errorf("machine %q already exists", machineName)
+		return err
+	}
+	return setMachineResult(cmd.Context(), m.Name)
+}
+
+// parseLabels parses key=value labels, a label without value has an empty
+// value
+func parseLabels(labels []string) (map[string]string, error) {
+	if len(labels) == 0 {
+		return nil, nil
+	}
+	parsed := make(map[string]string, len(labels))
+	for _, label := range labels {
+		key, value, _ := strings.Cut(label, "=")
+		if key == "" {
+			return nil, fmt.Errorf("invalid label %q, expected key=value", label)
 		}
-	*/
-	return shim.Init(*initOpts, vmProvider)
+		parsed[key] = value
+	}
+	return parsed, nil
 }
@@ -7,12 +7,13 @@ import (
 	"os"
 	"time"
 
+	"github.com/containers/common/pkg/report"
 	"github.com/containers/podman/v5/cmd/podman/utils"
 	"github.com/containers/podman/v5/pkg/machine/define"
-	"github.com/containers/podman/v5/pkg/machine/env"
 	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	"github.com/crc-org/macadam/cmd/macadam/common"
 	"github.com/crc-org/macadam/cmd/macadam/registry"
-	provider2 "github.com/crc-org/macadam/pkg/machinedriver/provider"
+	"github.com/crc-org/macadam/pkg/client"
 	"github.com/spf13/cobra"
 )
 
@@ -23,18 +24,31 @@ var (
 		Long:              "Provide details on a managed virtual machine",
 		PersistentPreRunE: machinePreRunE,
 		RunE:              inspect,
-		Example:           `podman machine inspect myvm`,
-		//ValidArgsFunction: autocompleteMachine,
+		Example: `macadam inspect myvm
+  macadam inspect --format '{{.SSHConfig.Port}}' myvm`,
+		ValidArgsFunction: autocompleteMachine,
 	}
+	inspectFormat string
 )
 
 // this is based on the struct of the same name in
 // github.com/containers/podman/v5/pkg/machine/config.go
 type InspectInfo struct {
+	Capabilities       define.MachineCapabilities
+	CloudInit          vmconfigs.CloudInitConfig
 	ConfigDir          define.VMFile
 	Created            time.Time
-	LastUp             *time.Time `json:",omitempty"`
+	DiskPath           string
+	Image              string
+	IPAddress          string
+	KnownHostsFile     string            `json:",omitempty"`
+	Labels             map[string]string `json:",omitempty"`
+	LastUp             *time.Time        `json:",omitempty"`
+	Mounts             []*vmconfigs.Mount
 	Name               string
+	Processes          client.Processes
+	Profile            string `json:",omitempty"`
+	Provider           string
 	Resources          vmconfigs.ResourceConfig
 	SSHConfig          vmconfigs.SSHConfig
 	State              define.Status
@@ -45,46 +59,50 @@ func init() {
 	registry.Commands = append(registry.Commands, registry.CliCommand{
 		Command: inspectCmd,
 	})
+
+	flags := inspectCmd.Flags()
+	formatFlagName := "format"
+	flags.StringVar(&inspectFormat, formatFlagName, "", "Format inspect output using JSON or a Go template")
+	_ = inspectCmd.RegisterFlagCompletionFunc(formatFlagName, common.AutocompleteFormat(&InspectInfo{}))
 }
 
 func inspect(cmd *cobra.Command, args []string) error {
 	var (
 		errs utils.OutputErrors
 	)
-	vmProvider, err := provider2.GetProviderOrDefault(provider)
-	if err != nil {
-		return err
-	}
-	dirs, err := env.GetMachineDirs(vmProvider.VMType())
-	if err != nil {
-		return err
-	}
 	if len(args) < 1 {
-		args = append(args, defaultMachineName)
+		// an empty name is the default machine
+		args = append(args, "")
 	}
 
 	vms := make([]InspectInfo, 0, len(args))
 	for _, name := range args {
-		mc, err := vmconfigs.LoadMachineByName(name, dirs)
+		m, err := macadamClient.Inspect(cmd.Context(), name)
 		if err != nil {
 			errs = append(errs, err)
 			continue
 		}
 
-		state, err := vmProvider.State(mc, false)
-		if err != nil {
-			return err
-		}
-
 		ii := InspectInfo{
-			ConfigDir:          *dirs.ConfigDir,
-			Created:            mc.Created,
-			LastUp:             &mc.LastUp,
-			Name:               mc.Name,
-			Resources:          mc.Resources,
-			SSHConfig:          mc.SSH,
-			State:              state,
-			UserModeNetworking: vmProvider.UserModeNetworkEnabled(mc),
+			Capabilities:       m.Capabilities,
+			CloudInit:          m.CloudInit,
+			ConfigDir:          m.ConfigDir,
+			Created:            m.Created,
+			DiskPath:           m.DiskPath,
+			Image:              m.Image,
+			IPAddress:          m.IPAddress,
+			KnownHostsFile:     m.KnownHostsFile,
+			Labels:             m.Labels,
+			LastUp:             &m.LastUp,
+			Mounts:             m.Mounts,
+			Name:               m.Name,
+			Processes:          m.Processes,
+			Profile:            m.Profile,
+			Provider:           m.VMType.String(),
+			Resources:          m.Resources,
+			SSHConfig:          m.SSH,
+			State:              m.State,
+			UserModeNetworking: m.UserModeNetworking,
 		}
 		if ii.LastUp.IsZero() {
 			ii.LastUp = nil
@@ -93,12 +111,28 @@ func inspect(cmd *cobra.Command, args []string) error {
 		vms = append(vms, ii)
 	}
 
-	if err := printJSON(vms); err != nil {
-		errs = append(errs, err)
+	switch {
+	case inspectFormat == "" || report.IsJSON(inspectFormat):
+		if err := printJSON(vms); err != nil {
+			errs = append(errs, err)
+		}
+	default:
+		if err := printTemplate(cmd, vms); err != nil {
+			errs = append(errs, err)
+		}
 	}
 	return errs.PrintErrors()
 }
 
+func printTemplate(cmd *cobra.Command, data []InspectInfo) error {
+	rpt, err := report.New(os.Stdout, cmd.Name()).Parse(report.OriginUser, inspectFormat)
+	if err != nil {
+		return err
+	}
+	defer rpt.Flush()
+	return rpt.Execute(data)
+}
+
 func printJSON(data []InspectInfo) error {
 	enc := json.NewEncoder(os.Stdout)
 	// by default, json marshallers will force utf=8 from
@@ -11,12 +11,9 @@ import (
 	"github.com/containers/common/pkg/completion"
 	"github.com/containers/common/pkg/report"
 	"github.com/containers/podman/v5/pkg/domain/entities"
-	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
 	"github.com/crc-org/macadam/cmd/macadam/common"
 	"github.com/crc-org/macadam/cmd/macadam/registry"
-	macadam "github.com/crc-org/macadam/pkg/machinedriver"
-	provider2 "github.com/crc-org/macadam/pkg/machinedriver/provider"
-	"github.com/crc-org/machine/libmachine/state"
+	"github.com/crc-org/macadam/pkg/client"
 	"github.com/docker/go-units"
 	"github.com/spf13/cobra"
 )
@@ -46,6 +43,7 @@ type listFlagType struct {
 
 type ListReporter struct {
 	Name           string
+	IsDefault      bool
 	Image          string
 	Created        string
 	Running        bool
@@ -58,6 +56,8 @@ type ListReporter struct {
 	RemoteUsername string
 	IdentityPath   string
 	VMType         string
+	// Default marks the default machine with "*" in the human output
+	Default string `json:"-"`
 }
 
 func init() {
@@ -67,7 +67,7 @@ func init() {
 
 	flags := lsCmd.Flags()
 	formatFlagName := "format"
-	flags.StringVar(&listFlag.format, formatFlagName, "{{range .}}{{.Name}}\t{{.VMType}}\t{{.Created}}\t{{.LastUp}}\t{{.CPUs}}\t{{.Memory}}\t{{.DiskSize}}\n{{end -}}", "Format volume output using JSON or a Go template")
+	flags.StringVar(&listFlag.format, formatFlagName, "{{range .}}{{.Name}}\t{{.Default}}\t{{.VMType}}\t{{.Created}}\t{{.LastUp}}\t{{.CPUs}}\t{{.Memory}}\t{{.DiskSize}}\n{{end -}}", "Format volume output using JSON or a Go template")
 	_ = lsCmd.RegisterFlagCompletionFunc(formatFlagName, common.AutocompleteFormat(ListReporter{}))
 
 	flags.BoolVarP(&listFlag.noHeading, "noheading", "n", false, "Do not print headers")
@@ -75,34 +75,22 @@ func init() {
 }
 
 func list(cmd *cobra.Command, args []string) error {
-	vmProvider, err := provider2.GetProviderOrDefault(provider)
-	if err != nil {
-		return err
-	}
-	providers := []vmconfigs.VMProvider{vmProvider}
-
-	listDrivers, err := macadam.List(providers)
+	machines, err := macadamClient.List(cmd.Context())
 	if err != nil {
 		return err
 	}
 
 	// Sort by last run
-	sort.Slice(listDrivers, func(i, j int) bool {
-		lhs_vm := listDrivers[i].GetVmConfig()
-		rhs_vm := listDrivers[j].GetVmConfig()
-		return lhs_vm.LastUp.After(rhs_vm.LastUp)
+	sort.Slice(machines, func(i, j int) bool {
+		return machines[i].LastUp.After(machines[j].LastUp)
 	})
 	// Bring currently running machines to top
-	sort.Slice(listDrivers, func(i, j int) bool {
-		vmState, err := listDrivers[i].GetState()
-		if err != nil {
-			return false
-		}
-		return vmState == state.Running
+	sort.SliceStable(machines, func(i, j int) bool {
+		return machines[i].Running() && !machines[j].Running()
 	})
 
-	if report.IsJSON(listFlag.format) {
-		machineReporter := toMachineFormat(listDrivers)
+	if report.IsJSON(listFlag.format) || jsonOutput() {
+		machineReporter := toMachineFormat(machines)
 		b, err := json.MarshalIndent(machineReporter, "", "    ")
 		if err != nil {
 			return err
@@ -111,7 +99,7 @@ func list(cmd *cobra.Command, args []string) error {
 
 		return nil
 	}
-	machineReporter := toHumanFormat(listDrivers)
+	machineReporter := toHumanFormat(machines)
 	return outputTemplate(cmd, machineReporter)
 }
 
@@ -160,21 +148,15 @@ func strUint(u uint64) string {
 	return strconv.FormatUint(u, 10)
 }
 
-func toMachineFormat(drivers []*macadam.Driver) []ListReporter {
+func toMachineFormat(machines []*client.Machine) []ListReporter {
 	machineResponses := []ListReporter{}
 
-	for _, d := range drivers {
-		vm := d.GetVmConfig()
-
-		vmState, err := d.GetState()
-		if err != nil {
-			return machineResponses
-		}
-
+	for _, vm := range machines {
 		response := new(ListReporter)
 		response.Name = vm.Name
-		response.Image = vm.ImagePath.Path
-		response.Running = vmState == state.Running
+		response.IsDefault = vm.IsDefault
+		response.Image = vm.Image
+		response.Running = vm.Running()
 		response.LastUp = strTime(vm.LastUp)
 		response.Created = strTime(vm.Created)
 		response.CPUs = vm.Resources.CPUs
@@ -184,7 +166,7 @@ func toMachineFormat(drivers []*macadam.Driver) []ListReporter {
 		response.RemoteUsername = vm.SSH.RemoteUsername
 		response.IdentityPath = vm.SSH.IdentityPath
 		response.Starting = vm.Starting
-		response.VMType = d.GetVMType().String()
+		response.VMType = vm.VMType.String()
 
 		machineResponses = append(machineResponses, *response)
 	}
@@ -192,25 +174,22 @@ func toMachineFormat(drivers []*macadam.Driver) []ListReporter {
 	return machineResponses
 }
 
-func toHumanFormat(drivers []*macadam.Driver) []ListReporter {
+func toHumanFormat(machines []*client.Machine) []ListReporter {
 	humanResponses := []ListReporter{}
 
-	for _, d := range drivers {
-		vm := d.GetVmConfig()
-
-		vmState, err := d.GetState()
-		if err != nil {
-			return humanResponses
-		}
-
+	for _, vm := range machines {
 		response := new(ListReporter)
 		response.Name = vm.Name
+		response.IsDefault = vm.IsDefault
+		if vm.IsDefault {
+			response.Default = "*"
+		}
 		response.LastUp = strTime(vm.LastUp)
 		switch {
 		case vm.Starting:
 			response.LastUp = "Currently starting"
 			response.Starting = true
-		case vmState == state.Running:
+		case vm.Running():
 			response.LastUp = "Currently running"
 			response.Running = true
 		case vm.LastUp.IsZero():
@@ -225,7 +204,7 @@ func toHumanFormat(drivers []*macadam.Driver) []ListReporter {
 		response.Port = vm.SSH.Port
 		response.RemoteUsername = vm.SSH.RemoteUsername
 		response.IdentityPath = vm.SSH.IdentityPath
-		response.VMType = d.GetVMType().String()
+		response.VMType = vm.VMType.String()
 
 		humanResponses = append(humanResponses, *response)
 	}
@@ -5,11 +5,18 @@ import (
 	"os"
 
 	"github.com/crc-org/macadam/cmd/macadam/registry"
+	"github.com/crc-org/macadam/pkg/env"
 
 	"github.com/spf13/cobra"
 )
 
 func main() {
+	// MACADAM_HOME must be applied before any path is computed, including
+	// the one of the debug log
+	if err := env.SetupHome(); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid MACADAM_HOME: %v\n", err)
+		os.Exit(1)
+	}
 	rootCmd = parseCommands()
 
 	Execute()
@@ -26,7 +33,7 @@ func parseCommands() *cobra.Command {
 }
 
 func flagErrorFuncfunc(c *cobra.Command, e error) error {
-	e = fmt.Errorf("%w\nSee '%s --help'", e, c.CommandPath())
+	e = newCommandError(codeInvalidArgument, fmt.Errorf("%w\nSee '%s --help'", e, c.CommandPath()))
 	return e
 }
 
@@ -0,0 +1,366 @@
+//go:build amd64 || arm64
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/crc-org/macadam/cmd/macadam/registry"
+	"github.com/crc-org/macadam/internal/testenv"
+	"github.com/crc-org/macadam/pkg/client"
+	"github.com/crc-org/macadam/pkg/machinedriver/provider/fake"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// fakeProvider runs the machines of the commands run by runMacadam
+var fakeProvider *fake.Provider
+
+func TestMain(m *testing.M) {
+	testenv.Main(m, func(string) (func(), error) {
+		fakeProvider = testenv.FakeProvider()
+		vmProviderOverride = fakeProvider
+		rootCmd = parseCommands()
+		return fakeProvider.Close, nil
+	})
+}
+
+// runMacadam runs macadam in-process with the fake provider, like main does,
+// and returns what it printed on stdout with the error of the command
+func runMacadam(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	resetFlags(rootCmd)
+	result = nil
+	warnings = nil
+	registry.SetExitCode(0)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	output := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		output <- string(b)
+	}()
+
+	start := time.Now()
+	rootCmd.SetArgs(args)
+	cmdErr := rootCmd.ExecuteContext(context.Background())
+	if jsonOutput() {
+		printResult(start, cmdErr)
+	}
+
+	os.Stdout = stdout
+	w.Close()
+	return <-output, cmdErr
+}
+
+// resetFlags sets the flags of cmd and of its subcommands back to their
+// default value, as they keep the value of the previous run
+func resetFlags(cmd *cobra.Command) {
+	reset := func(flag *pflag.Flag) {
+		if !flag.Changed {
+			return
+		}
+		if value, ok := flag.Value.(pflag.SliceValue); ok {
+			_ = value.Replace(nil)
+		} else {
+			_ = flag.Value.Set(flag.DefValue)
+		}
+		flag.Changed = false
+	}
+	cmd.Flags().VisitAll(reset)
+	cmd.PersistentFlags().VisitAll(reset)
+	for _, child := range cmd.Commands() {
+		resetFlags(child)
+	}
+}
+
+// mustRunMacadam runs macadam, and fails the test when the command fails
+func mustRunMacadam(t *testing.T, args ...string) string {
+	t.Helper()
+	output, err := runMacadam(t, args...)
+	if err != nil {
+		t.Fatalf("macadam %s: %v\n%s", strings.Join(args, " "), err, output)
+	}
+	return output
+}
+
+// createMachine creates a machine from a fake disk image, which is removed at
+// the end of the test
+func createMachine(t *testing.T, name string, args ...string) {
+	t.Helper()
+	image := filepath.Join(t.TempDir(), "disk.qcow2")
+	if err := os.WriteFile(image, []byte("disk"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mustRunMacadam(t, append([]string{"init", "--name", name, image}, args...)...)
+	t.Cleanup(func() {
+		_, _ = runMacadam(t, "rm", "--force", name)
+	})
+}
+
+func listMachines(t *testing.T) map[string]ListReporter {
+	t.Helper()
+	var machines []ListReporter
+	if err := json.Unmarshal([]byte(mustRunMacadam(t, "list", "--format", "json")), &machines); err != nil {
+		t.Fatal(err)
+	}
+	byName := map[string]ListReporter{}
+	for _, m := range machines {
+		byName[m.Name] = m
+	}
+	return byName
+}
+
+func parseResult(t *testing.T, output string) *commandResult {
+	t.Helper()
+	var res commandResult
+	if err := json.Unmarshal([]byte(output), &res); err != nil {
+		t.Fatalf("invalid JSON result: %v\n%s", err, output)
+	}
+	return &res
+}
+
+func TestLifecycle(t *testing.T) {
+	createMachine(t, "lifecycle", "--cpus", "3")
+
+	m, ok := listMachines(t)["lifecycle"]
+	if !ok {
+		t.Fatal("the machine is not listed")
+	}
+	if m.CPUs != 3 || m.Running {
+		t.Errorf("unexpected machine %+v", m)
+	}
+
+	mustRunMacadam(t, "start", "lifecycle")
+	if !listMachines(t)["lifecycle"].Running {
+		t.Error("the machine is not running")
+	}
+
+	mustRunMacadam(t, "stop", "lifecycle")
+	if listMachines(t)["lifecycle"].Running {
+		t.Error("the machine is still running")
+	}
+
+	mustRunMacadam(t, "rm", "--force", "lifecycle")
+	if _, ok := listMachines(t)["lifecycle"]; ok {
+		t.Error("the machine is still listed")
+	}
+}
+
+func TestInitExisting(t *testing.T) {
+	createMachine(t, "existing")
+	image := filepath.Join(t.TempDir(), "disk.qcow2")
+	if err := os.WriteFile(image, []byte("disk"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := runMacadam(t, "--format", "json", "init", "--name", "existing", image)
+	if err == nil {
+		t.Fatal("init succeeded")
+	}
+	if res := parseResult(t, output); res.Error == nil || res.Error.Code != client.ErrorCode(client.ErrMachineExists) {
+		t.Errorf("unexpected result %+v", res)
+	}
+}
+
+func TestInspect(t *testing.T) {
+	createMachine(t, "inspected", "--label", "env=test")
+
+	var machines []map[string]any
+	if err := json.Unmarshal([]byte(mustRunMacadam(t, "inspect", "inspected")), &machines); err != nil {
+		t.Fatal(err)
+	}
+	if len(machines) != 1 || machines[0]["Name"] != "inspected" {
+		t.Fatalf("unexpected inspect output %v", machines)
+	}
+	if labels, _ := machines[0]["Labels"].(map[string]any); labels["env"] != "test" {
+		t.Errorf("unexpected labels %v", machines[0]["Labels"])
+	}
+}
+
+func TestStartJSON(t *testing.T) {
+	createMachine(t, "started")
+
+	res := parseResult(t, mustRunMacadam(t, "--format", "json", "start", "started"))
+	if res.Machine != "started" || res.State != string(define.Running) || res.Error != nil {
+		t.Errorf("unexpected result %+v", res)
+	}
+}
+
+func TestStartFailure(t *testing.T) {
+	createMachine(t, "failing")
+	fakeProvider.Fail(fake.OpStartVM, fmt.Errorf("no hypervisor"))
+	defer fakeProvider.Fail(fake.OpStartVM, nil)
+
+	output, err := runMacadam(t, "--format", "json", "start", "failing")
+	if err == nil {
+		t.Fatal("start succeeded")
+	}
+	res := parseResult(t, output)
+	if res.Error == nil || !strings.Contains(res.Error.Message, "no hypervisor") {
+		t.Errorf("unexpected result %+v", res)
+	}
+	if listMachines(t)["failing"].Running {
+		t.Error("the machine is running")
+	}
+}
+
+func TestExec(t *testing.T) {
+	createMachine(t, "exec")
+	mustRunMacadam(t, "start", "exec")
+	fakeProvider.SetExec(func(_, command string, stdout, _ io.Writer) int {
+		// exec quotes the arguments for the shell of the machine
+		switch command {
+		case "'echo' 'hello'":
+			fmt.Fprintln(stdout, "hello")
+		case "'false'":
+			return 1
+		}
+		return 0
+	})
+	defer fakeProvider.SetExec(nil)
+
+	if output := mustRunMacadam(t, "exec", "--machine", "exec", "--", "echo", "hello"); output != "hello\n" {
+		t.Errorf("unexpected output %q", output)
+	}
+
+	// with --json, the exit code of the command is the exit code of macadam
+	output := mustRunMacadam(t, "exec", "--machine", "exec", "--json", "--", "false")
+	var res execResult
+	if err := json.Unmarshal([]byte(output), &res); err != nil {
+		t.Fatalf("invalid JSON result: %v\n%s", err, output)
+	}
+	if res.ExitCode != 1 || registry.GetExitCode() != 1 {
+		t.Errorf("unexpected result %+v, exit code %d", res, registry.GetExitCode())
+	}
+}
+
+func TestRmRequiresForce(t *testing.T) {
+	createMachine(t, "kept")
+
+	output, err := runMacadam(t, "--format", "json", "rm", "kept")
+	if err == nil {
+		t.Fatal("rm succeeded")
+	}
+	if res := parseResult(t, output); res.Error == nil || res.Error.Code != codeConfirmationRequired {
+		t.Errorf("unexpected result %+v", res)
+	}
+	if _, ok := listMachines(t)["kept"]; !ok {
+		t.Error("the machine was removed")
+	}
+}
+
+func TestRmRunning(t *testing.T) {
+	createMachine(t, "running")
+	mustRunMacadam(t, "start", "running")
+
+	if _, err := runMacadam(t, "rm", "running"); !errors.Is(err, client.ErrMachineRunning) {
+		t.Errorf("rm of a running machine returned %v", err)
+	}
+	if m, ok := listMachines(t)["running"]; !ok || !m.Running {
+		t.Error("the running machine was removed or stopped")
+	}
+}
+
+func TestSystemDefault(t *testing.T) {
+	createMachine(t, "first")
+	createMachine(t, "second")
+
+	mustRunMacadam(t, "system", "default", "second")
+	if output := strings.TrimSpace(mustRunMacadam(t, "system", "default")); output != "second" {
+		t.Errorf("unexpected default machine %q", output)
+	}
+	machines := listMachines(t)
+	if machines["first"].IsDefault || !machines["second"].IsDefault {
+		t.Errorf("unexpected machines %+v", machines)
+	}
+	// the default machine is marked in its own column, not in its name
+	output := mustRunMacadam(t, "list", "--format", "{{range .}}{{.Name}}={{.IsDefault}}\n{{end}}")
+	for _, line := range []string{"first=false", "second=true"} {
+		if !strings.Contains("\n"+output, "\n"+line+"\n") {
+			t.Errorf("%q is not in the list output\n%s", line, output)
+		}
+	}
+}
+
+func TestSystemInfo(t *testing.T) {
+	createMachine(t, "info")
+	mustRunMacadam(t, "start", "info")
+
+	var report systemInfoReport
+	if err := json.Unmarshal([]byte(mustRunMacadam(t, "--format", "json", "system", "info")), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Machines.Total != 1 || report.Machines.States[string(define.Running)] != 1 {
+		t.Errorf("unexpected machines %+v", report.Machines)
+	}
+	if !strings.HasPrefix(report.Dirs.ConfigDir, os.Getenv("XDG_CONFIG_HOME")) {
+		t.Errorf("unexpected configuration directory %s", report.Dirs.ConfigDir)
+	}
+}
+
+func TestSystemReset(t *testing.T) {
+	createMachine(t, "reset1")
+	createMachine(t, "reset2")
+	mustRunMacadam(t, "start", "reset1")
+
+	if _, err := runMacadam(t, "--format", "json", "system", "reset"); err == nil {
+		t.Error("reset succeeded without --force")
+	}
+	mustRunMacadam(t, "system", "reset", "--force")
+	if machines := listMachines(t); len(machines) != 0 {
+		t.Errorf("machines were not removed: %v", machines)
+	}
+	if output := mustRunMacadam(t, "system", "reset"); !strings.HasPrefix(output, "Nothing to reset") {
+		t.Errorf("unexpected output %q", output)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	createMachine(t, "pruned")
+
+	var info systemInfoReport
+	if err := json.Unmarshal([]byte(mustRunMacadam(t, "--format", "json", "system", "info")), &info); err != nil {
+		t.Fatal(err)
+	}
+	orphan := filepath.Join(info.Dirs.DataDir, "gone-qemu.qcow2")
+	if err := os.WriteFile(orphan, []byte("disk"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var report pruneReport
+	if err := json.Unmarshal([]byte(mustRunMacadam(t, "--format", "json", "prune", "--dry-run")), &report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Files) != 1 || report.Files[0].Path != orphan || report.Size != 4 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if _, err := os.Stat(orphan); err != nil {
+		t.Errorf("the file was removed with --dry-run: %v", err)
+	}
+
+	if output := mustRunMacadam(t, "prune"); !strings.Contains(output, orphan) {
+		t.Errorf("unexpected output %q", output)
+	}
+	if _, err := os.Stat(orphan); err == nil {
+		t.Error("the file was not removed")
+	}
+	if _, ok := listMachines(t)["pruned"]; !ok {
+		t.Error("the machine was removed")
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crc-org/macadam/pkg/client"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	codeInvalidArgument      = "invalid_argument"
+	codePreflightFailed      = "preflight_failed"
+	codeConfirmationRequired = "confirmation_required"
+)
+
+// commandResult is the JSON object printed by the commands when the global
+// --format json flag is used
+type commandResult struct {
+	// Machine is the name of the machine the command operated on
+	Machine string `json:",omitempty"`
+	// State is the state of the machine after the command, it is empty
+	// when the machine was removed
+	State string `json:",omitempty"`
+	// Duration is the time taken by the command, in seconds
+	Duration float64
+	// Warnings are the warnings logged while running the command
+	Warnings []string
+	// Error is set when the command failed
+	Error *resultError `json:",omitempty"`
+}
+
+// resultError describes the error of a failed command
+type resultError struct {
+	// Code is a stable identifier of the error, such as machine_not_found
+	Code    string
+	Message string
+}
+
+// commandError is an error of the command line tool itself, such as an
+// invalid flag, with its error code
+type commandError struct {
+	code string
+	err  error
+}
+
+func newCommandError(code string, err error) error {
+	return &commandError{code: code, err: err}
+}
+
+func (err *commandError) Error() string {
+	return err.err.Error()
+}
+
+func (err *commandError) Unwrap() error {
+	return err.err
+}
+
+var (
+	outputFormat = ""
+
+	// result is set by the commands which report the machine they operated
+	// on, it is printed by printResult
+	result *commandResult
+
+	warningsLock sync.Mutex
+	warnings     = []string{}
+)
+
+// jsonOutput returns true when the global --format json flag is used
+func jsonOutput() bool {
+	return outputFormat == "json"
+}
+
+// outputHook validates the global --format flag, and collects the warnings
+// to include them in the JSON result
+func outputHook() {
+	switch outputFormat {
+	case "":
+		return
+	case "json":
+	default:
+		fmt.Fprintf(os.Stderr, "Format %q is not supported, only json can be used\n", outputFormat)
+		os.Exit(1)
+	}
+
+	// the warnings are still logged on stderr
+	logrus.AddHook(warningsHook{})
+	slog.SetDefault(slog.New(&warningsHandler{
+		Handler: slog.NewTextHandler(os.Stderr, nil),
+	}))
+}
+
+func addWarning(warning string) {
+	warningsLock.Lock()
+	defer warningsLock.Unlock()
+	warnings = append(warnings, warning)
+}
+
+// warningsHook collects the warnings logged by the podman code with logrus
+type warningsHook struct{}
+
+func (warningsHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel, logrus.WarnLevel}
+}
+
+func (warningsHook) Fire(entry *logrus.Entry) error {
+	addWarning(entry.Message)
+	return nil
+}
+
+// warningsHandler collects the warnings logged by the macadam code with slog
+type warningsHandler struct {
+	slog.Handler
+}
+
+func (h *warningsHandler) Handle(ctx context.Context, record slog.Record) error {
+	if record.Level >= slog.LevelWarn {
+		warning := []string{record.Message}
+		record.Attrs(func(attr slog.Attr) bool {
+			warning = append(warning, attr.String())
+			return true
+		})
+		addWarning(strings.Join(warning, " "))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *warningsHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &warningsHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *warningsHandler) WithGroup(name string) slog.Handler {
+	return &warningsHandler{Handler: h.Handler.WithGroup(name)}
+}
+
+// setMachineResult records the machine a command operated on, with its
+// current state, for the JSON result
+func setMachineResult(ctx context.Context, name string) error {
+	if !jsonOutput() {
+		return nil
+	}
+	m, err := macadamClient.Inspect(ctx, name)
+	if err != nil {
+		return err
+	}
+	result = &commandResult{
+		Machine: m.Name,
+		State:   string(m.State),
+	}
+	return nil
+}
+
+// printResult prints the JSON result of the command. Commands which print
+// their own JSON output, such as list, only print a result when they fail.
+func printResult(start time.Time, err error) {
+	if result == nil && err == nil {
+		return
+	}
+	if result == nil {
+		result = &commandResult{}
+	}
+	result.Duration = time.Since(start).Seconds()
+	warningsLock.Lock()
+	result.Warnings = warnings
+	warningsLock.Unlock()
+	if err != nil {
+		result.Error = &resultError{
+			Code:    errorCode(err),
+			Message: err.Error(),
+		}
+	}
+
+	b, err := json.MarshalIndent(result, "", "    ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	fmt.Println(string(b))
+}
+
+func errorCode(err error) string {
+	var cmdErr *commandError
+	if errors.As(err, &cmdErr) {
+		return cmdErr.code
+	}
+	return client.ErrorCode(err)
+}
@@ -1,33 +1,121 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
 	"github.com/crc-org/macadam/cmd/macadam/registry"
-	provider2 "github.com/crc-org/macadam/pkg/machinedriver/provider"
 	"github.com/crc-org/macadam/pkg/preflights"
 	"github.com/spf13/cobra"
 )
 
 var (
 	preflightsCmd = &cobra.Command{
-		Use:     "preflight",
-		Short:   "Perform preflight checks on an existing machine",
-		Long:    "Perform preflight checks on a managed virtual machine ",
-		RunE:    preflight,
-		Args:    cobra.MaximumNArgs(0),
-		Example: `macadam preflight`,
+		Use:   "preflight",
+		Short: "Perform preflight checks on an existing machine",
+		Long:  "Perform preflight checks on a managed virtual machine ",
+		RunE:  preflight,
+		Args:  cobra.MaximumNArgs(0),
+		Example: `macadam preflight
+  macadam preflight --skip-check gvproxy-version
+  macadam preflight --format json`,
 	}
+
+	preflightSkipChecks []string
 )
 
 func init() {
 	registry.Commands = append(registry.Commands, registry.CliCommand{
 		Command: preflightsCmd,
 	})
+
+	addSkipCheckFlag(preflightsCmd, &preflightSkipChecks)
+}
+
+// addSkipCheckFlag adds the --skip-check flag, shared by preflight and init,
+// to cmd
+func addSkipCheckFlag(cmd *cobra.Command, skip *[]string) {
+	skipCheckFlagName := "skip-check"
+	cmd.Flags().StringArrayVar(skip, skipCheckFlagName, []string{}, "Name of a preflight check to skip, can be repeated")
+	_ = cmd.RegisterFlagCompletionFunc(skipCheckFlagName, func(_ *cobra.Command, _ []string, _ string) ([]string, cobra.ShellCompDirective) {
+		names := []string{}
+		for _, check := range preflights.Checks() {
+			names = append(names, check.Name+"\t"+check.Description)
+		}
+		return names, cobra.ShellCompDirectiveNoFileComp
+	})
 }
 
-func preflight(_ *cobra.Command, args []string) error {
-	vmProvider, err := provider2.GetProviderOrDefault(provider)
+func preflight(_ *cobra.Command, _ []string) error {
+	if err := preflights.ValidateSkip(preflightSkipChecks); err != nil {
+		return newCommandError(codeInvalidArgument, err)
+	}
+	// the memory and disk checks use the settings of a machine created
+	// without flags
+	defaults := macadamClient.MachineDefaults()
+	results, err := preflights.Run(macadamClient.VMProvider(), preflights.Options{
+		Skip:     preflightSkipChecks,
+		Memory:   defaults.Memory,
+		DiskSize: defaults.DiskSize,
+	})
 	if err != nil {
 		return err
 	}
-	return preflights.RunPreflights(vmProvider)
+
+	if jsonOutput() {
+		b, err := json.MarshalIndent(results, "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		// the results already tell which checks failed
+		if preflights.Err(results) != nil {
+			registry.SetExitCode(1)
+		}
+		return nil
+	}
+
+	printPreflightResults(results)
+	failed := 0
+	for _, res := range results {
+		if res.Severity == preflights.SeverityError && res.Status == preflights.StatusFailed {
+			failed++
+		}
+	}
+	if failed > 0 {
+		registry.SetExitCode(1)
+		// the failures were already printed with their hints
+		return newCommandError(codePreflightFailed, fmt.Errorf("%d preflight check(s) failed", failed))
+	}
+	return nil
+}
+
+// printPreflightResults prints one line per check run or skipped, the checks
+// of the other providers are only listed in the JSON output
+func printPreflightResults(results []preflights.Result) {
+	for _, res := range results {
+		var status string
+		switch res.Status {
+		case preflights.StatusPassed:
+			status = "PASS"
+		case preflights.StatusSkipped:
+			status = "SKIP"
+		case preflights.StatusFailed:
+			status = "FAIL"
+			if res.Severity == preflights.SeverityWarning {
+				status = "WARN"
+			}
+		default:
+			continue
+		}
+		fmt.Fprintf(os.Stdout, "%s  %-16s %s\n", status, res.Name, res.Description)
+		if res.Status == preflights.StatusFailed {
+			fmt.Fprintf(os.Stdout, "      %s\n", strings.TrimSpace(res.Message))
+			if res.Remediation != "" {
+				fmt.Fprintf(os.Stdout, "      hint: %s\n", res.Remediation)
+			}
+		}
+	}
 }
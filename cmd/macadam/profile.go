@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/common/pkg/completion"
+	"github.com/containers/common/pkg/report"
+	"github.com/crc-org/macadam/cmd/macadam/common"
+	"github.com/crc-org/macadam/cmd/macadam/registry"
+	"github.com/crc-org/macadam/pkg/profiles"
+	"github.com/spf13/cobra"
+)
+
+var (
+	profileCmd = &cobra.Command{
+		Use:               "profile",
+		Short:             "Manage machine profiles",
+		Long:              "Manage the named profiles which can be used with 'macadam init --profile'",
+		PersistentPreRunE: noPreRunE,
+		RunE:              validateSubcommand,
+	}
+
+	profileListCmd = &cobra.Command{
+		Use:               "list [options]",
+		Aliases:           []string{"ls"},
+		Short:             "List profiles",
+		Long:              "List machine profiles",
+		RunE:              profileList,
+		Args:              cobra.NoArgs,
+		ValidArgsFunction: completion.AutocompleteNone,
+		Example: `macadam profile list
+  macadam profile list --format json`,
+	}
+
+	profileShowCmd = &cobra.Command{
+		Use:               "show PROFILE",
+		Short:             "Show a profile",
+		Long:              "Print the content of a machine profile",
+		RunE:              profileShow,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: autocompleteProfiles,
+		Example:           `macadam profile show small-ci`,
+	}
+
+	profileCreateCmd = &cobra.Command{
+		Use:               "create [options] PROFILE",
+		Short:             "Create a profile",
+		Long:              "Create a machine profile, unspecified values will use the macadam defaults",
+		RunE:              profileCreate,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completion.AutocompleteNone,
+		Example:           `macadam profile create --cpus 16 --disk-size 100 kernel-dev`,
+	}
+
+	profileRmCmd = &cobra.Command{
+		Use:               "rm PROFILE [PROFILE...]",
+		Aliases:           []string{"remove"},
+		Short:             "Remove profiles",
+		Long:              "Remove machine profiles, machines created from these profiles are not affected",
+		RunE:              profileRm,
+		Args:              cobra.MinimumNArgs(1),
+		ValidArgsFunction: autocompleteProfiles,
+		Example:           `macadam profile rm small-ci`,
+	}
+
+	profileListFormat = ""
+	profileFromFlags  = profiles.Profile{}
+)
+
+type ProfileReporter struct {
+	Name      string
+	CPUs      string
+	Memory    string
+	DiskSize  string
+	Username  string
+	Image     string
+	CloudInit []string
+	Volumes   []string
+}
+
+func init() {
+	registry.Commands = append(registry.Commands, registry.CliCommand{
+		Command: profileCmd,
+	})
+	for _, c := range []*cobra.Command{profileListCmd, profileShowCmd, profileCreateCmd, profileRmCmd} {
+		registry.Commands = append(registry.Commands, registry.CliCommand{
+			Command: c,
+			Parent:  profileCmd,
+		})
+	}
+
+	listFlags := profileListCmd.Flags()
+	formatFlagName := "format"
+	listFlags.StringVar(&profileListFormat, formatFlagName, "{{range .}}{{.Name}}\t{{.CPUs}}\t{{.Memory}}\t{{.DiskSize}}\t{{.Image}}\n{{end -}}", "Format profile output using JSON or a Go template")
+	_ = profileListCmd.RegisterFlagCompletionFunc(formatFlagName, common.AutocompleteFormat(&ProfileReporter{}))
+
+	flags := profileCreateCmd.Flags()
+	flags.Uint64Var(&profileFromFlags.CPUs, "cpus", 0, "Number of CPUs")
+	flags.Uint64VarP(&profileFromFlags.Memory, "memory", "m", 0, "Memory in MiB")
+	flags.Uint64Var(&profileFromFlags.DiskSize, "disk-size", 0, "Disk size in GiB")
+	flags.StringVar(&profileFromFlags.Username, "username", "", "Username used in image")
+	flags.StringVar(&profileFromFlags.Image, "image", "", "Path to the disk image used when none is given to 'macadam init'")
+	flags.StringSliceVar(&profileFromFlags.CloudInit, "cloud-init", []string{}, "Path to user-data, meta-data and network-config cloud-init configuration files")
+	flags.StringArrayVarP(&profileFromFlags.Volumes, "volume", "v", []string{}, "Volumes to mount, source:target")
+	for _, flagName := range []string{"cpus", "memory", "disk-size", "username"} {
+		_ = profileCreateCmd.RegisterFlagCompletionFunc(flagName, completion.AutocompleteNone)
+	}
+	for _, flagName := range []string{"image", "cloud-init", "volume"} {
+		_ = profileCreateCmd.RegisterFlagCompletionFunc(flagName, completion.AutocompleteDefault)
+	}
+}
+
+func profileList(cmd *cobra.Command, _ []string) error {
+	profileList, err := profiles.List()
+	if err != nil {
+		return err
+	}
+
+	if report.IsJSON(profileListFormat) || jsonOutput() {
+		b, err := json.MarshalIndent(profileList, "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+
+	responses := make([]ProfileReporter, 0, len(profileList))
+	for _, p := range profileList {
+		responses = append(responses, toProfileReporter(p))
+	}
+
+	headers := report.Headers(ProfileReporter{}, map[string]string{
+		"CPUs":     "CPUS",
+		"DiskSize": "DISK SIZE",
+	})
+
+	rpt := report.New(os.Stdout, cmd.Name())
+	defer rpt.Flush()
+
+	origin := report.OriginPodman
+	if cmd.Flag("format").Changed {
+		origin = report.OriginUser
+	}
+	rpt, err = rpt.Parse(origin, profileListFormat)
+	if err != nil {
+		return err
+	}
+	if rpt.RenderHeaders {
+		if err := rpt.Execute(headers); err != nil {
+			return fmt.Errorf("failed to write report column headers: %w", err)
+		}
+	}
+	return rpt.Execute(responses)
+}
+
+func toProfileReporter(p *profiles.Profile) ProfileReporter {
+	unset := func(value uint64, unit string) string {
+		if value == 0 {
+			return "-"
+		}
+		return fmt.Sprintf("%d%s", value, unit)
+	}
+	return ProfileReporter{
+		Name:      p.Name,
+		CPUs:      unset(p.CPUs, ""),
+		Memory:    unset(p.Memory, "MiB"),
+		DiskSize:  unset(p.DiskSize, "GiB"),
+		Username:  p.Username,
+		Image:     p.Image,
+		CloudInit: p.CloudInit,
+		Volumes:   p.Volumes,
+	}
+}
+
+func profileShow(_ *cobra.Command, args []string) error {
+	profile, err := profiles.Load(args[0])
+	if err != nil {
+		return err
+	}
+	b, err := profile.Marshal()
+	if err != nil {
+		return err
+	}
+	fmt.Print(string(b))
+	return nil
+}
+
+func profileCreate(_ *cobra.Command, args []string) error {
+	name := args[0]
+	exists, err := profiles.Exists(name)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("profile %q already exists", name)
+	}
+
+	profile := profileFromFlags
+	profile.Name = name
+	// profiles can be used from any directory
+	if profile.Image != "" {
+		if profile.Image, err = filepath.Abs(profile.Image); err != nil {
+			return err
+		}
+	}
+	for i, param := range profile.CloudInit {
+		kind, file, found := strings.Cut(param, "=")
+		if !found {
+			kind, file = "", param
+		}
+		if file, err = filepath.Abs(file); err != nil {
+			return err
+		}
+		if found {
+			file = kind + "=" + file
+		}
+		profile.CloudInit[i] = file
+	}
+
+	return profile.Write()
+}
+
+func profileRm(_ *cobra.Command, args []string) error {
+	for _, name := range args {
+		if err := profiles.Remove(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func autocompleteProfiles(_ *cobra.Command, _ []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	profileList, err := profiles.List()
+	if err != nil {
+		cobra.CompErrorln(err.Error())
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	names := []string{}
+	for _, p := range profileList {
+		if strings.HasPrefix(p.Name, toComplete) {
+			names = append(names, p.Name)
+		}
+	}
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
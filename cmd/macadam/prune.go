@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/containers/common/pkg/completion"
+	"github.com/crc-org/macadam/cmd/macadam/registry"
+	"github.com/crc-org/macadam/pkg/client"
+	"github.com/docker/go-units"
+	"github.com/spf13/cobra"
+)
+
+var (
+	pruneCmd = &cobra.Command{
+		Use:   "prune [options]",
+		Short: "Remove the files and port allocations no machine owns",
+		Long: `Remove the disk images, cloud-init files, sockets, pid files and machine metadata which no machine of the provider owns, and release the SSH ports allocated to no machine.
+These are left behind when macadam or a helper process crashes. The sockets still accepting connections and the pid files of running processes are kept.`,
+		RunE:              prune,
+		Args:              cobra.NoArgs,
+		ValidArgsFunction: completion.AutocompleteNone,
+		Example: `macadam prune --dry-run
+  macadam prune`,
+	}
+	pruneDryRun bool
+)
+
+func init() {
+	registry.Commands = append(registry.Commands, registry.CliCommand{
+		Command: pruneCmd,
+	})
+
+	flags := pruneCmd.Flags()
+	flags.BoolVar(&pruneDryRun, "dry-run", false, "Print what would be removed without removing it")
+}
+
+// pruneReport is the output of prune with --format json
+type pruneReport struct {
+	Files []client.OrphanFile
+	Ports []int
+	// Size is the space freed, or which would be freed with --dry-run, in
+	// bytes
+	Size   int64
+	DryRun bool
+}
+
+func prune(cmd *cobra.Command, _ []string) error {
+	ctx := cmd.Context()
+	orphans, err := macadamClient.Orphans(ctx)
+	if err != nil {
+		return err
+	}
+	report := pruneReport{
+		Files:  orphans.Files,
+		Ports:  orphans.Ports,
+		Size:   orphans.Size(),
+		DryRun: pruneDryRun,
+	}
+	if !pruneDryRun {
+		report.Size, err = macadamClient.Prune(ctx, orphans)
+		if err != nil {
+			return err
+		}
+	}
+
+	if jsonOutput() {
+		b, err := json.MarshalIndent(report, "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+	printPruneReport(&report)
+	return nil
+}
+
+func printPruneReport(report *pruneReport) {
+	if len(report.Files) == 0 && len(report.Ports) == 0 {
+		fmt.Println("Nothing to prune")
+		return
+	}
+	verb := "Removed"
+	if report.DryRun {
+		verb = "Would remove"
+	}
+	if len(report.Files) > 0 {
+		fmt.Printf("%s the following files:\n", verb)
+		for _, file := range report.Files {
+			fmt.Printf("  %s (%s, %s)\n", file.Path, units.HumanSize(float64(file.Size)), file.Reason)
+		}
+	}
+	if len(report.Ports) > 0 {
+		ports := make([]string, 0, len(report.Ports))
+		for _, port := range report.Ports {
+			ports = append(ports, fmt.Sprint(port))
+		}
+		verb := "Released"
+		if report.DryRun {
+			verb = "Would release"
+		}
+		fmt.Printf("%s the following port allocations: %s\n", verb, strings.Join(ports, ", "))
+	}
+	if report.DryRun {
+		fmt.Printf("Total reclaimable space: %s\n", units.HumanSize(float64(report.Size)))
+		return
+	}
+	fmt.Printf("Total reclaimed space: %s\n", units.HumanSize(float64(report.Size)))
+}
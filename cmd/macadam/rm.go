@@ -1,10 +1,14 @@
 package main
 
 import (
-	"github.com/containers/podman/v5/pkg/machine"
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
 	"github.com/crc-org/macadam/cmd/macadam/registry"
-	macadam "github.com/crc-org/macadam/pkg/machinedriver"
-	provider2 "github.com/crc-org/macadam/pkg/machinedriver/provider"
+	"github.com/crc-org/macadam/pkg/client"
 	"github.com/spf13/cobra"
 )
 
@@ -20,7 +24,7 @@ var (
 )
 
 var (
-	destroyOptions machine.RemoveOptions
+	destroyOptions client.RemoveOptions
 )
 
 func init() {
@@ -33,20 +37,32 @@ func init() {
 	flags.BoolVarP(&destroyOptions.Force, formatFlagName, "f", false, "Stop and do not prompt before rming")
 }
 
-func rm(_ *cobra.Command, args []string) error {
-	machineName := defaultMachineName
-	if len(args) > 0 && len(args[0]) > 0 {
-		machineName = args[0]
+func rm(cmd *cobra.Command, args []string) error {
+	name := machineNameArg(args)
+	if jsonOutput() {
+		// the confirmation prompt would be mixed with the JSON result
+		if !destroyOptions.Force {
+			return newCommandError(codeConfirmationRequired, errors.New("--force is required to remove a machine with --format json"))
+		}
+		var err error
+		if name == "" {
+			name, err = macadamClient.DefaultMachine(cmd.Context())
+			if err != nil {
+				return err
+			}
+		}
+		result = &commandResult{Machine: name}
 	}
+	destroyOptions.Confirm = confirmRemove
+	return macadamClient.Remove(cmd.Context(), name, destroyOptions)
+}
 
-	vmProvider, err := provider2.GetProviderOrDefault(provider)
+func confirmRemove(name string) (bool, error) {
+	fmt.Printf("Machine %q and its files will be deleted.\n", name)
+	fmt.Print("Are you sure you want to continue? [y/N] ")
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
 	if err != nil {
-		return err
+		return false, err
 	}
-	driver, err := macadam.GetDriverByProviderAndMachineName(vmProvider, machineName)
-	if err != nil {
-		return err
-	}
-
-	return driver.RemoveWithOptions(destroyOptions)
+	return strings.HasPrefix(strings.ToLower(answer), "y"), nil
 }
@@ -3,17 +3,23 @@ package main
 import (
 	"context"
 	"fmt"
+	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/containers/common/pkg/completion"
 	"github.com/containers/podman/v5/libpod/define"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
 	"github.com/crc-org/macadam/cmd/macadam/common"
 	"github.com/crc-org/macadam/cmd/macadam/registry"
+	"github.com/crc-org/macadam/pkg/client"
 	"github.com/crc-org/macadam/pkg/cmdline"
-	"github.com/crc-org/macadam/pkg/env"
+	"github.com/crc-org/macadam/pkg/debuglog"
 	provider2 "github.com/crc-org/macadam/pkg/machinedriver/provider"
+	"github.com/crc-org/macadam/pkg/signals"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
@@ -64,6 +70,10 @@ var (
 	defaultLogLevel = "warn"
 	logLevel        = defaultLogLevel
 	provider        = ""
+
+	// macadamClient is used by the commands to manage the machines, it is
+	// created by machinePreRunE
+	macadamClient *client.Client
 	// dockerConfig    = ""
 	// debug           bool
 
@@ -82,6 +92,8 @@ func init() {
 	// actually running the command.
 	cobra.OnInitialize(
 		loggingHook,
+		outputHook,
+		debugLogHook,
 	)
 
 	pFlags := rootCmd.PersistentFlags()
@@ -94,27 +106,63 @@ func init() {
 	pFlags.StringVar(&provider, providerFlagName, "", fmt.Sprintf("Name for the provider (%s). Default value: %s", strings.Join(provider2.GetProviders(), ", "), provider2.GetDefaultProvider()))
 	_ = initCmd.RegisterFlagCompletionFunc(providerFlagName, completion.AutocompleteNone)
 
+	// list, events and profile list have their own --format flag, which
+	// also accepts Go templates
+	formatFlagName := "format"
+	pFlags.StringVar(&outputFormat, formatFlagName, "", "Print the result of the command as JSON (json)")
+	_ = rootCmd.RegisterFlagCompletionFunc(formatFlagName, common.AutocompleteFormat(nil))
+
 	rootCmd.SetUsageTemplate(usageTemplate)
 }
 
 func Execute() {
-	if err := rootCmd.ExecuteContext(context.Background()); err != nil {
-		if registry.GetExitCode() == 0 {
-			registry.SetExitCode(define.ExecErrorCodeGeneric)
-		}
+	start := time.Now()
+	err := rootCmd.ExecuteContext(context.Background())
+	if err != nil {
+		slog.Debug("command failed", "error", err)
+	}
+	if err != nil && registry.GetExitCode() == 0 {
+		registry.SetExitCode(define.ExecErrorCodeGeneric)
+	}
+	if jsonOutput() {
+		printResult(start, err)
+	} else if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 	}
 
 	os.Exit(registry.GetExitCode())
 }
 
+// vmProviderOverride is used instead of the provider selected with
+// --provider when it is set, by the tests of the commands
+var vmProviderOverride vmconfigs.VMProvider
+
 func machinePreRunE(c *cobra.Command, args []string) error {
-	vmProvider, err := provider2.GetProviderOrDefault(provider)
-	if err != nil {
-		return err
+	var err error
+	macadamClient, err = client.New(client.Options{
+		Provider:   provider,
+		VMProvider: vmProviderOverride,
+		Progress:   printProgress,
+	})
+	return err
+}
+
+func printProgress(_, message string) {
+	// stdout only has the result when --format json is used
+	if jsonOutput() {
+		fmt.Fprintln(os.Stderr, message)
+		return
 	}
+	fmt.Println(message)
+}
 
-	return env.SetupEnvironment(vmProvider)
+// machineNameArg returns the machine name given as first argument, or an
+// empty string to use the default machine
+func machineNameArg(args []string) string {
+	if len(args) > 0 {
+		return args[0]
+	}
+	return ""
 }
 
 func loggingHook() {
@@ -141,3 +189,45 @@ func loggingHook() {
 		logrus.Infof("%s filtering at log level %s", os.Args[0], logrus.GetLevel())
 	}
 }
+
+// debugLogHook also writes the logs to the debug log, which is included in
+// the bundles of system diag. It must run after outputHook, which replaces
+// the slog handler.
+func debugLogHook() {
+	handler := slog.Default().Handler()
+	slog.SetDefault(slog.New(debuglog.NewHandler(handler)))
+	if !jsonOutput() {
+		// handler is the slog default handler, which writes with the log
+		// package. SetDefault redirected the log package to the new
+		// handler, it must write to stderr again to not loop.
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	}
+	logrus.AddHook(debuglog.LogrusHook{})
+	slog.Debug("running macadam", "version", cmdline.Version(), "command", commandName())
+}
+
+// commandName returns the macadam subcommand being run, without its
+// arguments which may contain secrets, such as the command run by exec
+func commandName() string {
+	cmd, _, err := rootCmd.Find(os.Args[1:])
+	if err != nil {
+		return ""
+	}
+	return cmd.CommandPath()
+}
+
+// contextWithTimeout returns a copy of ctx which is cancelled after
+// timeout, or on SIGINT/SIGTERM so that an interrupted start or stop cleans
+// up the machine processes. A timeout of 0 means no timeout.
+func contextWithTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, stop := signals.NotifyContext(ctx)
+	if timeout <= 0 {
+		return ctx, stop
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	return ctx, func() {
+		cancel()
+		stop()
+	}
+}
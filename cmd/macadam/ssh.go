@@ -3,17 +3,14 @@
 package main
 
 import (
-	"fmt"
-
-	"github.com/containers/podman/v5/pkg/machine/define"
-	"github.com/containers/podman/v5/pkg/machine/env"
+	"errors"
+	"os"
+	"os/exec"
 
 	"github.com/containers/common/pkg/completion"
-	"github.com/containers/podman/v5/cmd/podman/utils"
-	"github.com/containers/podman/v5/pkg/machine"
-	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
 	"github.com/crc-org/macadam/cmd/macadam/registry"
-	provider2 "github.com/crc-org/macadam/pkg/machinedriver/provider"
+	"github.com/crc-org/macadam/pkg/client"
+	"github.com/crc-org/macadam/pkg/sshclient"
 	"github.com/spf13/cobra"
 )
 
@@ -25,13 +22,14 @@ var (
 		PersistentPreRunE: machinePreRunE,
 		RunE:              ssh,
 		Example: `macadam ssh podman-machine-default
-  macadam ssh myvm echo hello`,
+  macadam ssh myvm echo hello
+  macadam ssh --workdir /srv --env MODE=test myvm make check`,
 		//ValidArgsFunction: autocompleteMachineSSH,
 	}
 )
 
 var (
-	sshOpts machine.SSHOptions
+	sshOpts client.SSHOptions
 )
 
 func init() {
@@ -43,28 +41,27 @@ func init() {
 	usernameFlagName := "username"
 	flags.StringVar(&sshOpts.Username, usernameFlagName, "", "Username to use when ssh-ing into the VM.")
 	_ = sshCmd.RegisterFlagCompletionFunc(usernameFlagName, completion.AutocompleteNone)
+
+	envFlagName := "env"
+	flags.StringArrayVarP(&sshOpts.Env, envFlagName, "e", nil, "Set environment variables for the command, KEY=VALUE or KEY to use the host value")
+	_ = sshCmd.RegisterFlagCompletionFunc(envFlagName, completion.AutocompleteNone)
+
+	workdirFlagName := "workdir"
+	flags.StringVarP(&sshOpts.WorkDir, workdirFlagName, "w", "", "Working directory of the command in the machine")
+	_ = sshCmd.RegisterFlagCompletionFunc(workdirFlagName, completion.AutocompleteNone)
+
+	forwardAgentFlagName := "forward-agent"
+	flags.BoolVarP(&sshOpts.ForwardAgent, forwardAgentFlagName, "A", false, "Forward the SSH agent of the host to the machine")
+
+	externalSSHFlagName := "external-ssh"
+	flags.BoolVar(&sshOpts.ExternalSSH, externalSSHFlagName, false, "Use the ssh binary of the host instead of the built-in SSH client")
 }
 
 // TODO Remember that this changed upstream and needs to updated as such!
 
 func ssh(cmd *cobra.Command, args []string) error {
-	var (
-		err     error
-		mc      *vmconfigs.MachineConfig
-		validVM bool
-	)
-
-	vmProvider, err := provider2.GetProviderOrDefault(provider)
-	if err != nil {
-		return err
-	}
-	dirs, err := env.GetMachineDirs(vmProvider.VMType())
-	if err != nil {
-		return err
-	}
-
-	// Set the VM to default
-	vmName := defaultMachineName
+	// An empty name means the default machine
+	vmName := ""
 	// If len is greater than 0, it means we may have been
 	// provided the VM name.  If so, we check.  The VM name,
 	// if provided, must be in args[0].
@@ -72,55 +69,48 @@ func ssh(cmd *cobra.Command, args []string) error {
 		// note: previous incantations of this up by a specific name
 		// and errors were ignored.  this error is not ignored because
 		// it implies podman cannot read its machine files, which is bad
-		machines, err := vmconfigs.LoadMachinesInDir(dirs)
+		machines, err := macadamClient.List(cmd.Context())
 		if err != nil {
 			return err
 		}
 
-		mc, validVM = machines[args[0]]
-		if validVM {
-			vmName = args[0]
-		} else {
-			sshOpts.Args = append(sshOpts.Args, args[0])
-		}
-	}
-
-	// If len is greater than 1, it means we might have been
-	// given a vmname and args or just args
-	if len(args) > 1 {
-		if validVM {
-			sshOpts.Args = args[1:]
-		} else {
-			sshOpts.Args = args
-		}
-	}
-
-	// If the machine config was not loaded earlier, we load it now
-	if mc == nil {
-		mc, err = vmconfigs.LoadMachineByName(vmName, dirs)
-		if err != nil {
-			return fmt.Errorf("vm %s not found: %w", vmName, err)
+		sshOpts.Args = args
+		for _, m := range machines {
+			if m.Name == args[0] {
+				vmName = args[0]
+				sshOpts.Args = args[1:]
+				break
+			}
 		}
 	}
 
-	state, err := vmProvider.State(mc, false)
-	if err != nil {
-		return err
-	}
-	if state != define.Running {
-		return fmt.Errorf("vm %q is not running", mc.Name)
-	}
-
-	username := sshOpts.Username
-	if username == "" {
-		username = mc.SSH.RemoteUsername
-	}
+	err := macadamClient.SSH(cmd.Context(), vmName, sshOpts)
+	return handleSSHError(err)
+}
 
-	address := "localhost"
-	if mc.IPAddress != "" {
-		address = mc.IPAddress
+// handleSSHError sets the exit code of macadam to the exit status of the
+// command run in the machine, as podman's utils.HandleOSExecError does for
+// its own exit code
+func handleSSHError(err error) error {
+	var exitErr *sshclient.ExitError
+	var execExitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &exitErr):
+		registry.SetExitCode(exitErr.Code)
+		return nil
+	case errors.As(err, &execExitErr):
+		registry.SetExitCode(execExitErr.ExitCode())
+		return nil
+	case errors.Is(err, sshclient.ErrInvalidEnv):
+		return newCommandError(codeInvalidArgument, err)
+	case !sshOpts.ExternalSSH:
+	case errors.Is(err, os.ErrNotExist) || errors.Is(err, exec.ErrNotFound):
+		// the ssh binary is missing
+		registry.SetExitCode(127)
+	case errors.Is(err, os.ErrPermission):
+		registry.SetExitCode(126)
 	}
-
-	err = machine.LocalhostSSHShellWithAddress(username, mc.SSH.IdentityPath, mc.Name, address, mc.SSH.Port, sshOpts.Args)
-	return utils.HandleOSExecError(err)
+	return err
 }
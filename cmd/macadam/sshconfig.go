@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/crc-org/macadam/cmd/macadam/registry"
+	"github.com/crc-org/macadam/pkg/sshconfig"
+	"github.com/spf13/cobra"
+)
+
+var (
+	sshConfigCmd = &cobra.Command{
+		Use:               "ssh-config [options] [MACHINE...]",
+		Short:             "Print the OpenSSH configuration of machines",
+		Long:              "Print OpenSSH client configuration to connect to the machines with 'ssh macadam-NAME', or install it in ~/.ssh/config.d",
+		RunE:              sshConfig,
+		ValidArgsFunction: autocompleteMachine,
+		Example: `macadam ssh-config myvm >> ~/.ssh/config
+  macadam ssh-config --install`,
+	}
+	sshConfigInstall bool
+)
+
+func init() {
+	registry.Commands = append(registry.Commands, registry.CliCommand{
+		Command: sshConfigCmd,
+	})
+
+	flags := sshConfigCmd.Flags()
+	installFlagName := "install"
+	flags.BoolVar(&sshConfigInstall, installFlagName, false, "Write the configuration of all the machines to a file included from ~/.ssh/config, and keep it up to date")
+}
+
+func sshConfig(cmd *cobra.Command, args []string) error {
+	if sshConfigInstall {
+		if len(args) > 0 {
+			return newCommandError(codeInvalidArgument, errors.New("--install manages all the machines, no machine name can be given"))
+		}
+		if err := macadamClient.InstallSSHConfig(cmd.Context()); err != nil {
+			return err
+		}
+		path, err := sshconfig.Path(macadamClient.VMType())
+		if err != nil {
+			return err
+		}
+		printProgress("", fmt.Sprintf("SSH configuration written to %s, use 'ssh %s' to connect to a machine", path, sshconfig.HostAlias("NAME")))
+		return nil
+	}
+
+	hosts, err := macadamClient.SSHConfig(cmd.Context(), args)
+	if err != nil {
+		return err
+	}
+	return sshconfig.Write(os.Stdout, hosts)
+}
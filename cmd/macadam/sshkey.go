@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/crc-org/macadam/cmd/macadam/registry"
+	"github.com/crc-org/macadam/pkg/client"
+	"github.com/spf13/cobra"
+)
+
+var (
+	sshKeyCmd = &cobra.Command{
+		Use:   "ssh-key",
+		Short: "Manage the SSH keys of machines",
+		Long:  "Manage the SSH keys used to connect to the machines",
+		RunE:  validateSubcommand,
+	}
+
+	sshKeyRotateCmd = &cobra.Command{
+		Use:               "rotate [MACHINE]",
+		Short:             "Replace the SSH key of a machine",
+		Long:              "Generate a new SSH key for a running machine, authorize it in the machine and revoke the previous key",
+		RunE:              sshKeyRotate,
+		Args:              cobra.MaximumNArgs(1),
+		ValidArgsFunction: autocompleteMachine,
+		Example:           `macadam ssh-key rotate myvm`,
+	}
+)
+
+func init() {
+	registry.Commands = append(registry.Commands, registry.CliCommand{
+		Command: sshKeyCmd,
+	})
+	registry.Commands = append(registry.Commands, registry.CliCommand{
+		Command: sshKeyRotateCmd,
+		Parent:  sshKeyCmd,
+	})
+}
+
+func sshKeyRotate(cmd *cobra.Command, args []string) error {
+	name := machineNameArg(args)
+	if err := macadamClient.RotateSSHKey(cmd.Context(), name); err != nil {
+		if errors.Is(err, client.ErrCustomSSHKey) {
+			return newCommandError(codeInvalidArgument, err)
+		}
+		return err
+	}
+	return setMachineResult(cmd.Context(), name)
+}
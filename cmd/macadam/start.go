@@ -3,14 +3,10 @@
 package main
 
 import (
-	"fmt"
+	"time"
 
-	"github.com/containers/podman/v5/pkg/machine"
-	"github.com/containers/podman/v5/pkg/machine/shim"
-	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
 	"github.com/crc-org/macadam/cmd/macadam/registry"
-	macadam "github.com/crc-org/macadam/pkg/machinedriver"
-	provider2 "github.com/crc-org/macadam/pkg/machinedriver/provider"
+	"github.com/crc-org/macadam/pkg/client"
 	"github.com/spf13/cobra"
 )
 
@@ -23,7 +19,8 @@ var (
 		Args:    cobra.MaximumNArgs(1),
 		Example: `macadam start`,
 	}
-	startOpts = machine.StartOptions{}
+	startOpts    = client.StartOptions{}
+	startTimeout time.Duration
 )
 
 func init() {
@@ -37,28 +34,17 @@ func init() {
 
 	quietFlagName := "quiet"
 	flags.BoolVarP(&startOpts.Quiet, quietFlagName, "q", false, "Suppress machine starting status output")
+
+	timeoutFlagName := "timeout"
+	flags.DurationVar(&startTimeout, timeoutFlagName, 0, "Forcefully stop the machine if it is not running after this duration, 0 for no timeout")
 }
 
-func start(_ *cobra.Command, args []string) error {
-	machineName := defaultMachineName
-	if len(args) > 0 && len(args[0]) > 0 {
-		machineName = args[0]
-	}
-	initOpts := macadam.DefaultInitOpts(machineName)
-	//initOpts.ImagePuller = ...
-	vmProvider, err := provider2.GetProviderOrDefault(provider)
-	if err != nil {
-		return err
-	}
-	// set exclusive mode to false so to allow multiple VMs to run at the same time
-	vmProvider.SetExclusiveActive(false)
-	vmConfig, _, err := shim.VMExists(initOpts.Name, []vmconfigs.VMProvider{vmProvider})
-	if err != nil {
+func start(cmd *cobra.Command, args []string) error {
+	ctx, cancel := contextWithTimeout(cmd.Context(), startTimeout)
+	defer cancel()
+	name := machineNameArg(args)
+	if err := macadamClient.Start(ctx, name, startOpts); err != nil {
 		return err
 	}
-	if vmConfig == nil {
-		return fmt.Errorf("VM %s does not exist", machineName)
-	}
-
-	return macadam.Start(vmConfig, vmProvider)
+	return setMachineResult(cmd.Context(), name)
 }
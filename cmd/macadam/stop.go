@@ -1,9 +1,9 @@
 package main
 
 import (
+	"time"
+
 	"github.com/crc-org/macadam/cmd/macadam/registry"
-	macadam "github.com/crc-org/macadam/pkg/machinedriver"
-	provider2 "github.com/crc-org/macadam/pkg/machinedriver/provider"
 	"github.com/spf13/cobra"
 )
 
@@ -16,28 +16,25 @@ var (
 		Args:    cobra.MaximumNArgs(1),
 		Example: `macadam stop`,
 	}
+	stopTimeout time.Duration
 )
 
 func init() {
 	registry.Commands = append(registry.Commands, registry.CliCommand{
 		Command: stopCmd,
 	})
+
+	flags := stopCmd.Flags()
+	timeoutFlagName := "timeout"
+	flags.DurationVar(&stopTimeout, timeoutFlagName, 0, "Forcefully stop the machine if it is not stopped after this duration, 0 for no timeout")
 }
 
 func stop(cmd *cobra.Command, args []string) error {
-	machineName := defaultMachineName
-	if len(args) > 0 && len(args[0]) > 0 {
-		machineName = args[0]
-	}
-
-	vmProvider, err := provider2.GetProviderOrDefault(provider)
-	if err != nil {
+	ctx, cancel := contextWithTimeout(cmd.Context(), stopTimeout)
+	defer cancel()
+	name := machineNameArg(args)
+	if err := macadamClient.Stop(ctx, name); err != nil {
 		return err
 	}
-	driver, err := macadam.GetDriverByProviderAndMachineName(vmProvider, machineName)
-	if err != nil {
-		return err
-	}
-
-	return driver.Stop()
+	return setMachineResult(cmd.Context(), name)
 }
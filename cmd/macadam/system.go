@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/containers/common/pkg/completion"
+	"github.com/crc-org/macadam/cmd/macadam/registry"
+	"github.com/crc-org/macadam/pkg/client"
+	"github.com/crc-org/macadam/pkg/service"
+	"github.com/crc-org/macadam/pkg/signals"
+	"github.com/spf13/cobra"
+)
+
+var (
+	systemCmd = &cobra.Command{
+		Use:   "system",
+		Short: "Manage macadam",
+		Long:  "Manage macadam settings and state",
+		RunE:  validateSubcommand,
+	}
+
+	systemDefaultCmd = &cobra.Command{
+		Use:               "default [MACHINE]",
+		Short:             "Get or set the default machine",
+		Long:              "Print the machine used when no machine name is given to a command, or make MACHINE the default machine",
+		RunE:              systemDefault,
+		Args:              cobra.MaximumNArgs(1),
+		ValidArgsFunction: autocompleteMachine,
+		Example: `macadam system default
+  macadam system default myvm`,
+	}
+
+	systemServiceCmd = &cobra.Command{
+		Use:               "service [options]",
+		Short:             "Serve the macadam REST API",
+		Long:              "Serve a versioned JSON HTTP API to manage the machines, on a unix socket or a Windows named pipe",
+		RunE:              systemService,
+		Args:              cobra.NoArgs,
+		ValidArgsFunction: completion.AutocompleteNone,
+		Example: `macadam system service
+  macadam system service --socket unix:///tmp/macadam.sock`,
+	}
+	serviceSocket string
+)
+
+func init() {
+	registry.Commands = append(registry.Commands, registry.CliCommand{
+		Command: systemCmd,
+	})
+	registry.Commands = append(registry.Commands, registry.CliCommand{
+		Command: systemDefaultCmd,
+		Parent:  systemCmd,
+	})
+	registry.Commands = append(registry.Commands, registry.CliCommand{
+		Command: systemServiceCmd,
+		Parent:  systemCmd,
+	})
+
+	flags := systemServiceCmd.Flags()
+	socketFlagName := "socket"
+	flags.StringVar(&serviceSocket, socketFlagName, "", "URI to serve the API on, unix:///path/to/socket or npipe:////./pipe/name (default in the macadam runtime directory)")
+	_ = systemServiceCmd.RegisterFlagCompletionFunc(socketFlagName, completion.AutocompleteNone)
+}
+
+func systemDefault(cmd *cobra.Command, args []string) error {
+	if len(args) == 0 {
+		name, err := macadamClient.DefaultMachine(cmd.Context())
+		if err != nil {
+			return err
+		}
+		if jsonOutput() {
+			return setMachineResult(cmd.Context(), name)
+		}
+		fmt.Println(name)
+		return nil
+	}
+
+	if err := macadamClient.SetDefaultMachine(cmd.Context(), args[0]); err != nil {
+		return err
+	}
+	return setMachineResult(cmd.Context(), args[0])
+}
+
+func systemService(cmd *cobra.Command, _ []string) error {
+	uri := serviceSocket
+	if uri == "" {
+		var err error
+		uri, err = service.DefaultURI(macadamClient.VMType())
+		if err != nil {
+			return err
+		}
+	}
+	listener, err := service.Listen(uri)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signals.NotifyContext(cmd.Context())
+	defer stop()
+	fmt.Printf("API service listening on %s\n", uri)
+	return service.New(macadamClient).Serve(ctx, listener)
+}
+
+func autocompleteMachine(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	c, err := client.New(client.Options{Provider: provider})
+	if err != nil {
+		cobra.CompErrorln(err.Error())
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	machines, err := c.List(cmd.Context())
+	if err != nil {
+		cobra.CompErrorln(err.Error())
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	names := []string{}
+	for _, m := range machines {
+		if strings.HasPrefix(m.Name, toComplete) {
+			names = append(names, m.Name)
+		}
+	}
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
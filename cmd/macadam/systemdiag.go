@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containers/common/pkg/completion"
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/pkg/machine/env"
+	"github.com/crc-org/macadam/cmd/macadam/registry"
+	"github.com/crc-org/macadam/pkg/client"
+	"github.com/crc-org/macadam/pkg/debuglog"
+	"github.com/crc-org/macadam/pkg/diag"
+	"github.com/crc-org/macadam/pkg/events"
+	"github.com/crc-org/macadam/pkg/metadata"
+	"github.com/shirou/gopsutil/v4/process"
+	"github.com/spf13/cobra"
+)
+
+var (
+	systemDiagCmd = &cobra.Command{
+		Use:   "diag [options] [MACHINE]",
+		Short: "Collect a support bundle",
+		Long: `Collect the system information, the configuration, cloud-init files, logs and helper processes of a machine, and the recent macadam logs in a tar.gz archive to attach to a bug report.
+The secrets, such as the private SSH host key in the cloud-init user-data, are redacted.`,
+		RunE:              systemDiag,
+		Args:              cobra.MaximumNArgs(1),
+		ValidArgsFunction: autocompleteMachine,
+		Example: `macadam system diag
+  macadam system diag myvm -o bundle.tar.gz`,
+	}
+	diagOutput string
+)
+
+func init() {
+	registry.Commands = append(registry.Commands, registry.CliCommand{
+		Command: systemDiagCmd,
+		Parent:  systemCmd,
+	})
+
+	flags := systemDiagCmd.Flags()
+	outputFlagName := "output"
+	flags.StringVarP(&diagOutput, outputFlagName, "o", "", "Path of the bundle (default: macadam-diag-<date>.tar.gz in the current directory)")
+	_ = systemDiagCmd.RegisterFlagCompletionFunc(outputFlagName, completion.AutocompleteDefault)
+}
+
+// helperProcess is a process of a running machine, in the bundles
+type helperProcess struct {
+	Name    string
+	PID     int
+	Cmdline []string `json:",omitempty"`
+	// Error tells why the command line could not be read
+	Error string `json:",omitempty"`
+}
+
+func systemDiag(cmd *cobra.Command, args []string) error {
+	ctx := cmd.Context()
+	output := diagOutput
+	if output == "" {
+		output = fmt.Sprintf("macadam-diag-%s.tar.gz", time.Now().Format("20060102-150405"))
+	}
+
+	// the default machine is only collected if it exists, so that a
+	// bundle can be created when no machine can be created
+	name := ""
+	if len(args) > 0 {
+		name = args[0]
+	}
+	m, err := macadamClient.Inspect(ctx, name)
+	if err != nil && (name != "" || !errors.Is(err, client.ErrMachineNotFound)) {
+		return err
+	}
+
+	bundle, err := diag.Create(output)
+	if err != nil {
+		return err
+	}
+	if err := collectDiag(ctx, cmd, bundle, m); err != nil {
+		_ = bundle.Close()
+		return err
+	}
+	if err := bundle.Close(); err != nil {
+		return err
+	}
+
+	if jsonOutput() {
+		result = &commandResult{}
+		if m != nil {
+			result.Machine = m.Name
+			result.State = string(m.State)
+		}
+		return nil
+	}
+	fmt.Printf("Support bundle written to %s\n", output)
+	return nil
+}
+
+func collectDiag(ctx context.Context, cmd *cobra.Command, bundle *diag.Bundle, m *client.Machine) error {
+	report, err := newSystemInfoReport(cmd)
+	if err != nil {
+		return err
+	}
+	if err := bundle.AddJSON("system-info.json", report); err != nil {
+		return err
+	}
+	if err := collectPorts(ctx, bundle); err != nil {
+		return err
+	}
+	if err := collectLogs(bundle); err != nil {
+		return err
+	}
+	if m == nil {
+		bundle.Notef("no machine was collected, the default machine does not exist")
+		return nil
+	}
+	return collectMachine(bundle, m)
+}
+
+// collectMachine adds the configuration, the cloud-init files, the logs and
+// the helper processes of m to the bundle
+func collectMachine(bundle *diag.Bundle, m *client.Machine) error {
+	dir := "machine/"
+	redactedMachine, err := redactJSONValue(m)
+	if err != nil {
+		return err
+	}
+	if err := bundle.AddBytes(dir+"inspect.json", redactedMachine); err != nil {
+		return err
+	}
+	if err := bundle.AddFile(dir+"config.json", filepath.Join(m.ConfigDir.GetPath(), m.Name+".json"), diag.RedactJSON); err != nil {
+		return err
+	}
+	metadataPath, err := metadata.Path(m.VMType, m.Name)
+	if err != nil {
+		return err
+	}
+	if err := bundle.AddFile(dir+"metadata.json", metadataPath, diag.RedactJSON); err != nil {
+		return err
+	}
+
+	cloudInitFiles := []struct {
+		kind string
+		file *define.VMFile
+	}{
+		{"user-data", m.CloudInit.UserData},
+		{"meta-data", m.CloudInit.MetaData},
+		{"network-config", m.CloudInit.NetworkConfig},
+	}
+	for _, cloudInit := range cloudInitFiles {
+		if cloudInit.file == nil {
+			continue
+		}
+		if err := bundle.AddFile(dir+"cloud-init/"+cloudInit.kind, cloudInit.file.GetPath(), diag.RedactYAML); err != nil {
+			return err
+		}
+	}
+
+	dirs, err := macadamClient.MachineDirs()
+	if err != nil {
+		return err
+	}
+	runtimeDir := dirs.RuntimeDir.GetPath()
+	// the serial console log is only written by the vfkit based providers
+	if err := bundle.AddFile(dir+"serial.log", filepath.Join(runtimeDir, m.Name+".log"), diag.RedactText); err != nil {
+		return err
+	}
+	if err := bundle.AddFile(dir+"gvproxy.log", filepath.Join(runtimeDir, fmt.Sprintf("gvproxy-%s.log", m.Name)), diag.RedactText); err != nil {
+		return err
+	}
+
+	processes := []helperProcess{}
+	for _, helper := range []helperProcess{
+		{Name: "gvproxy", PID: m.Processes.GvProxy},
+		{Name: "vm", PID: m.Processes.VM},
+	} {
+		pid := helper.PID
+		if pid == 0 {
+			continue
+		}
+		if p, err := process.NewProcess(int32(pid)); err != nil {
+			helper.Error = err.Error()
+		} else if helper.Cmdline, err = p.CmdlineSlice(); err != nil {
+			helper.Error = err.Error()
+		}
+		processes = append(processes, helper)
+	}
+	if len(processes) == 0 {
+		bundle.Notef("%sprocesses.json: the machine has no helper process running", dir)
+		return nil
+	}
+	return bundle.AddJSON(dir+"processes.json", processes)
+}
+
+// collectPorts adds the ports allocated by podman, and the SSH port of the
+// machines
+func collectPorts(ctx context.Context, bundle *diag.Bundle) error {
+	dataDir, err := env.GetGlobalDataDir()
+	if err != nil {
+		return err
+	}
+	if err := bundle.AddFile("ports/port-alloc.dat", filepath.Join(dataDir, "port-alloc.dat"), nil); err != nil {
+		return err
+	}
+	machines, err := macadamClient.List(ctx)
+	if err != nil {
+		return err
+	}
+	sshPorts := map[string]int{}
+	for _, m := range machines {
+		sshPorts[m.Name] = m.SSH.Port
+	}
+	return bundle.AddJSON("ports/ssh-ports.json", sshPorts)
+}
+
+// collectLogs adds the debug logs of the recent macadam commands, and the
+// events journal
+func collectLogs(bundle *diag.Bundle) error {
+	debugLog, err := debuglog.Path()
+	if err != nil {
+		return err
+	}
+	journal, err := events.JournalPath()
+	if err != nil {
+		return err
+	}
+	if err := bundle.AddFile("logs/macadam.log", debugLog, diag.RedactText); err != nil {
+		return err
+	}
+	if err := bundle.AddFile("logs/events.log", journal, diag.RedactText); err != nil {
+		return err
+	}
+	// the rotated logs only exist once the logs reached their maximum size
+	for _, rotated := range []struct{ name, path string }{
+		{"logs/macadam.log.1", debuglog.RotatedPath(debugLog)},
+		{"logs/events.log.1", events.RotatedJournalPath(journal)},
+	} {
+		if _, err := os.Stat(rotated.path); err != nil {
+			continue
+		}
+		if err := bundle.AddFile(rotated.name, rotated.path, diag.RedactText); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// redactJSONValue returns the redacted JSON encoding of v
+func redactJSONValue(v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return diag.RedactJSON(data), nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/crc-org/macadam/cmd/macadam/registry"
+	"github.com/crc-org/macadam/pkg/cmdline"
+	"github.com/crc-org/macadam/pkg/env"
+	"github.com/crc-org/macadam/pkg/helperbinaries"
+	provider2 "github.com/crc-org/macadam/pkg/machinedriver/provider"
+	"github.com/spf13/cobra"
+)
+
+var systemInfoCmd = &cobra.Command{
+	Use:   "info",
+	Short: "Display information about the host",
+	Long:  "Display the version of macadam, the providers, the helper binaries, the directories and the machines, to include in bug reports",
+	RunE:  systemInfo,
+	Args:  cobra.NoArgs,
+	Example: `macadam system info
+  macadam system info --format json`,
+}
+
+func init() {
+	registry.Commands = append(registry.Commands, registry.CliCommand{
+		Command: systemInfoCmd,
+		Parent:  systemCmd,
+	})
+}
+
+// systemInfoReport is the output of system info
+type systemInfoReport struct {
+	Version string
+	OS      string
+	Arch    string
+	// Provider is the provider used by the command, selected with
+	// --provider
+	Provider string
+	// DefaultProvider is the provider used when --provider is not given
+	DefaultProvider string
+	// Providers are the providers available on this host
+	Providers []string
+	// HelperBinaries are the helper binaries used by the provider
+	HelperBinaries []helperbinaries.Info
+	Dirs           systemDirs
+	// Machines are the machines of the provider
+	Machines machineCounts
+}
+
+// systemDirs are the directories and files used by macadam for the provider
+type systemDirs struct {
+	ConfigDir     string
+	DataDir       string
+	ImageCacheDir string
+	RuntimeDir    string
+	// ConnectionsFile holds the podman connections of the machines
+	ConnectionsFile string
+}
+
+type machineCounts struct {
+	Total int
+	// States is the number of machines per state
+	States map[string]int
+}
+
+func systemInfo(cmd *cobra.Command, _ []string) error {
+	report, err := newSystemInfoReport(cmd)
+	if err != nil {
+		return err
+	}
+
+	if jsonOutput() {
+		b, err := json.MarshalIndent(report, "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+	return printSystemInfo(report)
+}
+
+func newSystemInfoReport(cmd *cobra.Command) (*systemInfoReport, error) {
+	report := &systemInfoReport{
+		Version:         cmdline.Version(),
+		OS:              runtime.GOOS,
+		Arch:            runtime.GOARCH,
+		Provider:        macadamClient.VMType().String(),
+		DefaultProvider: provider2.GetDefaultProvider(),
+		Providers:       provider2.GetProviders(),
+		HelperBinaries:  helperbinaries.Inventory(macadamClient.VMType()),
+		Machines: machineCounts{
+			States: map[string]int{},
+		},
+	}
+	cfg, err := env.LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+	if defaultProvider := cfg.DefaultProvider(); defaultProvider != "" {
+		report.DefaultProvider = defaultProvider
+	}
+
+	dirs, err := macadamClient.MachineDirs()
+	if err != nil {
+		return nil, err
+	}
+	report.Dirs = systemDirs{
+		ConfigDir:     dirs.ConfigDir.GetPath(),
+		DataDir:       dirs.DataDir.GetPath(),
+		ImageCacheDir: dirs.ImageCacheDir.GetPath(),
+		RuntimeDir:    dirs.RuntimeDir.GetPath(),
+	}
+	report.Dirs.ConnectionsFile, err = env.ConnectionsPath()
+	if err != nil {
+		return nil, err
+	}
+
+	machines, err := macadamClient.List(cmd.Context())
+	if err != nil {
+		return nil, err
+	}
+	report.Machines.Total = len(machines)
+	for _, m := range machines {
+		report.Machines.States[string(m.State)]++
+	}
+	return report, nil
+}
+
+func printSystemInfo(report *systemInfoReport) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Version:\t%s\n", report.Version)
+	fmt.Fprintf(w, "OS/Arch:\t%s/%s\n", report.OS, report.Arch)
+	fmt.Fprintf(w, "Provider:\t%s\n", report.Provider)
+	fmt.Fprintf(w, "Default provider:\t%s\n", report.DefaultProvider)
+	fmt.Fprintf(w, "Providers:\t%s\n", strings.Join(report.Providers, ", "))
+	fmt.Fprintf(w, "Config dir:\t%s\n", report.Dirs.ConfigDir)
+	fmt.Fprintf(w, "Data dir:\t%s\n", report.Dirs.DataDir)
+	fmt.Fprintf(w, "Image cache dir:\t%s\n", report.Dirs.ImageCacheDir)
+	fmt.Fprintf(w, "Runtime dir:\t%s\n", report.Dirs.RuntimeDir)
+	fmt.Fprintf(w, "Connections file:\t%s\n", report.Dirs.ConnectionsFile)
+	states := []string{}
+	for _, state := range slices.Sorted(maps.Keys(report.Machines.States)) {
+		states = append(states, fmt.Sprintf("%s: %d", state, report.Machines.States[state]))
+	}
+	if len(states) == 0 {
+		fmt.Fprintf(w, "Machines:\t%d\n", report.Machines.Total)
+	} else {
+		fmt.Fprintf(w, "Machines:\t%d (%s)\n", report.Machines.Total, strings.Join(states, ", "))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Println()
+	fmt.Println("Helper binaries:")
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "  NAME\tPATH\tVERSION\tMIN VERSION\tSTATUS")
+	for _, info := range report.HelperBinaries {
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%s\n", info.Name, valueOrDash(info.Path), valueOrDash(info.Version), valueOrDash(info.MinVersion), helperStatus(&info))
+	}
+	return w.Flush()
+}
+
+// helperStatus is "ok", or tells why the binary cannot be used
+func helperStatus(info *helperbinaries.Info) string {
+	if info.Path == "" {
+		return "not found"
+	}
+	if err := info.CheckMinVersion(); err != nil {
+		return err.Error()
+	}
+	if info.Version == "" {
+		return info.Error
+	}
+	return "ok"
+}
+
+func valueOrDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
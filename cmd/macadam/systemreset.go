@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/containers/common/pkg/completion"
+	"github.com/crc-org/macadam/cmd/macadam/registry"
+	"github.com/crc-org/macadam/pkg/client"
+	"github.com/spf13/cobra"
+)
+
+var (
+	systemResetCmd = &cobra.Command{
+		Use:   "reset [options]",
+		Short: "Remove all the machines and the macadam state",
+		Long: `Stop and remove all the machines of the provider, with their disks, configurations, cloud-init ISOs, cached images, port allocations and podman connections.
+The files to be removed are printed before asking for a confirmation. macadam.conf, the profiles and the logs are kept.`,
+		RunE:              systemReset,
+		Args:              cobra.NoArgs,
+		ValidArgsFunction: completion.AutocompleteNone,
+		Example: `macadam system reset
+  macadam system reset --provider qemu --force`,
+	}
+	resetForce bool
+)
+
+func init() {
+	registry.Commands = append(registry.Commands, registry.CliCommand{
+		Command: systemResetCmd,
+		Parent:  systemCmd,
+	})
+
+	flags := systemResetCmd.Flags()
+	flags.BoolVarP(&resetForce, "force", "f", false, "Do not prompt before resetting")
+}
+
+func systemReset(cmd *cobra.Command, _ []string) error {
+	ctx := cmd.Context()
+	if jsonOutput() {
+		// the confirmation prompt would be mixed with the JSON result
+		if !resetForce {
+			return newCommandError(codeConfirmationRequired, errors.New("--force is required to reset with --format json"))
+		}
+		result = &commandResult{}
+	}
+
+	plan, err := macadamClient.ResetPlan(ctx)
+	if err != nil {
+		return err
+	}
+	if !jsonOutput() {
+		printResetPlan(plan)
+	}
+	if len(plan.Machines) == 0 && len(plan.Dirs) == 0 && len(plan.Connections) == 0 {
+		return nil
+	}
+
+	if !resetForce {
+		reader := bufio.NewReader(os.Stdin)
+		fmt.Print("Are you sure you want to continue? [y/N] ")
+		answer, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(strings.ToLower(answer), "y") {
+			return nil
+		}
+	}
+	return macadamClient.Reset(ctx, plan)
+}
+
+func printResetPlan(plan *client.ResetPlan) {
+	if len(plan.Machines) == 0 && len(plan.Dirs) == 0 && len(plan.Connections) == 0 {
+		fmt.Printf("Nothing to reset for the %s provider\n", macadamClient.VMType())
+		return
+	}
+	if len(plan.Machines) > 0 {
+		fmt.Println("The following machines will be stopped and removed:")
+		for _, m := range plan.Machines {
+			fmt.Printf("  %s (%s)\n", m.Name, m.State)
+		}
+	}
+	if len(plan.Files) > 0 {
+		fmt.Println("The following files and directories will be removed:")
+		for _, file := range plan.Files {
+			fmt.Printf("  %s\n", file)
+		}
+	}
+	if len(plan.Connections) > 0 {
+		fmt.Println("The following podman connections will be removed:")
+		for _, name := range plan.Connections {
+			fmt.Printf("  %s\n", name)
+		}
+	}
+	if len(plan.Ports) > 0 {
+		ports := make([]string, 0, len(plan.Ports))
+		for _, port := range plan.Ports {
+			ports = append(ports, fmt.Sprint(port))
+		}
+		fmt.Printf("The following SSH ports will be released: %s\n", strings.Join(ports, ", "))
+	}
+	fmt.Println()
+}
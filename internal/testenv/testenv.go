@@ -0,0 +1,60 @@
+// Package testenv sets up the environment of the unit tests creating
+// machines, so that they do not use the directories of the user.
+package testenv
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/crc-org/macadam/pkg/machinedriver/provider/fake"
+)
+
+// homeVars are the environment variables the podman machine code and macadam
+// compute their directories from
+var homeVars = []string{"XDG_CONFIG_HOME", "XDG_DATA_HOME", "XDG_RUNTIME_DIR", "XDG_CACHE_HOME", "HOME", "USERPROFILE"}
+
+// Main runs the tests of m, as the TestMain function of a package, with the
+// home and XDG directories in a new temporary directory. setup is called with
+// this directory before the tests, and the function it returns, if any, after
+// them.
+func Main(m *testing.M, setup func(dir string) (teardown func(), err error)) {
+	os.Exit(run(m, setup))
+}
+
+func run(m *testing.M, setup func(dir string) (func(), error)) int {
+	dir, err := os.MkdirTemp("", "macadam-test")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+
+	for _, key := range homeVars {
+		path := filepath.Join(dir, key)
+		if err := os.MkdirAll(path, 0o700); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		os.Setenv(key, path)
+	}
+
+	teardown, err := setup(dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if teardown != nil {
+		defer teardown()
+	}
+	return m.Run()
+}
+
+// FakeProvider returns the in-memory provider running the machines of the
+// tests. UnknownVirt uses the QEMU directories, without the QEMU preflight
+// checks and helper binaries.
+func FakeProvider() *fake.Provider {
+	return fake.New(define.UnknownVirt)
+}
@@ -0,0 +1,228 @@
+// Package client is the Go API to manage macadam virtual machines. It is
+// used by the macadam command line tool, and can be used by other tools
+// embedding macadam.
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/pkg/machine/env"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	macadamenv "github.com/crc-org/macadam/pkg/env"
+	macadam "github.com/crc-org/macadam/pkg/machinedriver"
+	"github.com/crc-org/macadam/pkg/machinedriver/provider"
+)
+
+var (
+	// ErrMachineNotFound is returned when the requested machine does not exist
+	ErrMachineNotFound = errors.New("machine does not exist")
+	// ErrMachineExists is returned by Init when a machine with the same name already exists
+	ErrMachineExists = errors.New("machine already exists")
+	// ErrMachineNotRunning is returned when an operation needs a running machine
+	ErrMachineNotRunning = errors.New("machine is not running")
+	// ErrMachineRunning is returned by Remove when the machine runs and
+	// RemoveOptions.Force is not set
+	ErrMachineRunning = errors.New("machine is running")
+	// ErrInvalidName is returned by Init when the machine name cannot be used
+	ErrInvalidName = errors.New("invalid machine name")
+	// ErrInvalidImage is returned by Init when the disk image cannot be used
+	ErrInvalidImage = errors.New("invalid disk image")
+)
+
+// ErrorCode returns a stable identifier of the cause of err, for the tools
+// which cannot use errors.Is, such as the wrappers of the macadam command.
+// Errors without a specific cause are "internal".
+func ErrorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrMachineNotFound):
+		return "machine_not_found"
+	case errors.Is(err, ErrMachineExists):
+		return "machine_exists"
+	case errors.Is(err, ErrMachineNotRunning):
+		return "machine_not_running"
+	case errors.Is(err, ErrMachineRunning):
+		return "machine_running"
+	case errors.Is(err, ErrInvalidName):
+		return "invalid_name"
+	case errors.Is(err, ErrInvalidImage):
+		return "invalid_image"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "cancelled"
+	default:
+		return "internal"
+	}
+}
+
+// machineError keeps the wording of the error messages macadam has always
+// used, while letting callers test the error with errors.Is
+type machineError struct {
+	sentinel error
+	message  string
+}
+
+func newMachineError(sentinel error, format string, args ...any) error {
+	return &machineError{
+		sentinel: sentinel,
+		message:  fmt.Sprintf(format, args...),
+	}
+}
+
+func (err *machineError) Error() string {
+	return err.message
+}
+
+func (err *machineError) Unwrap() error {
+	return err.sentinel
+}
+
+// ProgressFunc receives the progress messages of long running operations,
+// such as "Starting machine". They are meant to be displayed to users.
+type ProgressFunc = macadam.ProgressFunc
+
+// Options configures a Client
+type Options struct {
+	// Provider is the name of the virtualization provider to use. When
+	// empty, the provider from macadam.conf or the platform default is used.
+	Provider string
+	// VMProvider is used instead of the provider named by Provider when it
+	// is set, such as the in-memory provider of the fake package in tests
+	VMProvider vmconfigs.VMProvider
+	// Progress receives the progress messages of the Client operations.
+	// When nil, these messages are logged with slog.
+	Progress ProgressFunc
+}
+
+// Client manages the machines of a single virtualization provider
+type Client struct {
+	vmProvider vmconfigs.VMProvider
+	config     *macadamenv.Config
+	defaults   macadamenv.MachineDefaults
+	progress   ProgressFunc
+}
+
+// New creates a Client. It reads macadam.conf, and sets the process
+// environment variables which make the podman machine code use the macadam
+// directories, so only one provider can be used by a given process. These
+// directories are under $MACADAM_HOME when it is set, see env.SetupHome.
+func New(opts Options) (*Client, error) {
+	cfg, err := macadamenv.LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	vmProvider := opts.VMProvider
+	if vmProvider == nil {
+		providerName := opts.Provider
+		if providerName == "" {
+			providerName = cfg.DefaultProvider()
+		}
+		vmProvider, err = provider.GetProviderOrDefault(providerName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// set exclusive mode to false so to allow multiple VMs to run at the same time
+	vmProvider.SetExclusiveActive(false)
+
+	defaults, err := cfg.MachineDefaults(vmProvider.VMType().String())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := macadamenv.SetupEnvironment(vmProvider); err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		vmProvider: vmProvider,
+		config:     cfg,
+		defaults:   defaults,
+		progress:   opts.Progress,
+	}, nil
+}
+
+// VMType returns the virtualization provider used by the client
+func (c *Client) VMType() define.VMType {
+	return c.vmProvider.VMType()
+}
+
+// VMProvider returns the podman provider used by the client
+func (c *Client) VMProvider() vmconfigs.VMProvider {
+	return c.vmProvider
+}
+
+// MachineDefaults returns the values used by Init for the options which are
+// not set
+func (c *Client) MachineDefaults() macadamenv.MachineDefaults {
+	return c.defaults
+}
+
+// DefaultMachine returns the name of the machine used when an empty machine
+// name is passed to the Client methods
+func (c *Client) DefaultMachine(ctx context.Context) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return macadam.DefaultMachineName(c.vmProvider, c.defaults.Name)
+}
+
+// SetDefaultMachine makes name the default machine
+func (c *Client) SetDefaultMachine(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if _, err := c.loadMachine(name); err != nil {
+		return err
+	}
+	return macadam.SetDefaultMachine(c.vmProvider, name)
+}
+
+// resolveName returns name, or the default machine name when name is empty
+func (c *Client) resolveName(ctx context.Context, name string) (string, error) {
+	if name != "" {
+		return name, nil
+	}
+	return c.DefaultMachine(ctx)
+}
+
+// MachineDirs returns the directories holding the machine files of the
+// provider
+func (c *Client) MachineDirs() (*define.MachineDirs, error) {
+	return env.GetMachineDirs(c.vmProvider.VMType())
+}
+
+func (c *Client) loadMachine(name string) (*vmconfigs.MachineConfig, error) {
+	dirs, err := c.MachineDirs()
+	if err != nil {
+		return nil, err
+	}
+	mc, err := vmconfigs.LoadMachineByName(name, dirs)
+	if err != nil {
+		return nil, notFoundError(name, err)
+	}
+	return mc, nil
+}
+
+func (c *Client) driver(name string) (*macadam.Driver, error) {
+	driver, err := macadam.GetDriverByProviderAndMachineName(c.vmProvider, name)
+	if err != nil {
+		return nil, notFoundError(name, err)
+	}
+	driver.SetProgressFunc(c.progress)
+	driver.SetMachineDefaults(c.defaults)
+	return driver, nil
+}
+
+// notFoundError converts podman's error for missing machines to ErrMachineNotFound
+func notFoundError(name string, err error) error {
+	var notExist *define.ErrVMDoesNotExist
+	if errors.As(err, &notExist) {
+		return newMachineError(ErrMachineNotFound, "VM %s does not exist", name)
+	}
+	return err
+}
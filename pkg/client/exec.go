@@ -0,0 +1,47 @@
+package client
+
+import (
+	"context"
+	"io"
+
+	"github.com/crc-org/macadam/pkg/sshclient"
+)
+
+// ExecOptions are the options of Exec
+type ExecOptions struct {
+	// Username overrides the user configured for the machine
+	Username string
+	// Command is the command to run and its arguments. Unlike SSHOptions.Args,
+	// they are passed as is to the command, without being interpreted by
+	// the shell of the machine user.
+	Command []string
+	// TTY allocates a pseudo-terminal, Stdin and Stdout must then be
+	// terminals
+	TTY bool
+
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// Exec runs a command in the machine called name, or in the default machine
+// if name is empty, with the built-in SSH client. When the command fails,
+// the error is an *sshclient.ExitError holding its exit status. The command
+// is sent SIGTERM when ctx is done.
+func (c *Client) Exec(ctx context.Context, name string, opts ExecOptions) error {
+	target, err := c.sshTarget(ctx, name, opts.Username)
+	if err != nil {
+		return err
+	}
+	command := make([]string, 0, len(opts.Command))
+	for _, arg := range opts.Command {
+		command = append(command, sshclient.Quote(arg))
+	}
+	return sshclient.Run(ctx, target, sshclient.Options{
+		Command: command,
+		TTY:     opts.TTY,
+		Stdin:   opts.Stdin,
+		Stdout:  opts.Stdout,
+		Stderr:  opts.Stderr,
+	})
+}
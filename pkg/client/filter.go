@@ -0,0 +1,67 @@
+package client
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// machineFilterKeys are the keys accepted by ParseMachineFilter
+var machineFilterKeys = []string{"name", "label", "profile"}
+
+// MachineFilter selects machines by name, label or profile. Values of the
+// same key match any of them, except for labels which must all match, and
+// all the keys must match.
+type MachineFilter map[string][]string
+
+// ParseMachineFilter parses filters in the key=value format, for example
+// "name=myvm", "label=env=ci", or "label=gpu" for the machines with a gpu
+// label
+func ParseMachineFilter(filters []string) (MachineFilter, error) {
+	filter := MachineFilter{}
+	for _, f := range filters {
+		key, value, found := strings.Cut(f, "=")
+		if !found || value == "" {
+			return nil, fmt.Errorf("invalid filter %q, expected key=value", f)
+		}
+		if !slices.Contains(machineFilterKeys, key) {
+			return nil, fmt.Errorf("invalid filter key %q, valid keys are %s", key, strings.Join(machineFilterKeys, ", "))
+		}
+		filter[key] = append(filter[key], value)
+	}
+	return filter, nil
+}
+
+// Match returns true if m is selected by filter
+func (filter MachineFilter) Match(m *Machine) bool {
+	for key, values := range filter {
+		switch key {
+		case "name":
+			if !slices.Contains(values, m.Name) {
+				return false
+			}
+		case "profile":
+			if !slices.Contains(values, m.Profile) {
+				return false
+			}
+		case "label":
+			for _, label := range values {
+				if !matchLabel(m.Labels, label) {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// matchLabel returns true if labels has the label key=value, or the label
+// key with any value
+func matchLabel(labels map[string]string, label string) bool {
+	key, value, hasValue := strings.Cut(label, "=")
+	labelValue, found := labels[key]
+	if !found {
+		return false
+	}
+	return !hasValue || labelValue == value
+}
@@ -0,0 +1,551 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containers/common/pkg/strongunits"
+	ldefine "github.com/containers/podman/v5/libpod/define"
+	"github.com/containers/podman/v5/pkg/machine"
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/pkg/machine/shim"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	"github.com/crc-org/macadam/pkg/events"
+	"github.com/crc-org/macadam/pkg/imagepullers"
+	macadam "github.com/crc-org/macadam/pkg/machinedriver"
+	"github.com/crc-org/macadam/pkg/metadata"
+	"github.com/crc-org/macadam/pkg/profiles"
+	"github.com/crc-org/macadam/pkg/sshclient"
+	"github.com/docker/go-units"
+	"golang.org/x/term"
+)
+
+// maxMachineNameSize is set to thirty to limit huge machine names primarily
+// because macOS has a much smaller file size limit.
+const maxMachineNameSize = 30
+
+// Machine describes a macadam virtual machine
+type Machine struct {
+	Name   string
+	VMType define.VMType
+	// Image is the disk image the machine was created from. It is the
+	// same as DiskPath for the machines created by older macadam versions.
+	Image string
+	// DiskPath is the disk of the machine, a copy of Image
+	DiskPath string
+	Profile  string
+	Labels   map[string]string
+	// IsDefault is true for the machine used when no machine name is given
+	IsDefault bool
+
+	Created time.Time
+	// LastUp is the zero time if the machine never ran
+	LastUp   time.Time
+	State    define.Status
+	Starting bool
+
+	ConfigDir          define.VMFile
+	Resources          vmconfigs.ResourceConfig
+	SSH                vmconfigs.SSHConfig
+	UserModeNetworking bool
+	// IPAddress is only known for some providers
+	IPAddress    string
+	CloudInit    vmconfigs.CloudInitConfig
+	Capabilities define.MachineCapabilities
+	Mounts       []*vmconfigs.Mount
+	Processes    Processes
+	// KnownHostsFile holds the SSH host key of the machine, it is empty
+	// for the machines created before macadam pinned the host keys
+	KnownHostsFile string
+}
+
+// Running returns true if the machine is running or starting
+func (m *Machine) Running() bool {
+	return m.State == define.Running || m.State == define.Starting
+}
+
+// InitOptions are the settings of a new machine. Zero values are replaced
+// by the values from Profile, then by the macadam.conf defaults.
+type InitOptions struct {
+	// Name of the machine
+	Name string
+	// Image is the path to the disk image of the machine, in raw or qcow2 format
+	Image string
+	// Profile is the name of a profile created with 'macadam profile create'
+	Profile string
+
+	CPUs     uint64
+	Memory   uint64 // MiB
+	DiskSize uint64 // GiB
+	Username string
+	// SSHIdentityPath is the path of the private key used to connect to the
+	// machine. When empty, a key pair is generated for the machine in its
+	// data directory, and deleted with it.
+	SSHIdentityPath string
+	// CloudInitPaths lists user-data, meta-data and network-config files
+	CloudInitPaths []string
+	// Volumes lists the directories to mount in the machine, source:target
+	Volumes []string
+
+	// SetDefault makes the new machine the default machine
+	SetDefault bool
+	// Labels are stored with the machine, they can be used to select the
+	// machines with a MachineFilter
+	Labels map[string]string
+}
+
+// StartOptions are the options of Start
+type StartOptions struct {
+	// NoInfo suppresses the podman informational tips
+	NoInfo bool
+	// Quiet suppresses the status output printed while starting the machine
+	Quiet bool
+}
+
+// RemoveOptions are the options of Remove
+type RemoveOptions struct {
+	// Force stops the machine if it is running, and skips Confirm. When
+	// false, removing a running machine fails with ErrMachineRunning.
+	Force bool
+	// Confirm is called before anything is removed, unless Force is set.
+	// The machine is kept when it returns false.
+	Confirm func(name string) (bool, error)
+}
+
+// SetOptions are the machine settings changed by Set, nil values are left
+// unchanged
+type SetOptions struct {
+	CPUs     *uint64
+	Memory   *uint64 // MiB
+	DiskSize *uint64 // GiB, it can only be increased
+}
+
+// SSHOptions are the options of SSH
+type SSHOptions struct {
+	// Username overrides the user configured for the machine
+	Username string
+	// Args is the command to run, an interactive shell is opened when empty
+	Args []string
+	// Env lists K=V variables to set for the command, or K to use the
+	// value of the host
+	Env []string
+	// WorkDir is the directory the command runs in
+	WorkDir string
+	// ForwardAgent forwards the SSH agent of the host to the machine
+	ForwardAgent bool
+	// ExternalSSH uses the ssh binary of the host instead of the built-in
+	// SSH client
+	ExternalSSH bool
+
+	// Stdin, Stdout and Stderr default to the streams of the process
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// Init creates a machine
+func (c *Client) Init(ctx context.Context, opts InitOptions) (*Machine, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := c.ApplyDefaults(&opts); err != nil {
+		return nil, err
+	}
+	if err := validateInitOptions(&opts); err != nil {
+		return nil, err
+	}
+	initLock, err := metadata.InitLock(c.vmProvider.VMType(), opts.Name)
+	if err != nil {
+		return nil, err
+	}
+	initLock.Lock()
+	defer initLock.Unlock()
+	if _, err := c.loadMachine(opts.Name); err == nil {
+		return nil, newMachineError(ErrMachineExists, "%s: %v", opts.Name, define.ErrVMAlreadyExists)
+	}
+
+	c.progress.Report(opts.Name, "Initializing machine %q", opts.Name)
+
+	initOpts := macadam.DefaultInitOpts(opts.Name)
+	initOpts.ImagePuller = imagepullers.NewNoopImagePuller(opts.Name, c.vmProvider.VMType())
+	initOpts.ImagePuller.SetSourceURI(opts.Image)
+	initOpts.Image = opts.Image
+	initOpts.CPUS = opts.CPUs
+	initOpts.DiskSize = opts.DiskSize
+	initOpts.Memory = opts.Memory
+	initOpts.SSHIdentityPath = opts.SSHIdentityPath
+	initOpts.Username = opts.Username
+	initOpts.CloudInit = true // this should be calculated based on the image we want to start ??
+	initOpts.CloudInitPaths = opts.CloudInitPaths
+	initOpts.Volumes = opts.Volumes
+	initOpts.IsDefault = opts.SetDefault
+	initOpts.Capabilities = &define.MachineCapabilities{
+		HasReadyUnit:   false,
+		ForwardSockets: false,
+	}
+	cleanupIdentity, err := macadam.PrepareIdentity(initOpts, c.vmProvider.VMType())
+	if err != nil {
+		return nil, err
+	}
+	cleanupHostKey, err := macadam.PrepareHostKey(initOpts, c.vmProvider.VMType())
+	if err != nil {
+		cleanupIdentity()
+		return nil, err
+	}
+	if err := shim.Init(*initOpts, c.vmProvider); err != nil {
+		cleanupHostKey()
+		cleanupIdentity()
+		events.EmitError(events.Init, c.vmProvider.VMType(), opts.Name, err)
+		if errors.Is(err, define.ErrVMAlreadyExists) {
+			// created by a process not using the init lock
+			return nil, newMachineError(ErrMachineExists, "%s: %v", opts.Name, err)
+		}
+		return nil, err
+	}
+	events.Emit(events.Init, c.vmProvider.VMType(), opts.Name)
+
+	if opts.SetDefault {
+		if err := metadata.SetDefaultMachine(c.vmProvider.VMType(), opts.Name); err != nil {
+			return nil, err
+		}
+	}
+	md, err := metadata.Load(c.vmProvider.VMType(), opts.Name)
+	if err != nil {
+		return nil, err
+	}
+	md.Profile = opts.Profile
+	md.Labels = opts.Labels
+	md.Image = opts.Image
+	if image, err := filepath.Abs(opts.Image); err == nil {
+		md.Image = image
+	}
+	if err := md.Write(); err != nil {
+		return nil, err
+	}
+
+	c.progress.Report(opts.Name, "Machine %q initialized successfully", opts.Name)
+	c.updateSSHConfig(ctx)
+
+	return c.Inspect(ctx, opts.Name)
+}
+
+// ApplyDefaults replaces the zero values of opts with the values from the
+// profile, or from macadam.conf. Init applies them, callers only need it to
+// know the settings of the machine before creating it.
+func (c *Client) ApplyDefaults(opts *InitOptions) error {
+	profile := &profiles.Profile{}
+	if opts.Profile != "" {
+		var err error
+		profile, err = profiles.Load(opts.Profile)
+		if err != nil {
+			return err
+		}
+	}
+
+	opts.Name = valueOrDefault(opts.Name, c.defaults.Name)
+	opts.Image = valueOrDefault(opts.Image, profile.Image)
+	opts.Username = valueOrDefault(opts.Username, valueOrDefault(profile.Username, c.defaults.Username))
+	opts.CPUs = valueOrDefault(opts.CPUs, valueOrDefault(profile.CPUs, c.defaults.CPUs))
+	opts.DiskSize = valueOrDefault(opts.DiskSize, valueOrDefault(profile.DiskSize, c.defaults.DiskSize))
+	opts.Memory = valueOrDefault(opts.Memory, valueOrDefault(profile.Memory, c.defaults.Memory))
+	if len(opts.CloudInitPaths) == 0 {
+		opts.CloudInitPaths = profile.CloudInit
+	}
+	if len(opts.Volumes) == 0 {
+		opts.Volumes = profile.Volumes
+	}
+	return nil
+}
+
+func valueOrDefault[T comparable](value, defaultValue T) T {
+	var zero T
+	if value == zero {
+		return defaultValue
+	}
+	return value
+}
+
+func validateInitOptions(opts *InitOptions) error {
+	if len(opts.Name) > maxMachineNameSize {
+		return newMachineError(ErrInvalidName, "machine name %q must be %d characters or less", opts.Name, maxMachineNameSize)
+	}
+	if !ldefine.NameRegex.MatchString(opts.Name) {
+		return newMachineError(ErrInvalidName, "invalid name %q: %v", opts.Name, ldefine.RegexError)
+	}
+
+	// Check if the disk image exists and is not larger than the specified disk size
+	if opts.Image == "" {
+		return newMachineError(ErrInvalidImage, "disk image is required")
+	}
+	fileInfo, err := os.Stat(opts.Image)
+	if err != nil {
+		return newMachineError(ErrInvalidImage, "failed to stat disk image %q: %v", opts.Image, err)
+	}
+	diskSizeInBytes := int64(strongunits.GiB(opts.DiskSize).ToBytes())
+	if fileInfo.Size() > diskSizeInBytes {
+		return newMachineError(ErrInvalidImage, "disk image %s (size: %s) is larger than the expected maximum size of %s",
+			opts.Image, units.HumanSize(float64(fileInfo.Size())), units.HumanSize(float64(diskSizeInBytes)))
+	}
+
+	return nil
+}
+
+// Start starts the machine called name, or the default machine if name is
+// empty. If ctx is done before the machine is running, the machine and its
+// helper processes are forcefully stopped.
+func (c *Client) Start(ctx context.Context, name string, opts StartOptions) error {
+	name, err := c.resolveName(ctx, name)
+	if err != nil {
+		return err
+	}
+	mc, err := c.loadMachine(name)
+	if err != nil {
+		return err
+	}
+
+	startOpts := machine.StartOptions{
+		NoInfo: opts.NoInfo,
+		Quiet:  opts.Quiet,
+	}
+	if err := macadam.Start(ctx, mc, c.vmProvider, startOpts, c.progress); err != nil {
+		return err
+	}
+	c.updateSSHConfig(ctx)
+	return nil
+}
+
+// Stop stops the machine called name, or the default machine if name is
+// empty. If ctx is done before the machine is stopped, it is forcefully
+// stopped.
+func (c *Client) Stop(ctx context.Context, name string) error {
+	name, err := c.resolveName(ctx, name)
+	if err != nil {
+		return err
+	}
+	driver, err := c.driver(name)
+	if err != nil {
+		return err
+	}
+	return driver.StopContext(ctx)
+}
+
+// Remove deletes the machine called name, or the default machine if name is empty
+func (c *Client) Remove(ctx context.Context, name string, opts RemoveOptions) error {
+	name, err := c.resolveName(ctx, name)
+	if err != nil {
+		return err
+	}
+	if !opts.Force {
+		mc, err := c.loadMachine(name)
+		if err != nil {
+			return err
+		}
+		state, err := c.vmProvider.State(mc, false)
+		if err != nil {
+			return err
+		}
+		if state == define.Running {
+			return newMachineError(ErrMachineRunning, "vm %q is running, it can only be removed with force", name)
+		}
+		if opts.Confirm != nil {
+			confirmed, err := opts.Confirm(name)
+			if err != nil || !confirmed {
+				return err
+			}
+		}
+	}
+	driver, err := c.driver(name)
+	if err != nil {
+		return err
+	}
+	// the confirmation was asked above, shim.Remove would read it from stdin
+	if err := driver.RemoveWithOptions(ctx, machine.RemoveOptions{Force: true}); err != nil {
+		return err
+	}
+	c.updateSSHConfig(ctx)
+	return nil
+}
+
+// Set changes the settings of the machine called name, or of the default
+// machine if name is empty. The new settings are used at the next start.
+func (c *Client) Set(ctx context.Context, name string, opts SetOptions) error {
+	name, err := c.resolveName(ctx, name)
+	if err != nil {
+		return err
+	}
+	mc, err := c.loadMachine(name)
+	if err != nil {
+		return err
+	}
+
+	setOpts := define.SetOptions{
+		CPUs: opts.CPUs,
+	}
+	if opts.Memory != nil {
+		memory := strongunits.MiB(*opts.Memory)
+		setOpts.Memory = &memory
+	}
+	if opts.DiskSize != nil {
+		diskSize := strongunits.GiB(*opts.DiskSize)
+		setOpts.DiskSize = &diskSize
+	}
+	if err := shim.Set(mc, c.vmProvider, setOpts); err != nil {
+		events.EmitError(events.Set, c.vmProvider.VMType(), name, err)
+		return err
+	}
+	events.Emit(events.Set, c.vmProvider.VMType(), name)
+	return nil
+}
+
+// List returns all the machines of the client provider
+func (c *Client) List(ctx context.Context) ([]*Machine, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	dirs, err := c.MachineDirs()
+	if err != nil {
+		return nil, err
+	}
+	mcs, err := vmconfigs.LoadMachinesInDir(dirs)
+	if err != nil {
+		return nil, err
+	}
+	defaultName, err := c.DefaultMachine(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	machines := make([]*Machine, 0, len(mcs))
+	for _, mc := range mcs {
+		m, err := c.toMachine(mc, dirs, defaultName)
+		if err != nil {
+			return nil, err
+		}
+		machines = append(machines, m)
+	}
+	return machines, nil
+}
+
+// Inspect returns the machine called name, or the default machine if name is empty
+func (c *Client) Inspect(ctx context.Context, name string) (*Machine, error) {
+	defaultName, err := c.DefaultMachine(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		name = defaultName
+	}
+	dirs, err := c.MachineDirs()
+	if err != nil {
+		return nil, err
+	}
+	mc, err := c.loadMachine(name)
+	if err != nil {
+		return nil, err
+	}
+	return c.toMachine(mc, dirs, defaultName)
+}
+
+func (c *Client) toMachine(mc *vmconfigs.MachineConfig, dirs *define.MachineDirs, defaultName string) (*Machine, error) {
+	state, err := c.vmProvider.State(mc, false)
+	if err != nil {
+		return nil, err
+	}
+	md, err := metadata.Load(c.vmProvider.VMType(), mc.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Machine{
+		Name:               mc.Name,
+		VMType:             c.vmProvider.VMType(),
+		Image:              md.Image,
+		Profile:            md.Profile,
+		Labels:             md.Labels,
+		IsDefault:          mc.Name == defaultName,
+		Created:            mc.Created,
+		LastUp:             mc.LastUp,
+		State:              state,
+		Starting:           mc.Starting,
+		ConfigDir:          *dirs.ConfigDir,
+		Resources:          mc.Resources,
+		SSH:                mc.SSH,
+		UserModeNetworking: c.vmProvider.UserModeNetworkEnabled(mc),
+		IPAddress:          mc.IPAddress,
+		CloudInit:          mc.CloudInitConfig,
+		Mounts:             mc.Mounts,
+		KnownHostsFile:     knownHostsFile(dirs, mc.Name),
+	}
+	if mc.ImagePath != nil {
+		m.DiskPath = mc.ImagePath.GetPath()
+	}
+	if m.Image == "" {
+		m.Image = m.DiskPath
+	}
+	if mc.Capabilities != nil {
+		m.Capabilities = *mc.Capabilities
+	}
+	if m.Running() {
+		m.Processes = getProcesses(mc, dirs)
+	}
+	return m, nil
+}
+
+// SSH runs a command or an interactive shell in the machine called name, or
+// in the default machine if name is empty. The built-in SSH client is used
+// unless opts.ExternalSSH is set. When the command fails, the error is an
+// *sshclient.ExitError, or an *exec.ExitError with the ssh binary, holding
+// its exit status.
+func (c *Client) SSH(ctx context.Context, name string, opts SSHOptions) error {
+	target, err := c.sshTarget(ctx, name, opts.Username)
+	if err != nil {
+		return err
+	}
+
+	command, err := sshclient.RemoteCommand(opts.Args, opts.Env, opts.WorkDir)
+	if err != nil {
+		return err
+	}
+	if opts.Stdin == nil {
+		opts.Stdin = os.Stdin
+	}
+	if opts.Stdout == nil {
+		opts.Stdout = os.Stdout
+	}
+	if opts.Stderr == nil {
+		opts.Stderr = os.Stderr
+	}
+	if opts.ExternalSSH {
+		dirs, err := c.MachineDirs()
+		if err != nil {
+			return err
+		}
+		return sshBinary(target, knownHostsFile(dirs, target.Name), command, opts)
+	}
+
+	interactive := len(opts.Args) == 0
+	if interactive {
+		fmt.Fprintf(opts.Stderr, "Connecting to vm %s. To close connection, use `exit`\n", target.Name)
+	}
+	return sshclient.Run(ctx, target, sshclient.Options{
+		Command:      opts.Args,
+		Env:          opts.Env,
+		WorkDir:      opts.WorkDir,
+		TTY:          interactive && isTerminal(opts.Stdin) && isTerminal(opts.Stdout),
+		ForwardAgent: opts.ForwardAgent,
+		Stdin:        opts.Stdin,
+		Stdout:       opts.Stdout,
+		Stderr:       opts.Stderr,
+	})
+}
+
+func isTerminal(stream any) bool {
+	file, ok := stream.(*os.File)
+	return ok && term.IsTerminal(int(file.Fd()))
+}
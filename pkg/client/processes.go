@@ -0,0 +1,47 @@
+package client
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/containers/podman/v5/pkg/machine"
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	"github.com/shirou/gopsutil/v4/process"
+)
+
+// Processes holds the PIDs of the processes of a running machine. A PID is 0
+// when the process is not running, or when the provider does not record it.
+type Processes struct {
+	// GvProxy is the user-mode networking process
+	GvProxy int
+	// VM is the hypervisor process, it is only known for QEMU machines
+	VM int
+}
+
+func getProcesses(mc *vmconfigs.MachineConfig, dirs *define.MachineDirs) Processes {
+	processes := Processes{
+		VM: vmPID(mc),
+	}
+	if pidFile, err := machine.GetGVProxyPIDFile(mc, dirs); err == nil {
+		processes.GvProxy = readPIDFile(pidFile)
+	}
+	return processes
+}
+
+// readPIDFile returns the PID stored in pidFile, or 0 if the file does not
+// exist or if the process is gone
+func readPIDFile(pidFile *define.VMFile) int {
+	content, err := pidFile.Read()
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 32)
+	if err != nil {
+		return 0
+	}
+	if exists, err := process.PidExists(int32(pid)); err != nil || !exists {
+		return 0
+	}
+	return int(pid)
+}
@@ -0,0 +1,12 @@
+//go:build darwin
+
+package client
+
+import (
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+)
+
+// vfkit and krunkit do not write a pid file
+func vmPID(_ *vmconfigs.MachineConfig) int {
+	return 0
+}
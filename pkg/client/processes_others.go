@@ -0,0 +1,14 @@
+//go:build !darwin
+
+package client
+
+import (
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+)
+
+func vmPID(mc *vmconfigs.MachineConfig) int {
+	if mc.QEMUHypervisor == nil || mc.QEMUHypervisor.QEMUPidPath == nil {
+		return 0
+	}
+	return readPIDFile(mc.QEMUHypervisor.QEMUPidPath)
+}
@@ -0,0 +1,341 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/pkg/machine/env"
+	"github.com/containers/podman/v5/pkg/machine/lock"
+	"github.com/containers/podman/v5/pkg/machine/ports"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	"github.com/crc-org/macadam/pkg/machinedriver/provider"
+	"github.com/crc-org/macadam/pkg/metadata"
+	"github.com/shirou/gopsutil/v4/process"
+)
+
+// portAllocFile is the file where podman records the SSH ports allocated to
+// the machines of all the providers, in the global data directory
+const portAllocFile = "port-alloc.dat"
+
+// OrphanFile is a file which no machine owns
+type OrphanFile struct {
+	Path string
+	Size int64
+	// Reason tells why the file is orphaned
+	Reason string
+}
+
+// Orphans are the files and the port allocations which no machine owns,
+// such as the files left behind by a crash during init or rm
+type Orphans struct {
+	Files []OrphanFile
+	// Ports are allocated in the port allocation file, but are not the SSH
+	// port of any machine
+	Ports []int
+}
+
+// Size returns the total size of the orphaned files
+func (o *Orphans) Size() int64 {
+	var size int64
+	for _, file := range o.Files {
+		size += file.Size
+	}
+	return size
+}
+
+// Orphans cross-references the machines with the files in the directories of
+// the provider and with the port allocations. The files of the machines
+// being created, whose configuration is not written yet, are not orphans.
+func (c *Client) Orphans(ctx context.Context) (*Orphans, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	dirs, err := c.MachineDirs()
+	if err != nil {
+		return nil, err
+	}
+	mcs, err := vmconfigs.LoadMachinesInDir(dirs)
+	if err != nil {
+		return nil, err
+	}
+	images := map[string]bool{}
+	for _, mc := range mcs {
+		images[mc.ImagePath.GetPath()] = true
+	}
+	names, creating, err := machineNames(dirs.ConfigDir.GetPath())
+	if err != nil {
+		return nil, err
+	}
+
+	orphans := &Orphans{
+		Files: []OrphanFile{},
+		Ports: []int{},
+	}
+	for _, dir := range []string{dirs.ConfigDir.GetPath(), dirs.DataDir.GetPath()} {
+		if err := orphans.addFiles(dir, func(path string, _ fs.DirEntry) string {
+			if images[path] || ownedByMachine(dir, path, names) {
+				return ""
+			}
+			return "no machine"
+		}); err != nil {
+			return nil, err
+		}
+	}
+	if err := orphans.addFiles(dirs.RuntimeDir.GetPath(), func(path string, entry fs.DirEntry) string {
+		if ownedByMachine(dirs.RuntimeDir.GetPath(), path, names) {
+			return ""
+		}
+		return staleRuntimeFile(path, entry)
+	}); err != nil {
+		return nil, err
+	}
+	metadataDir, err := metadata.Dir(c.vmProvider.VMType())
+	if err != nil {
+		return nil, err
+	}
+	if err := orphans.addFiles(metadataDir, func(path string, _ fs.DirEntry) string {
+		name, isMetadata := strings.CutSuffix(filepath.Base(path), ".json")
+		if !isMetadata || names[name] {
+			return ""
+		}
+		return "no machine"
+	}); err != nil {
+		return nil, err
+	}
+
+	// the port of a machine being created is allocated before its
+	// configuration is written, it cannot be told from an orphaned port
+	if !creating {
+		if orphans.Ports, err = orphanedPorts(); err != nil {
+			return nil, err
+		}
+	}
+	return orphans, nil
+}
+
+// addFiles adds the files of dir for which orphaned returns a reason. The
+// directories are not removed, as they are created by any macadam command.
+func (o *Orphans) addFiles(dir string, orphaned func(path string, entry fs.DirEntry) string) error {
+	return filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if path == dir && errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		reason := orphaned(path, entry)
+		if reason == "" {
+			return nil
+		}
+		var size int64
+		if fileInfo, err := entry.Info(); err == nil {
+			size = fileInfo.Size()
+		}
+		o.Files = append(o.Files, OrphanFile{Path: path, Size: size, Reason: reason})
+		return nil
+	})
+}
+
+// ownedByMachine tells if a component of the path of a file of dir is named
+// after one of the machines, such as <name>-qemu.qcow2, gvproxy-<name>.pid,
+// qmp_<name>.sock or the wsldist/<name> directory of WSL. When a machine name
+// is a prefix of another, the files of the other machine are kept.
+func ownedByMachine(dir, path string, names map[string]bool) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return true
+	}
+	for _, component := range strings.Split(rel, string(filepath.Separator)) {
+		for name := range names {
+			if component == name {
+				return true
+			}
+			for _, sep := range []string{"-", "_", "."} {
+				if strings.HasPrefix(component, name+sep) {
+					return true
+				}
+			}
+			for _, sep := range []string{"-", "_"} {
+				if strings.Contains(component, sep+name+".") {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// staleRuntimeFile returns why a file of the runtime directory which no
+// machine owns can be removed, or an empty string if it is in use, such as
+// the socket of macadam system service
+func staleRuntimeFile(path string, entry fs.DirEntry) string {
+	switch {
+	case entry.Type()&fs.ModeSocket != 0 || strings.HasSuffix(path, ".sock"):
+		conn, err := net.DialTimeout("unix", path, time.Second)
+		if err == nil {
+			conn.Close()
+			return ""
+		}
+		return "stale socket"
+	case strings.HasSuffix(path, ".pid"):
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return "stale pid file"
+		}
+		pid, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 32)
+		if err != nil || pid <= 0 {
+			return "stale pid file"
+		}
+		if running, err := process.PidExists(int32(pid)); err != nil || running {
+			return ""
+		}
+		return "stale pid file"
+	}
+	return "no machine"
+}
+
+// machineNames returns the names of the machines which have a configuration
+// file in configDir, including the incompatible ones podman does not load,
+// and of the machines being created. podman's Init holds the machine lock
+// while it creates the machine files, before writing the configuration.
+func machineNames(configDir string) (map[string]bool, bool, error) {
+	names := map[string]bool{}
+	entries, err := os.ReadDir(configDir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return names, false, nil
+		}
+		return nil, false, err
+	}
+	for _, entry := range entries {
+		if name, isConfig := strings.CutSuffix(entry.Name(), ".json"); isConfig {
+			names[name] = true
+		}
+	}
+	creating := false
+	for _, entry := range entries {
+		name, isLock := strings.CutSuffix(entry.Name(), ".lock")
+		if !isLock || names[name] {
+			continue
+		}
+		machineLock, err := lock.GetMachineLock(name, configDir)
+		if err != nil {
+			return nil, false, err
+		}
+		if err := machineLock.TryLock(); err != nil {
+			names[name] = true
+			creating = true
+			continue
+		}
+		machineLock.Unlock()
+	}
+	return names, creating, nil
+}
+
+// orphanedPorts returns the allocated ports which are not the SSH port of a
+// machine. The ports are allocated for the machines of all the providers.
+func orphanedPorts() ([]int, error) {
+	inUse := map[int]bool{}
+	for _, providerName := range provider.GetProviders() {
+		vmType, err := define.ParseVMType(providerName, define.UnknownVirt)
+		if err != nil {
+			return nil, err
+		}
+		dirs, err := env.GetMachineDirs(vmType)
+		if err != nil {
+			return nil, err
+		}
+		_, creating, err := machineNames(dirs.ConfigDir.GetPath())
+		if err != nil {
+			return nil, err
+		}
+		if creating {
+			return []int{}, nil
+		}
+		mcs, err := vmconfigs.LoadMachinesInDir(dirs)
+		if err != nil {
+			return nil, err
+		}
+		for _, mc := range mcs {
+			inUse[mc.SSH.Port] = true
+		}
+	}
+
+	allocated, err := allocatedPorts()
+	if err != nil {
+		return nil, err
+	}
+	orphaned := []int{}
+	for _, port := range allocated {
+		if !inUse[port] {
+			orphaned = append(orphaned, port)
+		}
+	}
+	slices.Sort(orphaned)
+	return orphaned, nil
+}
+
+// allocatedPorts reads the port allocation file, which podman does not
+// export
+func allocatedPorts() ([]int, error) {
+	dataDir, err := env.GetGlobalDataDir()
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(filepath.Join(dataDir, portAllocFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	allocated := []int{}
+	if err := json.Unmarshal(b, &allocated); err != nil {
+		// podman ignores a corrupted file, and rebuilds it at the next
+		// allocation
+		return nil, nil
+	}
+	return allocated, nil
+}
+
+// Prune removes the orphaned files and releases the orphaned ports. It goes
+// on after a failure, and returns the size of the removed files with all the
+// errors.
+func (c *Client) Prune(ctx context.Context, orphans *Orphans) (int64, error) {
+	var (
+		freed int64
+		errs  []error
+	)
+	for _, file := range orphans.Files {
+		if err := ctx.Err(); err != nil {
+			return freed, err
+		}
+		if err := os.Remove(file.Path); err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		freed += file.Size
+	}
+	for _, port := range orphans.Ports {
+		if err := ports.ReleaseMachinePort(port); err != nil {
+			errs = append(errs, fmt.Errorf("releasing port %d: %w", port, err))
+		}
+	}
+	return freed, errors.Join(errs...)
+}
@@ -0,0 +1,178 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/containers/common/pkg/config"
+	"github.com/containers/podman/v5/pkg/machine"
+	"github.com/containers/podman/v5/pkg/machine/connection"
+	"github.com/containers/podman/v5/pkg/machine/ports"
+	"github.com/containers/podman/v5/utils"
+	"github.com/crc-org/macadam/pkg/metadata"
+)
+
+// ResetPlan lists what Reset removes
+type ResetPlan struct {
+	// Machines are the machines of the provider, the running ones are
+	// stopped before being removed
+	Machines []*Machine
+	// Dirs are the directories removed with their content: the machine
+	// configurations, disks, cloud-init ISOs, cached images and sockets
+	Dirs []string
+	// Files are the files and directories in Dirs, so that they can be
+	// reviewed before the removal
+	Files []string
+	// Connections are the podman connections of the machines
+	Connections []string
+	// Ports are the SSH ports of the machines, released from the port
+	// allocations
+	Ports []int
+}
+
+// ResetPlan returns what Reset removes. Only the files which exist are
+// listed.
+func (c *Client) ResetPlan(ctx context.Context) (*ResetPlan, error) {
+	machines, err := c.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	plan := &ResetPlan{
+		Machines: machines,
+	}
+
+	// podman's shim.Reset removes the parents of the provider directories,
+	// which are shared with the other providers, such as applehv and
+	// libkrun on macOS, so only the directories of this provider are
+	// removed. macadam.conf and the logs are kept.
+	dirs, err := c.MachineDirs()
+	if err != nil {
+		return nil, err
+	}
+	metadataDir, err := metadata.Dir(c.vmProvider.VMType())
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range []string{dirs.ConfigDir.GetPath(), dirs.DataDir.GetPath(), dirs.RuntimeDir.GetPath(), metadataDir} {
+		files, err := listFiles(dir)
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			continue
+		}
+		plan.Dirs = append(plan.Dirs, dir)
+		plan.Files = append(plan.Files, files...)
+	}
+
+	names := map[string]bool{}
+	for _, m := range machines {
+		names[m.Name] = true
+		names[m.Name+"-root"] = true
+		if m.SSH.Port != 0 && !slices.Contains(plan.Ports, m.SSH.Port) {
+			plan.Ports = append(plan.Ports, m.SSH.Port)
+		}
+	}
+	plan.Connections, err = machineConnections(names)
+	if err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// machineConnections returns the machine connections of the connections
+// file which are in names. The file is read without containers.conf, whose
+// connections are not removed.
+func machineConnections(names map[string]bool) ([]string, error) {
+	connections, err := (&config.Config{}).GetAllConnections()
+	if err != nil {
+		return nil, err
+	}
+	found := []string{}
+	for _, conn := range connections {
+		if conn.IsMachine && names[conn.Name] {
+			found = append(found, conn.Name)
+		}
+	}
+	slices.Sort(found)
+	return found, nil
+}
+
+// listFiles returns dir and the files it contains. Nothing is returned when
+// dir does not exist or only holds empty directories, as the directories of
+// the provider are created by any macadam command.
+func listFiles(dir string) ([]string, error) {
+	files := []string{}
+	empty := true
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if path == dir && errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if !entry.IsDir() {
+			empty = false
+		}
+		files = append(files, path)
+		return nil
+	})
+	if empty {
+		return nil, err
+	}
+	return files, err
+}
+
+// Reset removes everything listed in plan. The machines are stopped and
+// removed first, so that their helper processes are stopped and the events
+// are emitted, then the remaining files are removed. Reset goes on after a
+// failure, and returns all the errors.
+func (c *Client) Reset(ctx context.Context, plan *ResetPlan) error {
+	var errs []error
+	for _, m := range plan.Machines {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		driver, err := c.driver(m.Name)
+		if err == nil {
+			err = driver.RemoveWithOptions(ctx, machine.RemoveOptions{Force: true})
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("removing machine %s: %w", m.Name, err))
+		}
+	}
+
+	// removing a machine may already have removed its connections, and
+	// RemoveConnections fails for the missing ones
+	names := map[string]bool{}
+	for _, name := range plan.Connections {
+		names[name] = true
+	}
+	remaining, err := machineConnections(names)
+	if err == nil && len(remaining) > 0 {
+		err = connection.RemoveConnections(map[string]bool{}, remaining...)
+	}
+	if err != nil {
+		errs = append(errs, fmt.Errorf("removing connections: %w", err))
+	}
+	// the ports of the removed machines were already released, releasing
+	// them again is a no-op
+	for _, port := range plan.Ports {
+		if err := ports.ReleaseMachinePort(port); err != nil {
+			errs = append(errs, fmt.Errorf("releasing port %d: %w", port, err))
+		}
+	}
+	for _, dir := range plan.Dirs {
+		if err := utils.GuardedRemoveAll(dir); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+
+	c.updateSSHConfig(ctx)
+	return errors.Join(errs...)
+}
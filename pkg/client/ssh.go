@@ -0,0 +1,104 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"github.com/containers/podman/v5/pkg/machine/define"
+	macadam "github.com/crc-org/macadam/pkg/machinedriver"
+	"github.com/crc-org/macadam/pkg/sshkeys"
+	"github.com/sirupsen/logrus"
+)
+
+// sshBinary runs the ssh binary of the host, like podman's
+// machine.LocalhostSSHShellWithAddress. The host key of the machine is
+// checked with its known_hosts file, if it has one.
+func sshBinary(target sshkeys.Target, knownHostsFile, command string, opts SSHOptions) error {
+	strictHostKeyChecking := "no"
+	if knownHostsFile != "" {
+		strictHostKeyChecking = "yes"
+	} else {
+		knownHostsFile = os.DevNull
+	}
+	args := []string{
+		"-i", target.IdentityPath,
+		"-p", strconv.Itoa(target.Port),
+		target.User + "@" + target.Address,
+		"-o", "IdentitiesOnly=yes",
+		"-o", "StrictHostKeyChecking=" + strictHostKeyChecking,
+		"-o", "UserKnownHostsFile=" + knownHostsFile,
+		"-o", "HostKeyAlias=" + sshkeys.HostKeyAlias(target.Name),
+		"-o", "CheckHostIP=no",
+		"-o", "LogLevel=ERROR",
+		"-o", "SetEnv=LC_ALL=",
+	}
+	if opts.ForwardAgent {
+		args = append(args, "-A")
+	}
+	interactive := len(opts.Args) == 0
+	if interactive {
+		// ensure we have a tty
+		args = append(args, "-t")
+		fmt.Fprintf(opts.Stderr, "Connecting to vm %s. To close connection, use `~.` or `exit`\n", target.Name)
+	}
+	if command != "" {
+		args = append(args, command)
+	}
+
+	cmd := exec.Command("ssh", args...)
+	logrus.Debugf("Executing: ssh %v\n", args)
+	if err := setupIOPassthrough(cmd, interactive, opts.Stdin, opts.Stdout, opts.Stderr); err != nil {
+		return err
+	}
+	return cmd.Run()
+}
+
+// sshTarget returns the SSH server of the running machine called name, or
+// of the default machine if name is empty. username overrides the user
+// configured for the machine.
+func (c *Client) sshTarget(ctx context.Context, name, username string) (sshkeys.Target, error) {
+	name, err := c.resolveName(ctx, name)
+	if err != nil {
+		return sshkeys.Target{}, err
+	}
+	mc, err := c.loadMachine(name)
+	if err != nil {
+		return sshkeys.Target{}, err
+	}
+
+	state, err := c.vmProvider.State(mc, false)
+	if err != nil {
+		return sshkeys.Target{}, err
+	}
+	if state != define.Running {
+		return sshkeys.Target{}, newMachineError(ErrMachineNotRunning, "vm %q is not running", mc.Name)
+	}
+
+	target := macadam.SSHTarget(mc)
+	if username != "" {
+		target.User = username
+	}
+	dirs, err := c.MachineDirs()
+	if err != nil {
+		return sshkeys.Target{}, err
+	}
+	// nil for the machines created before the host keys were pinned
+	target.HostKey, err = sshkeys.LoadHostKey(dirs.DataDir.GetPath(), mc.Name)
+	if err != nil {
+		return sshkeys.Target{}, err
+	}
+	return target, nil
+}
+
+// knownHostsFile returns the known_hosts file of the machine, or an empty
+// string if its host key is not pinned
+func knownHostsFile(dirs *define.MachineDirs, name string) string {
+	path := sshkeys.KnownHostsPath(dirs.DataDir.GetPath(), name)
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+
+package client
+
+import (
+	"io"
+	"os/exec"
+)
+
+func setupIOPassthrough(cmd *exec.Cmd, _ bool, stdin io.Reader, stdout, stderr io.Writer) error {
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	return nil
+}
@@ -0,0 +1,23 @@
+//go:build windows
+
+package client
+
+import (
+	"io"
+	"os/exec"
+)
+
+func setupIOPassthrough(cmd *exec.Cmd, interactive bool, stdin io.Reader, stdout, stderr io.Writer) error {
+	cmd.Stdin = stdin
+	if interactive {
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+		return nil
+	}
+	// OpenSSH mucks with the associated virtual console when there is no
+	// pty, leaving it in a broken state. Wrapping the files makes exec
+	// copy the output through pipes.
+	cmd.Stdout = struct{ io.Writer }{stdout}
+	cmd.Stderr = struct{ io.Writer }{stderr}
+	return nil
+}
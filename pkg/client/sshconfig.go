@@ -0,0 +1,83 @@
+package client
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/crc-org/macadam/pkg/sshconfig"
+	"github.com/crc-org/macadam/pkg/sshkeys"
+)
+
+// SSHConfigHost returns the OpenSSH client configuration of the machine
+func (m *Machine) SSHConfigHost() sshconfig.Host {
+	hostName := "localhost"
+	if m.IPAddress != "" {
+		hostName = m.IPAddress
+	}
+	host := sshconfig.Host{
+		Name:         m.Name,
+		HostName:     hostName,
+		Port:         m.SSH.Port,
+		User:         m.SSH.RemoteUsername,
+		IdentityFile: m.SSH.IdentityPath,
+	}
+	if m.KnownHostsFile != "" {
+		host.KnownHostsFile = m.KnownHostsFile
+		host.HostKeyAlias = sshkeys.HostKeyAlias(m.Name)
+	}
+	return host
+}
+
+// SSHConfig returns the OpenSSH client configuration of the machines called
+// names, or of all the machines if names is empty
+func (c *Client) SSHConfig(ctx context.Context, names []string) ([]sshconfig.Host, error) {
+	var machines []*Machine
+	if len(names) == 0 {
+		var err error
+		machines, err = c.List(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range names {
+		m, err := c.Inspect(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		machines = append(machines, m)
+	}
+
+	hosts := make([]sshconfig.Host, 0, len(machines))
+	for _, m := range machines {
+		hosts = append(hosts, m.SSHConfigHost())
+	}
+	return hosts, nil
+}
+
+// InstallSSHConfig writes the OpenSSH client configuration of all the
+// machines to a file included from ~/.ssh/config. Once installed, the file
+// is updated when machines are created, started or removed.
+func (c *Client) InstallSSHConfig(ctx context.Context) error {
+	hosts, err := c.SSHConfig(ctx, nil)
+	if err != nil {
+		return err
+	}
+	return sshconfig.Install(c.vmProvider.VMType(), hosts)
+}
+
+// updateSSHConfig updates the installed OpenSSH client configuration after
+// a machine was created, started or removed, as its port may have changed.
+// Failures do not fail the machine operation.
+func (c *Client) updateSSHConfig(ctx context.Context) {
+	vmType := c.vmProvider.VMType()
+	if !sshconfig.IsInstalled(vmType) {
+		return
+	}
+	hosts, err := c.SSHConfig(ctx, nil)
+	if err == nil {
+		err = sshconfig.Update(vmType, hosts)
+	}
+	if err != nil {
+		slog.Warn("failed to update the ssh configuration", "error", err)
+	}
+}
@@ -0,0 +1,127 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/pkg/machine/env"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	macadam "github.com/crc-org/macadam/pkg/machinedriver"
+	"github.com/crc-org/macadam/pkg/sshkeys"
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrCustomSSHKey is returned when rotating the key given with
+// InitOptions.SSHIdentityPath, which belongs to the user
+var ErrCustomSSHKey = errors.New("the SSH key was given at init")
+
+// RotateSSHKey replaces the SSH key of the machine called name, or of the
+// default machine if name is empty, with a new key pair. The machine must
+// be running: the new key is authorized in the machine using the old one,
+// then the old key is revoked using the new one. Machines using podman's
+// shared key get their own key, the keys given at init are not rotated.
+func (c *Client) RotateSSHKey(ctx context.Context, name string) error {
+	name, err := c.resolveName(ctx, name)
+	if err != nil {
+		return err
+	}
+	mc, err := c.loadMachine(name)
+	if err != nil {
+		return err
+	}
+	err = c.rotateSSHKey(ctx, mc)
+	// the key path changes for the machines using podman's key
+	c.updateSSHConfig(ctx)
+	return err
+}
+
+func (c *Client) rotateSSHKey(ctx context.Context, mc *vmconfigs.MachineConfig) error {
+	mc.Lock()
+	defer mc.Unlock()
+
+	state, err := c.vmProvider.State(mc, false)
+	if err != nil {
+		return err
+	}
+	if state != define.Running {
+		return newMachineError(ErrMachineNotRunning, "vm %q is not running, its SSH key can only be rotated while it runs", mc.Name)
+	}
+
+	dirs, err := c.MachineDirs()
+	if err != nil {
+		return err
+	}
+	identityPath := sshkeys.IdentityPath(dirs.DataDir.GetPath(), mc.Name)
+	sharedPath, err := env.GetSSHIdentityPath(define.DefaultIdentityName)
+	if err != nil {
+		return err
+	}
+	if mc.SSH.IdentityPath != identityPath && mc.SSH.IdentityPath != sharedPath {
+		return fmt.Errorf("machine %q uses %s: %w", mc.Name, mc.SSH.IdentityPath, ErrCustomSSHKey)
+	}
+
+	oldKey, err := sshkeys.ReadAuthorizedKey(mc.SSH.IdentityPath)
+	if err != nil {
+		return err
+	}
+	newPath := identityPath + ".new"
+	if err := sshkeys.GenerateIdentity(newPath, sshkeys.HostKeyAlias(mc.Name)); err != nil {
+		return err
+	}
+	newKey, err := sshkeys.ReadAuthorizedKey(newPath)
+	if err != nil {
+		_ = sshkeys.RemoveIdentity(newPath)
+		return err
+	}
+
+	c.progress.Report(mc.Name, "Rotating the SSH key of machine %q", mc.Name)
+	target := macadam.SSHTarget(mc)
+	if target.HostKey, err = sshkeys.LoadHostKey(dirs.DataDir.GetPath(), mc.Name); err != nil {
+		_ = sshkeys.RemoveIdentity(newPath)
+		return err
+	}
+	if err := sshkeys.Run(ctx, target, authorizeKeyCommand(newKey, mc.Name)); err != nil {
+		_ = sshkeys.RemoveIdentity(newPath)
+		return err
+	}
+
+	// from now on the new key is authorized, it is kept even if the old
+	// key cannot be revoked
+	if err := sshkeys.RenameIdentity(newPath, identityPath); err != nil {
+		return err
+	}
+	mc.SSH.IdentityPath = identityPath
+	if err := mc.Write(); err != nil {
+		return err
+	}
+
+	target.IdentityPath = identityPath
+	if err := sshkeys.Run(ctx, target, revokeKeyCommand(oldKey)); err != nil {
+		return fmt.Errorf("the new SSH key is in use, but the old key is still authorized in machine %q: %w", mc.Name, err)
+	}
+	c.progress.Report(mc.Name, "SSH key of machine %q rotated, the new key is %s", mc.Name, identityPath)
+	return nil
+}
+
+// authorizedKeysFile is relative to the home directory of the machine user,
+// where the ssh module of cloud-init writes the key
+const authorizedKeysFile = ".ssh/authorized_keys"
+
+// authorizeKeyCommand returns a shell command appending key to the
+// authorized keys of the machine user. The keys are base64, and the comment
+// is a machine name, so they need no escaping.
+func authorizeKeyCommand(key ssh.PublicKey, name string) string {
+	line := strings.TrimSuffix(string(ssh.MarshalAuthorizedKey(key)), "\n") + " " + sshkeys.HostKeyAlias(name)
+	return fmt.Sprintf("umask 077 && mkdir -p ~/.ssh && echo '%s' >> ~/%s", line, authorizedKeysFile)
+}
+
+// revokeKeyCommand returns a shell command removing the lines with key from
+// the authorized keys of the machine user. grep exits with 1 when no line is
+// left, which is not an error here.
+func revokeKeyCommand(key ssh.PublicKey) string {
+	blob := strings.Fields(string(ssh.MarshalAuthorizedKey(key)))[1]
+	return fmt.Sprintf("cd ~ && { grep -vF '%[1]s' %[2]s > %[2]s.macadam; [ $? -le 1 ]; } && chmod 600 %[2]s.macadam && mv %[2]s.macadam %[2]s", blob, authorizedKeysFile)
+}
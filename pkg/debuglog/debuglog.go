@@ -0,0 +1,140 @@
+// Package debuglog keeps the logs of the recent macadam commands, including
+// the debug messages, so that they can be included in the bundles created by
+// macadam system diag.
+package debuglog
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/crc-org/macadam/pkg/env"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	logFile = "macadam.log"
+	// the log is rotated when it reaches maxLogSize, the previous logs are
+	// kept in a single backup file
+	maxLogSize = 1024 * 1024
+)
+
+// Path returns the path of the debug log
+func Path() (string, error) {
+	dir, err := env.GetConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, logFile), nil
+}
+
+// RotatedPath returns the path of the backup of the debug log at path
+func RotatedPath(path string) string {
+	return path + ".1"
+}
+
+// writer appends to the debug log, which is opened on the first write.
+// Failing to open it is not an error, the logs are dropped in this case.
+type writer struct {
+	once sync.Once
+	lock sync.Mutex
+	file *os.File
+}
+
+var logWriter = &writer{}
+
+func (w *writer) open() {
+	path, err := Path()
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return
+	}
+	if fileInfo, err := os.Stat(path); err == nil && fileInfo.Size() >= maxLogSize {
+		// another macadam process may rotate it at the same time, one of
+		// the renames fails and the logs go to the new file anyway
+		_ = os.Rename(path, RotatedPath(path))
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	w.file = f
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	w.once.Do(w.open)
+	if w.file == nil {
+		return len(p), nil
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	// a single write per record, so that the records of concurrent
+	// processes are not mixed
+	_, _ = w.file.Write(p)
+	return len(p), nil
+}
+
+// handler passes the records to next, and writes all of them, including the
+// debug ones, to the debug log
+type handler struct {
+	next slog.Handler
+	log  slog.Handler
+}
+
+// NewHandler returns a slog handler which passes the records to next, and
+// also writes them to the debug log, whatever their level
+func NewHandler(next slog.Handler) slog.Handler {
+	return &handler{
+		next: next,
+		log: slog.NewTextHandler(logWriter, &slog.HandlerOptions{
+			Level: slog.LevelDebug,
+		}).WithAttrs([]slog.Attr{slog.Int("pid", os.Getpid())}),
+	}
+}
+
+func (h *handler) Enabled(_ context.Context, _ slog.Level) bool {
+	return true
+}
+
+func (h *handler) Handle(ctx context.Context, record slog.Record) error {
+	_ = h.log.Handle(ctx, record.Clone())
+	if !h.next.Enabled(ctx, record.Level) {
+		return nil
+	}
+	return h.next.Handle(ctx, record)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &handler{next: h.next.WithAttrs(attrs), log: h.log.WithAttrs(attrs)}
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return &handler{next: h.next.WithGroup(name), log: h.log.WithGroup(name)}
+}
+
+// LogrusHook writes the messages logged by the podman code with logrus to
+// the debug log. Only the messages of the levels enabled with --log-level
+// reach the hooks.
+type LogrusHook struct{}
+
+var logrusFormatter = &logrus.TextFormatter{
+	DisableColors: true,
+	FullTimestamp: true,
+}
+
+func (LogrusHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (LogrusHook) Fire(entry *logrus.Entry) error {
+	b, err := logrusFormatter.Format(entry)
+	if err != nil {
+		return nil
+	}
+	_, _ = logWriter.Write(b)
+	return nil
+}
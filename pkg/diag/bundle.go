@@ -0,0 +1,106 @@
+// Package diag writes the support bundles created by macadam system diag, a
+// tar.gz archive of the files needed to investigate a machine failure.
+package diag
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+)
+
+// notesFile lists the files which could not be collected
+const notesFile = "NOTES.txt"
+
+// Bundle is a support bundle being written
+type Bundle struct {
+	file  *os.File
+	gz    *gzip.Writer
+	tw    *tar.Writer
+	notes []string
+}
+
+// Create creates the bundle at path, it must be closed with Close
+func Create(path string) (*Bundle, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	gz := gzip.NewWriter(f)
+	return &Bundle{
+		file: f,
+		gz:   gz,
+		tw:   tar.NewWriter(gz),
+	}, nil
+}
+
+// AddBytes adds a file called name with data as content
+func (b *Bundle) AddBytes(name string, data []byte) error {
+	return b.add(name, data, time.Now())
+}
+
+func (b *Bundle) add(name string, data []byte, modTime time.Time) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: modTime.Truncate(time.Second),
+	}
+	if err := b.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := b.tw.Write(data)
+	return err
+}
+
+// AddJSON adds a file called name with the JSON encoding of v
+func (b *Bundle) AddJSON(name string, v any) error {
+	data, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return err
+	}
+	return b.AddBytes(name, append(data, '\n'))
+}
+
+// AddFile adds the file at path as name. The content is passed to redact
+// first when it is not nil. A missing file is recorded in the notes of the
+// bundle, it is not an error.
+func (b *Bundle) AddFile(name, path string, redact func([]byte) []byte) error {
+	fileInfo, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		b.Notef("%s: %s does not exist", name, path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if redact != nil {
+		data = redact(data)
+	}
+	return b.add(name, data, fileInfo.ModTime())
+}
+
+// Notef records a note, such as a file which could not be collected, in the
+// notes file of the bundle
+func (b *Bundle) Notef(format string, args ...any) {
+	b.notes = append(b.notes, fmt.Sprintf(format, args...))
+}
+
+// Close writes the notes and closes the bundle
+func (b *Bundle) Close() error {
+	var errs []error
+	if len(b.notes) > 0 {
+		errs = append(errs, b.AddBytes(notesFile, []byte(strings.Join(b.notes, "\n")+"\n")))
+	}
+	errs = append(errs, b.tw.Close(), b.gz.Close(), b.file.Close())
+	return errors.Join(errs...)
+}
@@ -0,0 +1,107 @@
+package diag
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Redacted replaces the secrets in the files of the bundles
+const Redacted = "<redacted>"
+
+// secretKeyRegexp matches the keys of the JSON and YAML values which must
+// not be shared, such as the private SSH host key in the cloud-init
+// user-data, or the passwords set by chpasswd
+var secretKeyRegexp = regexp.MustCompile(`(?i)(passw(or)?d|secret|token|private|credential|api_?key)`)
+
+// secretLineRegexp is used for the files which cannot be parsed, it matches
+// the lines with a key: value or key=value secret
+var secretLineRegexp = regexp.MustCompile(`(?im)^(\s*(?:-\s*|export\s+)?"?[\w.-]*(?:passw(?:or)?d|secret|token|private|credential|api_?key)[\w.-]*"?\s*[:=]\s*).+$`)
+
+// privateKeyRegexp matches PEM and OpenSSH private keys
+var privateKeyRegexp = regexp.MustCompile(`(?s)-----BEGIN [A-Z ]*PRIVATE KEY-----.*?-----END [A-Z ]*PRIVATE KEY-----`)
+
+// RedactJSON replaces the values of the secret keys of a JSON document. The
+// lines with secrets are redacted when data is not valid JSON.
+func RedactJSON(data []byte) []byte {
+	var doc any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return RedactText(data)
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "    ")
+	if err := enc.Encode(redactValue(doc)); err != nil {
+		return RedactText(data)
+	}
+	return buf.Bytes()
+}
+
+func redactValue(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, child := range v {
+			if secretKeyRegexp.MatchString(key) {
+				v[key] = Redacted
+				continue
+			}
+			v[key] = redactValue(child)
+		}
+	case []any:
+		for i, child := range v {
+			v[i] = redactValue(child)
+		}
+	}
+	return value
+}
+
+// RedactYAML replaces the values of the secret keys of a YAML document, such
+// as a cloud-init user-data. The comments, such as the #cloud-config header,
+// are kept. The lines with secrets are redacted when data is not valid YAML,
+// for example for a user-data shell script.
+func RedactYAML(data []byte) []byte {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil || doc.Kind != yaml.DocumentNode {
+		return RedactText(data)
+	}
+	redactNode(&doc)
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return RedactText(data)
+	}
+	return buf.Bytes()
+}
+
+func redactNode(node *yaml.Node) {
+	if node.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if secretKeyRegexp.MatchString(key.Value) {
+				node.Content[i+1] = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: Redacted}
+				continue
+			}
+			redactNode(value)
+		}
+		return
+	}
+	for _, child := range node.Content {
+		redactNode(child)
+	}
+	// secrets can also be in the scalars, such as a private key written by
+	// write_files
+	if node.Kind == yaml.ScalarNode && privateKeyRegexp.MatchString(node.Value) {
+		node.Value = Redacted
+	}
+}
+
+// RedactText replaces the private keys, and the values of the key: value or
+// key=value lines with a secret key
+func RedactText(data []byte) []byte {
+	data = privateKeyRegexp.ReplaceAll(data, []byte(Redacted))
+	return secretLineRegexp.ReplaceAll(data, []byte("${1}"+Redacted))
+}
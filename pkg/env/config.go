@@ -0,0 +1,361 @@
+package env
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/storage/pkg/homedir"
+	"github.com/containers/storage/pkg/ioutils"
+)
+
+// Built-in machine defaults, used when neither macadam.conf nor the
+// environment provide a value
+const (
+	DefaultMachineName = "macadam"
+	DefaultCPUs        = 2
+	DefaultMemory      = 4096 // MiB
+	DefaultDiskSize    = 20   // GiB
+	DefaultUsername    = "core"
+)
+
+const configFile = "macadam.conf"
+
+// environment variables overriding the values from macadam.conf
+const (
+	providerEnv = "MACADAM_PROVIDER"
+	nameEnv     = "MACADAM_NAME"
+	cpusEnv     = "MACADAM_CPUS"
+	memoryEnv   = "MACADAM_MEMORY"
+	diskSizeEnv = "MACADAM_DISK_SIZE"
+	usernameEnv = "MACADAM_USERNAME"
+)
+
+// MachineDefaults holds the values used when creating a machine without
+// explicitly specifying them. Zero values mean "not set".
+type MachineDefaults struct {
+	Name     string `toml:"name,omitempty"`
+	CPUs     uint64 `toml:"cpus,omitzero"`
+	Memory   uint64 `toml:"memory,omitzero"`
+	DiskSize uint64 `toml:"disk_size,omitzero"`
+	Username string `toml:"username,omitempty"`
+}
+
+// Config is the content of the macadam.conf file
+type Config struct {
+	// Provider is the virtualization provider used when --provider is not specified
+	Provider string `toml:"provider,omitempty"`
+	// Machine holds the defaults shared by all providers
+	Machine MachineDefaults `toml:"machine,omitempty"`
+	// Providers holds per-provider defaults, they take precedence over Machine
+	Providers map[string]MachineDefaults `toml:"providers,omitempty"`
+
+	path string
+}
+
+var machineKeys = []string{"name", "cpus", "memory", "disk_size", "username"}
+
+// BuiltinMachineDefaults returns the defaults compiled into macadam
+func BuiltinMachineDefaults() MachineDefaults {
+	return MachineDefaults{
+		Name:     DefaultMachineName,
+		CPUs:     DefaultCPUs,
+		Memory:   DefaultMemory,
+		DiskSize: DefaultDiskSize,
+		Username: DefaultUsername,
+	}
+}
+
+// GetConfigDir returns the directory holding macadam's own configuration files
+// e.g. /home/user/.config/macadam
+func GetConfigDir() (string, error) {
+	if err := SetupHome(); err != nil {
+		return "", err
+	}
+	if home := Home(); home != "" {
+		return filepath.Join(homeConfigDir(home), "macadam"), nil
+	}
+	path, err := homedir.GetConfigHome()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(path, "macadam"), nil
+}
+
+// ConfigPath returns the path of the macadam.conf file
+func ConfigPath() (string, error) {
+	dir, err := GetConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, configFile), nil
+}
+
+// LoadConfig reads macadam.conf. A missing file is not an error, an empty
+// configuration is returned in this case.
+func LoadConfig() (*Config, error) {
+	path, err := ConfigPath()
+	if err != nil {
+		return nil, err
+	}
+	return loadConfigFromPath(path)
+}
+
+func loadConfigFromPath(path string) (*Config, error) {
+	cfg := &Config{path: path}
+	md, err := toml.DecodeFile(path, cfg)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return cfg, nil
+		}
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("failed to parse %s: unknown key %q", path, undecoded[0].String())
+	}
+	for name := range cfg.Providers {
+		if _, err := parseProvider(name); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+	}
+
+	return cfg, nil
+}
+
+// Write saves the configuration to the file it was loaded from
+func (cfg *Config) Write() error {
+	if err := os.MkdirAll(filepath.Dir(cfg.path), 0755); err != nil {
+		return err
+	}
+	var b strings.Builder
+	enc := toml.NewEncoder(&b)
+	enc.Indent = ""
+	if err := enc.Encode(cfg); err != nil {
+		return err
+	}
+	return ioutils.AtomicWriteFile(cfg.path, []byte(b.String()), 0644)
+}
+
+// DefaultProvider returns the provider to use when --provider is not
+// specified, or an empty string to use the platform default
+func (cfg *Config) DefaultProvider() string {
+	if provider := os.Getenv(providerEnv); provider != "" {
+		return provider
+	}
+	return cfg.Provider
+}
+
+// MachineDefaults returns the defaults to use for machines created with the
+// given provider. Values are looked up in this order: environment variables,
+// the [providers.<provider>] section, the [machine] section, the built-in defaults.
+func (cfg *Config) MachineDefaults(provider string) (MachineDefaults, error) {
+	defaults := BuiltinMachineDefaults()
+	defaults.merge(cfg.Machine)
+	if provider != "" {
+		defaults.merge(cfg.Providers[provider])
+	}
+
+	fromEnv, err := machineDefaultsFromEnv()
+	if err != nil {
+		return MachineDefaults{}, err
+	}
+	defaults.merge(fromEnv)
+
+	return defaults, nil
+}
+
+// Get returns the effective value of a configuration key, taking into account
+// built-in defaults and environment variables
+func (cfg *Config) Get(key string) (string, error) {
+	if key == "provider" {
+		return cfg.DefaultProvider(), nil
+	}
+	section, provider, field, err := splitKey(key)
+	if err != nil {
+		return "", err
+	}
+	if section == "machine" {
+		provider = ""
+	}
+	defaults, err := cfg.MachineDefaults(provider)
+	if err != nil {
+		return "", err
+	}
+	return defaults.get(field)
+}
+
+// Set changes the value of a configuration key. The change is not persisted
+// until Write is called.
+func (cfg *Config) Set(key, value string) error {
+	if key == "provider" {
+		if value != "" {
+			if _, err := parseProvider(value); err != nil {
+				return err
+			}
+		}
+		cfg.Provider = value
+		return nil
+	}
+	section, provider, field, err := splitKey(key)
+	if err != nil {
+		return err
+	}
+	if section == "machine" {
+		return cfg.Machine.set(field, value)
+	}
+
+	if cfg.Providers == nil {
+		cfg.Providers = map[string]MachineDefaults{}
+	}
+	defaults := cfg.Providers[provider]
+	if err := defaults.set(field, value); err != nil {
+		return err
+	}
+	if defaults == (MachineDefaults{}) {
+		delete(cfg.Providers, provider)
+	} else {
+		cfg.Providers[provider] = defaults
+	}
+	return nil
+}
+
+// Keys returns all the configuration keys which apply to the given providers,
+// in the order they should be displayed
+func Keys(providers []string) []string {
+	keys := []string{"provider"}
+	for _, field := range machineKeys {
+		keys = append(keys, "machine."+field)
+	}
+	providers = append([]string{}, providers...)
+	sort.Strings(providers)
+	for _, provider := range providers {
+		for _, field := range machineKeys {
+			keys = append(keys, fmt.Sprintf("providers.%s.%s", provider, field))
+		}
+	}
+	return keys
+}
+
+func splitKey(key string) (section, provider, field string, err error) {
+	parts := strings.Split(key, ".")
+	switch {
+	case len(parts) == 2 && parts[0] == "machine":
+		section, field = parts[0], parts[1]
+	case len(parts) == 3 && parts[0] == "providers":
+		section, provider, field = parts[0], parts[1], parts[2]
+		if _, err := parseProvider(provider); err != nil {
+			return "", "", "", err
+		}
+	default:
+		return "", "", "", fmt.Errorf("unknown configuration key %q", key)
+	}
+	for _, k := range machineKeys {
+		if k == field {
+			return section, provider, field, nil
+		}
+	}
+	return "", "", "", fmt.Errorf("unknown configuration key %q", key)
+}
+
+func parseProvider(name string) (define.VMType, error) {
+	vmType, err := define.ParseVMType(name, define.UnknownVirt)
+	if err != nil || vmType == define.UnknownVirt {
+		return define.UnknownVirt, fmt.Errorf("unknown provider %q", name)
+	}
+	return vmType, nil
+}
+
+func machineDefaultsFromEnv() (MachineDefaults, error) {
+	var defaults MachineDefaults
+	for field, envVar := range map[string]string{
+		"name":      nameEnv,
+		"cpus":      cpusEnv,
+		"memory":    memoryEnv,
+		"disk_size": diskSizeEnv,
+		"username":  usernameEnv,
+	} {
+		value, ok := os.LookupEnv(envVar)
+		if !ok || value == "" {
+			continue
+		}
+		if err := defaults.set(field, value); err != nil {
+			return MachineDefaults{}, fmt.Errorf("invalid value for %s: %w", envVar, err)
+		}
+	}
+	return defaults, nil
+}
+
+// merge overrides the fields of defaults with the non-zero fields of other
+func (defaults *MachineDefaults) merge(other MachineDefaults) {
+	if other.Name != "" {
+		defaults.Name = other.Name
+	}
+	if other.CPUs != 0 {
+		defaults.CPUs = other.CPUs
+	}
+	if other.Memory != 0 {
+		defaults.Memory = other.Memory
+	}
+	if other.DiskSize != 0 {
+		defaults.DiskSize = other.DiskSize
+	}
+	if other.Username != "" {
+		defaults.Username = other.Username
+	}
+}
+
+func (defaults *MachineDefaults) get(field string) (string, error) {
+	switch field {
+	case "name":
+		return defaults.Name, nil
+	case "cpus":
+		return strconv.FormatUint(defaults.CPUs, 10), nil
+	case "memory":
+		return strconv.FormatUint(defaults.Memory, 10), nil
+	case "disk_size":
+		return strconv.FormatUint(defaults.DiskSize, 10), nil
+	case "username":
+		return defaults.Username, nil
+	}
+	return "", fmt.Errorf("unknown configuration key %q", field)
+}
+
+// set changes the value of field, an empty value unsets it
+func (defaults *MachineDefaults) set(field, value string) error {
+	var (
+		number uint64
+		err    error
+	)
+	switch field {
+	case "cpus", "memory", "disk_size":
+		if value != "" {
+			number, err = strconv.ParseUint(value, 10, 64)
+			if err != nil || number == 0 {
+				return fmt.Errorf("%q is not a valid value for %s, it must be a positive integer", value, field)
+			}
+		}
+	}
+
+	switch field {
+	case "name":
+		defaults.Name = value
+	case "cpus":
+		defaults.CPUs = number
+	case "memory":
+		defaults.Memory = number
+	case "disk_size":
+		defaults.DiskSize = number
+	case "username":
+		defaults.Username = value
+	default:
+		return fmt.Errorf("unknown configuration key %q", field)
+	}
+	return nil
+}
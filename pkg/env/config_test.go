@@ -0,0 +1,214 @@
+package env
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes a macadam.conf with content and loads it
+func writeConfig(t *testing.T, content string) (*Config, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), configFile)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return loadConfigFromPath(path)
+}
+
+// clearEnv unsets the environment variables overriding the configuration
+func clearEnv(t *testing.T) {
+	for _, name := range []string{providerEnv, nameEnv, cpusEnv, memoryEnv, diskSizeEnv, usernameEnv} {
+		t.Setenv(name, "")
+	}
+}
+
+func TestMachineDefaults(t *testing.T) {
+	const config = `
+provider = "qemu"
+
+[machine]
+cpus = 4
+memory = 8192
+username = "fedora"
+
+[providers.qemu]
+cpus = 6
+disk_size = 50
+`
+	tests := []struct {
+		name     string
+		config   string
+		provider string
+		env      map[string]string
+		expected MachineDefaults
+	}{
+		{
+			name:     "built-in",
+			expected: BuiltinMachineDefaults(),
+		},
+		{
+			name:     "machine section",
+			config:   config,
+			expected: MachineDefaults{Name: DefaultMachineName, CPUs: 4, Memory: 8192, DiskSize: DefaultDiskSize, Username: "fedora"},
+		},
+		{
+			name:     "provider section",
+			config:   config,
+			provider: "qemu",
+			expected: MachineDefaults{Name: DefaultMachineName, CPUs: 6, Memory: 8192, DiskSize: 50, Username: "fedora"},
+		},
+		{
+			name:     "section of another provider",
+			config:   config,
+			provider: "libkrun",
+			expected: MachineDefaults{Name: DefaultMachineName, CPUs: 4, Memory: 8192, DiskSize: DefaultDiskSize, Username: "fedora"},
+		},
+		{
+			name:     "environment",
+			config:   config,
+			provider: "qemu",
+			env:      map[string]string{cpusEnv: "8", nameEnv: "dev", usernameEnv: "core"},
+			expected: MachineDefaults{Name: "dev", CPUs: 8, Memory: 8192, DiskSize: 50, Username: "core"},
+		},
+		{
+			name:     "empty environment variable",
+			config:   config,
+			provider: "qemu",
+			env:      map[string]string{cpusEnv: ""},
+			expected: MachineDefaults{Name: DefaultMachineName, CPUs: 6, Memory: 8192, DiskSize: 50, Username: "fedora"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clearEnv(t)
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			cfg, err := writeConfig(t, test.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defaults, err := cfg.MachineDefaults(test.provider)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if defaults != test.expected {
+				t.Errorf("expected %+v, got %+v", test.expected, defaults)
+			}
+		})
+	}
+}
+
+func TestDefaultProvider(t *testing.T) {
+	clearEnv(t)
+	cfg, err := writeConfig(t, `provider = "qemu"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if provider := cfg.DefaultProvider(); provider != "qemu" {
+		t.Errorf("expected qemu, got %q", provider)
+	}
+	t.Setenv(providerEnv, "libkrun")
+	if provider := cfg.DefaultProvider(); provider != "libkrun" {
+		t.Errorf("expected libkrun, got %q", provider)
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{
+			name:   "syntax",
+			config: "[machine",
+			err:    "failed to parse",
+		},
+		{
+			name:   "unknown key",
+			config: "[machine]\ngpus = 1\n",
+			err:    `unknown key "machine.gpus"`,
+		},
+		{
+			name:   "unknown provider",
+			config: "[providers.virtualbox]\ncpus = 1\n",
+			err:    `unknown provider "virtualbox"`,
+		},
+		{
+			name:   "wrong type",
+			config: "[machine]\ncpus = \"two\"\n",
+			err:    "failed to parse",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := writeConfig(t, test.config)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("expected an error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestInvalidEnv(t *testing.T) {
+	for _, value := range []string{"0", "-1", "two"} {
+		t.Run(value, func(t *testing.T) {
+			clearEnv(t)
+			t.Setenv(cpusEnv, value)
+			cfg, err := writeConfig(t, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := cfg.MachineDefaults(""); err == nil || !strings.Contains(err.Error(), cpusEnv) {
+				t.Errorf("expected an error about %s, got %v", cpusEnv, err)
+			}
+		})
+	}
+}
+
+func TestSet(t *testing.T) {
+	tests := []struct {
+		key   string
+		value string
+		err   bool
+	}{
+		{key: "provider", value: "qemu"},
+		{key: "provider", value: "virtualbox", err: true},
+		{key: "machine.cpus", value: "3"},
+		{key: "machine.cpus", value: "0", err: true},
+		{key: "machine.memory", value: "lots", err: true},
+		{key: "machine.gpus", value: "1", err: true},
+		{key: "providers.qemu.disk_size", value: "40"},
+		{key: "providers.virtualbox.cpus", value: "1", err: true},
+		{key: "providers.qemu", value: "1", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.key+"="+test.value, func(t *testing.T) {
+			clearEnv(t)
+			cfg, err := writeConfig(t, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = cfg.Set(test.key, test.value)
+			if test.err {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			value, err := cfg.Get(test.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if value != test.value {
+				t.Errorf("expected %q, got %q", test.value, value)
+			}
+		})
+	}
+}
@@ -6,18 +6,31 @@ import (
 
 	"github.com/containers/podman/v5/pkg/machine/define"
 	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
-	"github.com/containers/storage/pkg/homedir"
 )
 
 const connectionsFile = "macadam-connections.json"
 
+// ConnectionsPath returns the path of the file storing the podman
+// connections of the macadam machines
+func ConnectionsPath() (string, error) {
+	configDir, err := GetConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, connectionsFile), nil
+}
+
 func SetupEnvironment(provider vmconfigs.VMProvider) error {
-	path, err := homedir.GetConfigHome()
+	// $MACADAM_HOME moves all the paths set below
+	if err := SetupHome(); err != nil {
+		return err
+	}
+
+	connsFile, err := ConnectionsPath()
 	if err != nil {
 		return err
 	}
 
-	connsFile := filepath.Join(path, "macadam", connectionsFile)
 	// set the path used for storing connection of macadam vms
 	err = os.Setenv("PODMAN_CONNECTIONS_CONF", connsFile)
 	if err != nil {
@@ -34,7 +47,7 @@ func SetupEnvironment(provider vmconfigs.VMProvider) error {
 
 	// set the directory to be used when calculating runtime path
 	// run -> <runHome>/macadam/<provider> (runHome changes based on the OS used e.g. runHome == /run)
-	err = os.Setenv("PODMAN_RUNTIME_DIR", filepath.Join("macadam", provider.VMType().String()))
+	err = os.Setenv("PODMAN_RUNTIME_DIR", runtimeDirSuffix(provider.VMType().String()))
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,117 @@
+package env
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+
+	"github.com/containers/storage/pkg/homedir"
+)
+
+// homeEnv is the environment variable overriding the root of all the macadam
+// state: its configuration, its connections and the files of its machines
+const homeEnv = "MACADAM_HOME"
+
+var (
+	homeOnce sync.Once
+	homeErr  error
+)
+
+// Home returns the absolute root of the macadam state set with
+// $MACADAM_HOME, or an empty string when the user directories are used
+func Home() string {
+	home := os.Getenv(homeEnv)
+	if home == "" {
+		return ""
+	}
+	if abs, err := filepath.Abs(home); err == nil {
+		return abs
+	}
+	return home
+}
+
+// homeConfigDir returns the directory replacing the user configuration
+// directory under home, e.g. ~/.config
+func homeConfigDir(home string) string {
+	if runtime.GOOS == "windows" {
+		// the config directory is %USERPROFILE%\.config
+		return filepath.Join(home, ".config")
+	}
+	return filepath.Join(home, "config")
+}
+
+// homeDataDir returns the directory replacing the user data directory under
+// home, e.g. ~/.local/share
+func homeDataDir(home string) string {
+	return filepath.Join(home, "data")
+}
+
+// SetupHome makes the podman machine code keep the state of the macadam
+// machines under $MACADAM_HOME when it is set, instead of the user
+// directories. macadam's own paths are computed from Home(), but podman only
+// computes its paths from the XDG variables, and from USERPROFILE on Windows
+// where the config directory ignores them, so these are set for the process.
+// It is called by GetConfigDir and SetupEnvironment, which come first in all
+// the code paths. Only the first call has an effect. An error is returned
+// when podman's config directory was already computed, as the
+// containers/storage homedir package caches it.
+//
+// The runtime directory is not moved, as it is /run for root on Linux, and
+// moving it under a temporary directory could exceed the length of a unix
+// socket path. Its name is made unique to $MACADAM_HOME instead, see
+// runtimeDirSuffix.
+func SetupHome() error {
+	homeOnce.Do(func() {
+		homeErr = setupHome()
+	})
+	return homeErr
+}
+
+func setupHome() error {
+	home := Home()
+	if home == "" {
+		return nil
+	}
+	if err := os.MkdirAll(home, 0700); err != nil {
+		return err
+	}
+
+	vars := map[string]string{
+		"XDG_DATA_HOME": homeDataDir(home),
+	}
+	if runtime.GOOS == "windows" {
+		vars["USERPROFILE"] = home
+	} else {
+		vars["XDG_CONFIG_HOME"] = homeConfigDir(home)
+	}
+	for name, value := range vars {
+		if err := os.Setenv(name, value); err != nil {
+			return err
+		}
+	}
+
+	configHome, err := homedir.GetConfigHome()
+	if err != nil {
+		return err
+	}
+	if configHome != homeConfigDir(home) {
+		return fmt.Errorf("%s is set after the podman directories were computed, they are in %s", homeEnv, configHome)
+	}
+	return nil
+}
+
+// runtimeDirSuffix returns the directory of the runtime files of the machines
+// of provider, relative to the runtime directory
+// e.g. macadam/qemu, or macadam-1a2b3c4d/qemu when $MACADAM_HOME is set
+func runtimeDirSuffix(provider string) string {
+	dir := "macadam"
+	if home := Home(); home != "" {
+		sum := sha256.Sum256([]byte(home))
+		dir += "-" + hex.EncodeToString(sum[:4])
+	}
+	return filepath.Join(dir, provider)
+}
@@ -0,0 +1,82 @@
+package env
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/pkg/machine/env"
+	"github.com/containers/storage/pkg/homedir"
+	"github.com/crc-org/macadam/pkg/machinedriver/provider/fake"
+)
+
+// TestSetupHome must be the only test computing the paths, as SetupHome and
+// the containers/storage homedir package only compute them once
+func TestSetupHome(t *testing.T) {
+	for _, name := range []string{"XDG_CONFIG_HOME", "XDG_DATA_HOME", "USERPROFILE", "PODMAN_CONNECTIONS_CONF", "PODMAN_DATA_DIR", "PODMAN_RUNTIME_DIR", "PODMAN_TOOL_PREFIX"} {
+		t.Setenv(name, os.Getenv(name))
+	}
+	home := t.TempDir()
+	t.Setenv(homeEnv, home)
+
+	if err := SetupEnvironment(fake.New(define.QemuVirt)); err != nil {
+		t.Fatal(err)
+	}
+
+	connections, err := ConnectionsPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirs, err := env.GetMachineDirs(define.QemuVirt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the runtime directory is not under MACADAM_HOME
+	t.Cleanup(func() { os.RemoveAll(filepath.Dir(dirs.RuntimeDir.GetPath())) })
+	for _, path := range []string{connections, dirs.ConfigDir.GetPath(), dirs.DataDir.GetPath()} {
+		if !strings.HasPrefix(path, home+string(filepath.Separator)) {
+			t.Errorf("%s is not under MACADAM_HOME", path)
+		}
+	}
+	if runtimeDir := os.Getenv("PODMAN_RUNTIME_DIR"); !strings.HasPrefix(runtimeDir, "macadam-") {
+		t.Errorf("the runtime directory %s is not specific to MACADAM_HOME", runtimeDir)
+	}
+}
+
+// lateHomeHelperEnv makes TestLateSetupHomeHelper run, in the process started
+// by TestLateSetupHome
+const lateHomeHelperEnv = "MACADAM_TEST_LATE_HOME_HELPER"
+
+// TestLateSetupHome checks that SetupHome fails when podman's config
+// directory was computed before, instead of leaving the machines in the user
+// directories. It runs in a separate process, as the paths are only computed
+// once.
+func TestLateSetupHome(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the config directory is not cached on Windows")
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestLateSetupHomeHelper$", "-test.v")
+	cmd.Env = append(os.Environ(), lateHomeHelperEnv+"=1")
+	output, err := cmd.CombinedOutput()
+	if err != nil || !strings.Contains(string(output), "--- PASS: TestLateSetupHomeHelper") {
+		t.Fatalf("the helper failed: %v\n%s", err, output)
+	}
+}
+
+func TestLateSetupHomeHelper(t *testing.T) {
+	if os.Getenv(lateHomeHelperEnv) == "" {
+		t.Skip("run by TestLateSetupHome")
+	}
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	if _, err := homedir.GetConfigHome(); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(homeEnv, t.TempDir())
+	if err := SetupHome(); err == nil {
+		t.Fatal("SetupHome succeeded after the config directory was computed")
+	}
+}
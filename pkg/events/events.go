@@ -0,0 +1,131 @@
+// Package events records the lifecycle events of macadam machines in a
+// per-user journal, so that frontends can react to changes made by other
+// macadam processes without polling the machine list.
+package events
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/containers/podman/v5/pkg/machine/define"
+)
+
+// Type is the type of an event
+type Type string
+
+const (
+	// Init is emitted when a machine is created
+	Init Type = "init"
+	// Start is emitted when a machine starts booting
+	Start Type = "start"
+	// Ready is emitted when a started machine is running and reachable
+	Ready Type = "ready"
+	// Stop is emitted when a machine is stopped
+	Stop Type = "stop"
+	// Remove is emitted when a machine is removed
+	Remove Type = "remove"
+	// Set is emitted when the settings of a machine are changed
+	Set Type = "set"
+	// Error is emitted when an operation on a machine fails
+	Error Type = "error"
+)
+
+// Event is a machine lifecycle event
+type Event struct {
+	Time     time.Time
+	Type     Type
+	Machine  string
+	Provider string
+	// Operation is the type of the operation which failed, for Error events
+	Operation Type `json:",omitempty"`
+	// Reason is the error message, for Error events
+	Reason string `json:",omitempty"`
+}
+
+// String returns a one-line description of the event, in the format used
+// by 'podman events'
+func (event *Event) String() string {
+	attributes := []string{"provider=" + event.Provider}
+	if event.Operation != "" {
+		attributes = append(attributes, "operation="+string(event.Operation))
+	}
+	if event.Reason != "" {
+		attributes = append(attributes, "reason="+event.Reason)
+	}
+	return fmt.Sprintf("%s machine %s %s (%s)", event.Time.Format(time.RFC3339Nano), event.Type, event.Machine, strings.Join(attributes, ", "))
+}
+
+// Emit appends an event to the journal. A journal which cannot be written
+// is only logged, it must not make the machine operation fail.
+func Emit(eventType Type, vmType define.VMType, machineName string) {
+	emit(&Event{
+		Time:     time.Now(),
+		Type:     eventType,
+		Machine:  machineName,
+		Provider: vmType.String(),
+	})
+}
+
+// EmitError appends an Error event for the failure of operation to the journal
+func EmitError(operation Type, vmType define.VMType, machineName string, err error) {
+	emit(&Event{
+		Time:      time.Now(),
+		Type:      Error,
+		Machine:   machineName,
+		Provider:  vmType.String(),
+		Operation: operation,
+		Reason:    err.Error(),
+	})
+}
+
+func emit(event *Event) {
+	if err := Write(event); err != nil {
+		slog.Warn("failed to write machine event", "machine", event.Machine, "event", event.Type, "error", err)
+	}
+}
+
+// filterKeys are the keys accepted by ParseFilter
+var filterKeys = []string{"event", "machine", "provider"}
+
+// Filter selects events by event type, machine name or provider. Values
+// of the same key match any of them, and all the keys must match.
+type Filter map[string][]string
+
+// ParseFilter parses filters in the key=value format, for example
+// "machine=myvm" or "event=start"
+func ParseFilter(filters []string) (Filter, error) {
+	filter := Filter{}
+	for _, f := range filters {
+		key, value, found := strings.Cut(f, "=")
+		if !found || value == "" {
+			return nil, fmt.Errorf("invalid filter %q, expected key=value", f)
+		}
+		if !slices.Contains(filterKeys, key) {
+			return nil, fmt.Errorf("invalid filter key %q, valid keys are %s", key, strings.Join(filterKeys, ", "))
+		}
+		filter[key] = append(filter[key], value)
+	}
+	return filter, nil
+}
+
+// Match returns true if event is selected by filter
+func (filter Filter) Match(event *Event) bool {
+	for key, values := range filter {
+		var field string
+		switch key {
+		case "event":
+			field = string(event.Type)
+		case "machine":
+			field = event.Machine
+		case "provider":
+			field = event.Provider
+		}
+		if !slices.Contains(values, field) {
+			return false
+		}
+	}
+	return true
+}
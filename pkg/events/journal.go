@@ -0,0 +1,218 @@
+package events
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containers/storage/pkg/lockfile"
+	"github.com/crc-org/macadam/pkg/env"
+)
+
+const (
+	journalFile = "events.log"
+	// the journal is rotated when it reaches maxJournalSize, the previous
+	// events are kept in a single backup file
+	maxJournalSize = 1024 * 1024
+	followInterval = 500 * time.Millisecond
+)
+
+// JournalPath returns the path of the file events are appended to, one
+// JSON object per line
+func JournalPath() (string, error) {
+	dir, err := env.GetConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, journalFile), nil
+}
+
+// RotatedJournalPath returns the path of the backup of the journal at path
+func RotatedJournalPath(path string) string {
+	return path + ".1"
+}
+
+// Write appends event to the journal
+func Write(event *Event) error {
+	path, err := JournalPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	lock, err := lockfile.GetLockFile(path + ".lock")
+	if err != nil {
+		return err
+	}
+	lock.Lock()
+	defer lock.Unlock()
+
+	if fileInfo, err := os.Stat(path); err == nil && fileInfo.Size() >= maxJournalSize {
+		// this fails on Windows while the journal is being followed, the
+		// journal is rotated by a later event in this case
+		if err := os.Rename(path, RotatedJournalPath(path)); err != nil {
+			slog.Debug("failed to rotate the events journal", "error", err)
+		}
+	}
+
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ReadOptions are the options of Read
+type ReadOptions struct {
+	// Follow makes Read wait for new events after reading the journal,
+	// until its context is done
+	Follow bool
+	// Filter selects the events passed to the handler, all the events
+	// are selected when it is empty
+	Filter Filter
+}
+
+// Read calls handler for the events of the journal, from the oldest one.
+// Reading stops at the first error returned by handler. When following the
+// journal, the context error is returned once ctx is done.
+func Read(ctx context.Context, opts ReadOptions, handler func(*Event) error) error {
+	path, err := JournalPath()
+	if err != nil {
+		return err
+	}
+
+	rotated, err := os.Open(RotatedJournalPath(path))
+	switch {
+	case err == nil:
+		err = newJournalReader(rotated).readEvents(opts.Filter, handler)
+		rotated.Close()
+		if err != nil {
+			return err
+		}
+	case !errors.Is(err, fs.ErrNotExist):
+		return err
+	}
+
+	return readJournal(ctx, path, opts, handler)
+}
+
+func readJournal(ctx context.Context, path string, opts ReadOptions, handler func(*Event) error) error {
+	var (
+		journal *os.File
+		reader  *journalReader
+	)
+	defer func() {
+		if journal != nil {
+			journal.Close()
+		}
+	}()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if journal == nil {
+			f, err := os.Open(path)
+			switch {
+			case err == nil:
+				journal = f
+				reader = newJournalReader(journal)
+			case !errors.Is(err, fs.ErrNotExist):
+				return err
+			}
+		}
+		if journal != nil {
+			if err := reader.readEvents(opts.Filter, handler); err != nil {
+				return err
+			}
+		}
+		if !opts.Follow {
+			return nil
+		}
+
+		if journal != nil && isRotated(journal, path) {
+			// events written before the rotation and after the last read
+			if err := reader.readEvents(opts.Filter, handler); err != nil {
+				return err
+			}
+			journal.Close()
+			journal = nil
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(followInterval):
+		}
+	}
+}
+
+// journalReader reads the events of a journal file which may be in the
+// process of being written
+type journalReader struct {
+	reader *bufio.Reader
+	// pending is the beginning of a partially written line
+	pending []byte
+}
+
+func newJournalReader(f *os.File) *journalReader {
+	return &journalReader{reader: bufio.NewReader(f)}
+}
+
+// readEvents passes the complete lines available in the journal to handler
+func (jr *journalReader) readEvents(filter Filter, handler func(*Event) error) error {
+	for {
+		line, err := jr.reader.ReadBytes('\n')
+		jr.pending = append(jr.pending, line...)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line, jr.pending = jr.pending, nil
+
+		event := &Event{}
+		if err := json.Unmarshal(line, event); err != nil {
+			slog.Debug("skipping invalid event", "line", string(line), "error", err)
+			continue
+		}
+		if !filter.Match(event) {
+			continue
+		}
+		if err := handler(event); err != nil {
+			return err
+		}
+	}
+}
+
+// isRotated returns true if path is no longer the file journal was opened from
+func isRotated(journal *os.File, path string) bool {
+	openedInfo, err := journal.Stat()
+	if err != nil {
+		return false
+	}
+	currentInfo, err := os.Stat(path)
+	if err != nil {
+		return errors.Is(err, fs.ErrNotExist)
+	}
+	return !os.SameFile(openedInfo, currentInfo)
+}
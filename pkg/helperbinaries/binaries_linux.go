@@ -0,0 +1,28 @@
+package helperbinaries
+
+import (
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/pkg/machine/qemu"
+)
+
+func init() {
+	binaries = append(binaries,
+		Binary{
+			Name: qemu.QemuCommand,
+			// the memory-backend machine property is used by podman
+			MinVersion: "5.0.0",
+			Providers:  []define.VMType{define.QemuVirt},
+			SearchPATH: true,
+		},
+		Binary{
+			Name:       "qemu-img",
+			Providers:  []define.VMType{define.QemuVirt},
+			SearchPATH: true,
+		},
+		Binary{
+			Name:       "virtiofsd",
+			Providers:  []define.VMType{define.QemuVirt},
+			SearchPATH: true,
+		},
+	)
+}
@@ -0,0 +1,110 @@
+package helperbinaries
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/containers/storage/pkg/homedir"
+	"github.com/containers/storage/pkg/ioutils"
+)
+
+const cacheFile = "helper-binaries.json"
+
+// cacheEntry is the version of a binary, it is valid as long as the binary
+// is not modified
+type cacheEntry struct {
+	ModTime time.Time
+	Size    int64
+	Version string
+}
+
+var (
+	cacheLock sync.Mutex
+	// cache is loaded from the cache file on first use, it is keyed by
+	// the path of the binaries
+	cache map[string]cacheEntry
+)
+
+func cachePath() (string, error) {
+	dir, err := homedir.GetCacheHome()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "macadam", cacheFile), nil
+}
+
+// cachedVersion returns the version of the binary at path, it is only
+// queried when the binary changed since the last time
+func cachedVersion(path string) (string, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+	if cache == nil {
+		cache = loadCache()
+	}
+	if entry, ok := cache[path]; ok && entry.ModTime.Equal(stat.ModTime()) && entry.Size == stat.Size() {
+		return entry.Version, nil
+	}
+
+	version, err := queryVersion(path)
+	if err != nil {
+		// failures are not cached, the binary may work next time
+		return "", err
+	}
+	cache[path] = cacheEntry{
+		ModTime: stat.ModTime(),
+		Size:    stat.Size(),
+		Version: version,
+	}
+	// the cache only avoids running the binaries, failing to write it is
+	// not an error
+	if err := writeCache(); err != nil {
+		slog.Debug("failed to write the helper binaries cache", "error", err)
+	}
+	return version, nil
+}
+
+func loadCache() map[string]cacheEntry {
+	entries := map[string]cacheEntry{}
+	path, err := cachePath()
+	if err != nil {
+		return entries
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			slog.Debug("failed to read the helper binaries cache", "error", err)
+		}
+		return entries
+	}
+	if err := json.Unmarshal(b, &entries); err != nil {
+		slog.Debug("ignoring invalid helper binaries cache", "path", path, "error", err)
+		return map[string]cacheEntry{}
+	}
+	return entries
+}
+
+func writeCache() error {
+	path, err := cachePath()
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutils.AtomicWriteFile(path, b, 0644)
+}
@@ -0,0 +1,195 @@
+// Package helperbinaries finds the helper binaries used by the providers,
+// such as gvproxy or vfkit, and their versions.
+package helperbinaries
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/blang/semver/v4"
+	"github.com/containers/common/pkg/config"
+	"github.com/containers/podman/v5/pkg/machine"
+	"github.com/containers/podman/v5/pkg/machine/define"
+)
+
+// versionTimeout is the time given to `<binary> --version` to print the
+// version
+const versionTimeout = 10 * time.Second
+
+// Binary is a helper binary used by some providers
+type Binary struct {
+	Name string
+	// MinVersion is the oldest supported version, any version is accepted
+	// when it is empty
+	MinVersion string
+	// Providers lists the providers using the binary
+	Providers []define.VMType
+	// SearchPATH is true when podman also looks for the binary in $PATH,
+	// and not only in the helper binaries directories
+	SearchPATH bool
+}
+
+var binaries = []Binary{
+	{
+		Name: machine.ForwarderBinaryName,
+		// the -services argument is needed
+		MinVersion: "0.8.3",
+		Providers:  []define.VMType{define.QemuVirt, define.AppleHvVirt, define.LibKrun},
+	},
+	{
+		Name: "vfkit",
+		// the --cloud-init argument is needed to inject ssh keys in RHEL
+		// cloud images
+		MinVersion: "0.6.1",
+		Providers:  []define.VMType{define.AppleHvVirt},
+		SearchPATH: true,
+	},
+	{
+		Name:       "krunkit",
+		Providers:  []define.VMType{define.LibKrun},
+		SearchPATH: true,
+	},
+}
+
+// Binaries returns the helper binaries used by vmType
+func Binaries(vmType define.VMType) []Binary {
+	used := []Binary{}
+	for _, binary := range binaries {
+		if slices.Contains(binary.Providers, vmType) {
+			used = append(used, binary)
+		}
+	}
+	return used
+}
+
+// Get returns the helper binary called name
+func Get(name string) (Binary, error) {
+	for _, binary := range binaries {
+		if binary.Name == name {
+			return binary, nil
+		}
+	}
+	return Binary{}, fmt.Errorf("unknown helper binary %q", name)
+}
+
+// Info describes an installed helper binary
+type Info struct {
+	Name string
+	// Path is empty when the binary is not installed
+	Path       string `json:",omitempty"`
+	Version    string `json:",omitempty"`
+	MinVersion string `json:",omitempty"`
+	// Error tells why the binary or its version could not be found
+	Error string `json:",omitempty"`
+}
+
+// Lookup finds the binary like podman does, and gets its version. An error
+// is only returned when the binary cannot be found, when its version is
+// unknown the reason is set in Info.Error.
+func (binary *Binary) Lookup() (*Info, error) {
+	info := &Info{
+		Name:       binary.Name,
+		MinVersion: binary.MinVersion,
+	}
+	cfg, err := config.Default()
+	if err != nil {
+		return nil, err
+	}
+	info.Path, err = cfg.FindHelperBinary(binary.Name, binary.SearchPATH)
+	if err != nil {
+		return nil, err
+	}
+	info.Version, err = cachedVersion(info.Path)
+	if err != nil {
+		info.Error = err.Error()
+	}
+	return info, nil
+}
+
+// ErrUnknownVersion is returned by CheckMinVersion when the version of the
+// binary is unknown, for example for distribution or development builds which
+// do not print a version. Such builds may be recent enough.
+var ErrUnknownVersion = errors.New("unknown version")
+
+// CheckMinVersion returns an error if the version of the binary is older
+// than its minimum version, or an error wrapping ErrUnknownVersion if it is
+// unknown while a minimum version is required
+func (info *Info) CheckMinVersion() error {
+	if info.MinVersion == "" {
+		return nil
+	}
+	if info.Version == "" {
+		return fmt.Errorf("%w: cannot check that %s is version %s or newer: %s", ErrUnknownVersion, info.Path, info.MinVersion, info.Error)
+	}
+	version, err := semver.ParseTolerant(info.Version)
+	if err != nil {
+		return fmt.Errorf("%w: cannot parse %q: %v", ErrUnknownVersion, info.Version, err)
+	}
+	// builds from git, such as 0.8.3-12-gabcdef, come after the release
+	// they are based on
+	version.Pre = nil
+	if version.LT(semver.MustParse(info.MinVersion)) {
+		return fmt.Errorf("%s version %s is too old", info.Path, info.Version)
+	}
+	return nil
+}
+
+// Lookup finds the helper binary called name, see Binary.Lookup
+func Lookup(name string) (*Info, error) {
+	binary, err := Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return binary.Lookup()
+}
+
+// Inventory returns the helper binaries used by vmType, the binaries which
+// cannot be found have an empty path and the reason in Info.Error
+func Inventory(vmType define.VMType) []Info {
+	infos := []Info{}
+	for _, binary := range Binaries(vmType) {
+		info, err := binary.Lookup()
+		if err != nil {
+			info = &Info{
+				Name:       binary.Name,
+				MinVersion: binary.MinVersion,
+				Error:      err.Error(),
+			}
+		}
+		infos = append(infos, *info)
+	}
+	return infos
+}
+
+// versionRegexp matches the version printed by the helper binaries, for
+// example "gvproxy version v0.8.3" or "QEMU emulator version 8.2.2"
+var versionRegexp = regexp.MustCompile(`\bv?(\d+\.\d+(?:\.\d+)?(?:-[0-9A-Za-z.-]+)?)`)
+
+// queryVersion runs `path --version` and returns the first version found in
+// its output
+func queryVersion(path string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), versionTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, path, "--version").CombinedOutput()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return "", fmt.Errorf("%s --version did not exit after %s", path, versionTimeout)
+	}
+	match := versionRegexp.FindSubmatch(out)
+	if match == nil {
+		if err != nil {
+			return "", fmt.Errorf("failed to run %s --version: %w", path, err)
+		}
+		return "", fmt.Errorf("cannot find the version in the output of %s --version: %q", path, strings.TrimSpace(string(out)))
+	}
+	version := string(match[1])
+	if _, err := semver.ParseTolerant(version); err != nil {
+		return "", fmt.Errorf("cannot parse the version of %s: %w", path, err)
+	}
+	return version, nil
+}
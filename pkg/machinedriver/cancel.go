@@ -0,0 +1,176 @@
+package macadam
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strconv"
+	"time"
+
+	gvproxy "github.com/containers/gvisor-tap-vsock/pkg/types"
+
+	"github.com/containers/podman/v5/pkg/machine"
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	"github.com/crc-org/macadam/pkg/signals"
+	"github.com/hashicorp/go-multierror"
+	"github.com/shirou/gopsutil/v4/process"
+)
+
+// signalInterceptInterval is the period at which the signal handlers
+// registered by shim.Start are replaced while a machine starts
+const signalInterceptInterval = 100 * time.Millisecond
+
+// runWithContext runs fn in a goroutine and waits for it to return, or for
+// ctx to be done. When ctx is done first, the helper processes of the
+// machine are forcefully stopped, and the context error is returned.
+//
+// The podman functions called by fn do not accept a context, so fn is given
+// a provider which refuses to start the machine or to report its state once
+// ctx is done, and which makes fn fail quickly. The VM or a helper process
+// may still be started by fn while the first cleanup runs, so runWithContext
+// waits for fn to return, and runs the cleanup a second time, which resets
+// the Starting flag of the machine under the machine lock.
+func runWithContext(ctx context.Context, machineName string, vmProvider vmconfigs.VMProvider, dirs *define.MachineDirs, fn func(vmconfigs.VMProvider) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- fn(&cancellableProvider{VMProvider: vmProvider, ctx: ctx})
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	var result *multierror.Error
+	if err := forceStop(machineName, vmProvider, dirs, false); err != nil {
+		result = multierror.Append(result, err)
+	}
+	<-errCh
+	if err := forceStop(machineName, vmProvider, dirs, true); err != nil {
+		result = multierror.Append(result, err)
+	}
+	if err := result.ErrorOrNil(); err != nil {
+		return fmt.Errorf("%w (cleanup failed: %v)", ctx.Err(), err)
+	}
+	return ctx.Err()
+}
+
+// cancellableProvider fails the calls which start the machine or wait for
+// it once ctx is done. These calls are also the points where the signal
+// handlers registered by shim.Start, which exit the process, are replaced,
+// see signals.Intercept. shim.Start registers a second handler from a
+// goroutine, which is replaced by Start with signals.InterceptEvery.
+type cancellableProvider struct {
+	vmconfigs.VMProvider
+	ctx context.Context
+}
+
+func (p *cancellableProvider) StartNetworking(mc *vmconfigs.MachineConfig, cmd *gvproxy.GvproxyCommand) error {
+	signals.Intercept()
+	if err := p.ctx.Err(); err != nil {
+		return err
+	}
+	return p.VMProvider.StartNetworking(mc, cmd)
+}
+
+func (p *cancellableProvider) StartVM(mc *vmconfigs.MachineConfig) (func() error, func() error, error) {
+	signals.Intercept()
+	if err := p.ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	return p.VMProvider.StartVM(mc)
+}
+
+func (p *cancellableProvider) State(mc *vmconfigs.MachineConfig, bypass bool) (define.Status, error) {
+	signals.Intercept()
+	if err := p.ctx.Err(); err != nil {
+		return "", err
+	}
+	return p.VMProvider.State(mc, bypass)
+}
+
+// forceStop kills the VM and its helper processes (gvproxy, virtiofsd). A
+// fresh copy of the machine configuration is used, as the interrupted
+// operation may still hold the machine lock and write its configuration.
+// When resetStarting is true, the operation must have returned, and the
+// Starting flag of the machine is reset under the machine lock.
+func forceStop(machineName string, vmProvider vmconfigs.VMProvider, dirs *define.MachineDirs, resetStarting bool) error {
+	mc, err := vmconfigs.LoadMachineByName(machineName, dirs)
+	if err != nil {
+		return err
+	}
+
+	var result *multierror.Error
+	if err := vmProvider.StopVM(mc, true); err != nil {
+		result = multierror.Append(result, fmt.Errorf("stop VM: %w", err))
+	}
+
+	// the pid file does not exist when gvproxy was not started, or when
+	// the provider does its own network setup
+	gvproxyPidFile, err := machine.GetGVProxyPIDFile(mc, dirs)
+	if err != nil {
+		result = multierror.Append(result, err)
+	} else if err := stopGVProxy(*gvproxyPidFile); err != nil {
+		result = multierror.Append(result, fmt.Errorf("stop gvproxy: %w", err))
+	}
+
+	runtimeDir, err := mc.RuntimeDir()
+	if err != nil {
+		result = multierror.Append(result, err)
+	} else if err := stopVirtiofsd(runtimeDir.GetPath()); err != nil {
+		result = multierror.Append(result, fmt.Errorf("stop virtiofsd: %w", err))
+	}
+
+	if resetStarting {
+		if err := resetStartingFlag(mc); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+
+	return result.ErrorOrNil()
+}
+
+func resetStartingFlag(mc *vmconfigs.MachineConfig) error {
+	mc.Lock()
+	defer mc.Unlock()
+	if err := mc.Refresh(); err != nil {
+		return err
+	}
+	if !mc.Starting {
+		return nil
+	}
+	mc.Starting = false
+	return mc.Write()
+}
+
+// stopGVProxy stops gvproxy with machine.CleanupGVProxy, which fails when
+// gvproxy exits between the signal and the check of its state. The pid
+// file is removed in this case.
+func stopGVProxy(pidFile define.VMFile) error {
+	err := machine.CleanupGVProxy(pidFile)
+	if err == nil {
+		return nil
+	}
+	content, readErr := pidFile.Read()
+	if errors.Is(readErr, fs.ErrNotExist) {
+		return nil
+	}
+	if readErr != nil {
+		return err
+	}
+	pid, convErr := strconv.ParseInt(string(content), 10, 32)
+	if convErr != nil {
+		return err
+	}
+	if exists, existsErr := process.PidExists(int32(pid)); existsErr != nil || exists {
+		return err
+	}
+	return pidFile.Delete()
+}
@@ -0,0 +1,522 @@
+//go:build linux
+
+package macadam
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gvproxy "github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/containers/podman/v5/pkg/machine"
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/pkg/machine/env"
+	"github.com/containers/podman/v5/pkg/machine/ignition"
+	"github.com/containers/podman/v5/pkg/machine/lock"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	macadamenv "github.com/crc-org/macadam/pkg/env"
+	"github.com/crc-org/macadam/pkg/signals"
+)
+
+// helperProcess is a child process standing for the VM or one of its helpers
+type helperProcess struct {
+	cmd    *exec.Cmd
+	exited chan struct{}
+}
+
+// startHelperProcess can be called from the goroutines of the code under
+// test, so it returns errors instead of failing t
+func startHelperProcess(t *testing.T, name string, args ...string) (*helperProcess, error) {
+	cmd := exec.Command(name, args...)
+	// keeps 'sh -c read' blocked until the process is killed
+	if _, err := cmd.StdinPipe(); err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	p := &helperProcess{cmd: cmd, exited: make(chan struct{})}
+	go func() {
+		// reap the process so that it does not linger as a zombie
+		_ = cmd.Wait()
+		close(p.exited)
+	}()
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		<-p.exited
+	})
+	return p, nil
+}
+
+func (p *helperProcess) running() bool {
+	select {
+	case <-p.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+func (p *helperProcess) waitExit(timeout time.Duration) bool {
+	select {
+	case <-p.exited:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// hangingProvider is a VMProvider whose machines never become ready, so
+// that shim.Start blocks in its readiness check until it is cancelled
+type hangingProvider struct {
+	t    *testing.T
+	dirs *define.MachineDirs
+
+	mu        sync.Mutex
+	vm        *helperProcess
+	gvproxy   *helperProcess
+	virtiofsd *helperProcess
+	vmStarted chan struct{}
+	// polled is closed when the state of the started VM is checked for
+	// the second time, once shim.Start registered all its signal handlers
+	polled chan struct{}
+	polls  int
+}
+
+func newHangingProvider(t *testing.T) *hangingProvider {
+	return &hangingProvider{t: t, vmStarted: make(chan struct{}), polled: make(chan struct{})}
+}
+
+func (p *hangingProvider) CreateVM(_ define.CreateVMOpts, _ *vmconfigs.MachineConfig, _ *ignition.IgnitionBuilder) error {
+	return nil
+}
+
+func (p *hangingProvider) PrepareIgnition(_ *vmconfigs.MachineConfig, _ *ignition.IgnitionBuilder) (*ignition.ReadyUnitOpts, error) {
+	return nil, nil
+}
+
+func (p *hangingProvider) Exists(_ string) (bool, error) {
+	return false, nil
+}
+
+func (p *hangingProvider) MountType() vmconfigs.VolumeMountType {
+	return vmconfigs.VirtIOFS
+}
+
+func (p *hangingProvider) MountVolumesToVM(_ *vmconfigs.MachineConfig, _ bool) error {
+	return nil
+}
+
+func (p *hangingProvider) Remove(_ *vmconfigs.MachineConfig) ([]string, func() error, error) {
+	return nil, func() error { return nil }, nil
+}
+
+func (p *hangingProvider) RemoveAndCleanMachines(_ *define.MachineDirs) error {
+	return nil
+}
+
+func (p *hangingProvider) SetProviderAttrs(_ *vmconfigs.MachineConfig, _ define.SetOptions) error {
+	return nil
+}
+
+// StartNetworking starts a fake gvproxy and writes its pid file like
+// the gvproxy started by podman
+func (p *hangingProvider) StartNetworking(mc *vmconfigs.MachineConfig, _ *gvproxy.GvproxyCommand) error {
+	pidFile, err := machine.GetGVProxyPIDFile(mc, p.dirs)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(pidFile.GetPath()), 0o755); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.gvproxy, err = startHelperProcess(p.t, "sleep", "60")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(pidFile.GetPath(), []byte(strconv.Itoa(p.gvproxy.cmd.Process.Pid)), 0o644)
+}
+
+func (p *hangingProvider) PostStartNetworking(_ *vmconfigs.MachineConfig, _ bool) error {
+	return nil
+}
+
+// StartVM starts a fake VM, and a fake virtiofsd with the command line
+// used by the QEMU provider
+func (p *hangingProvider) StartVM(mc *vmconfigs.MachineConfig) (func() error, func() error, error) {
+	runtimeDir, err := mc.RuntimeDir()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.vm, err = startHelperProcess(p.t, "sleep", "60")
+	if err != nil {
+		return nil, nil, err
+	}
+	socketPath := filepath.Join(runtimeDir.GetPath(), "virtiofschar0")
+	p.virtiofsd, err = startHelperProcess(p.t, "sh", "-c", "read x", "virtiofsd", "--sandbox", "none", "--socket-path", socketPath, "--shared-dir", ".")
+	if err != nil {
+		return nil, nil, err
+	}
+	close(p.vmStarted)
+	return nil, nil, nil
+}
+
+func (p *hangingProvider) State(_ *vmconfigs.MachineConfig, _ bool) (define.Status, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.vm != nil && p.vm.running() {
+		p.polls++
+		if p.polls == 2 {
+			close(p.polled)
+		}
+		return define.Starting, nil
+	}
+	return define.Stopped, nil
+}
+
+func (p *hangingProvider) StopVM(_ *vmconfigs.MachineConfig, _ bool) error {
+	p.mu.Lock()
+	vm := p.vm
+	p.mu.Unlock()
+	if vm == nil {
+		return nil
+	}
+	_ = vm.cmd.Process.Kill()
+	vm.waitExit(5 * time.Second)
+	return nil
+}
+
+func (p *hangingProvider) StopHostNetworking(_ *vmconfigs.MachineConfig, _ define.VMType) error {
+	return nil
+}
+
+func (p *hangingProvider) VMType() define.VMType {
+	return define.QemuVirt
+}
+
+func (p *hangingProvider) UserModeNetworkEnabled(_ *vmconfigs.MachineConfig) bool {
+	return false
+}
+
+func (p *hangingProvider) UseProviderNetworkSetup(_ *vmconfigs.MachineConfig) bool {
+	return true
+}
+
+func (p *hangingProvider) SetExclusiveActive(_ bool) {}
+
+func (p *hangingProvider) RequireExclusiveActive() bool {
+	return false
+}
+
+func (p *hangingProvider) UpdateSSHPort(_ *vmconfigs.MachineConfig, _ int) error {
+	return nil
+}
+
+func (p *hangingProvider) GetRosetta(_ *vmconfigs.MachineConfig) (bool, error) {
+	return false, nil
+}
+
+func createTestMachine(t *testing.T, provider *hangingProvider) *vmconfigs.MachineConfig {
+	t.Helper()
+	if err := macadamenv.SetupEnvironment(provider); err != nil {
+		t.Fatal(err)
+	}
+	dirs, err := env.GetMachineDirs(provider.VMType())
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider.dirs = dirs
+
+	name := fmt.Sprintf("test-%d", time.Now().UnixNano())
+	machineLock, err := lock.GetMachineLock(name, dirs.ConfigDir.GetPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc, err := vmconfigs.NewMachineConfig(*DefaultInitOpts(name), dirs, "", provider.VMType(), machineLock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc.Version = vmconfigs.MachineConfigVersion
+	mc.Capabilities = &define.MachineCapabilities{
+		HasReadyUnit:   false,
+		ForwardSockets: false,
+	}
+	if err := mc.Write(); err != nil {
+		t.Fatal(err)
+	}
+	return mc
+}
+
+func TestStartCancelStopsHelperProcesses(t *testing.T) {
+	provider := newHangingProvider(t)
+	mc := createTestMachine(t, provider)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-provider.vmStarted:
+			cancel()
+		case <-time.After(10 * time.Second):
+		}
+	}()
+
+	startTime := time.Now()
+	startErr := Start(ctx, mc, provider, machine.StartOptions{NoInfo: true, Quiet: true}, func(_, _ string) {})
+	if !errors.Is(startErr, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", startErr)
+	}
+	if elapsed := time.Since(startTime); elapsed > 5*time.Second {
+		t.Errorf("Start returned %s after cancellation", elapsed)
+	}
+
+	provider.mu.Lock()
+	helpers := map[string]*helperProcess{"VM": provider.vm, "gvproxy": provider.gvproxy, "virtiofsd": provider.virtiofsd}
+	provider.mu.Unlock()
+	for name, p := range helpers {
+		if p == nil {
+			t.Errorf("%s was not started", name)
+			continue
+		}
+		if !p.waitExit(5 * time.Second) {
+			t.Errorf("%s is still running", name)
+		}
+	}
+
+	pidFile, err := machine.GetGVProxyPIDFile(mc, provider.dirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(pidFile.GetPath()); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("gvproxy pid file was not removed: %v (start error: %v)", err, startErr)
+	}
+
+	reloaded, err := vmconfigs.LoadMachineByName(mc.Name, provider.dirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.Starting {
+		t.Error("machine is still marked as starting")
+	}
+}
+
+// slowStartProvider is a hangingProvider whose StartVM only starts the VM
+// when release is closed
+type slowStartProvider struct {
+	*hangingProvider
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (p *slowStartProvider) StartVM(mc *vmconfigs.MachineConfig) (func() error, func() error, error) {
+	close(p.entered)
+	<-p.release
+	return p.hangingProvider.StartVM(mc)
+}
+
+func TestStartCancelStopsLateHelperProcesses(t *testing.T) {
+	provider := &slowStartProvider{
+		hangingProvider: newHangingProvider(t),
+		entered:         make(chan struct{}),
+		release:         make(chan struct{}),
+	}
+	mc := createTestMachine(t, provider.hangingProvider)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-provider.entered:
+		case <-time.After(10 * time.Second):
+			return
+		}
+		cancel()
+		// start the VM once the first cleanup stopped gvproxy
+		provider.mu.Lock()
+		gvproxy := provider.gvproxy
+		provider.mu.Unlock()
+		gvproxy.waitExit(5 * time.Second)
+		close(provider.release)
+	}()
+
+	startErr := Start(ctx, mc, provider, machine.StartOptions{NoInfo: true, Quiet: true}, func(_, _ string) {})
+	if !errors.Is(startErr, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", startErr)
+	}
+
+	provider.mu.Lock()
+	helpers := map[string]*helperProcess{"VM": provider.vm, "gvproxy": provider.gvproxy, "virtiofsd": provider.virtiofsd}
+	provider.mu.Unlock()
+	for name, p := range helpers {
+		if p == nil {
+			t.Errorf("%s was not started", name)
+			continue
+		}
+		if !p.waitExit(5 * time.Second) {
+			t.Errorf("%s is still running", name)
+		}
+	}
+
+	reloaded, err := vmconfigs.LoadMachineByName(mc.Name, provider.dirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.Starting {
+		t.Error("machine is still marked as starting")
+	}
+}
+
+// interruptHelperEnv makes TestInterruptedStartHelper run, in the process
+// started by TestStartInterrupt
+const interruptHelperEnv = "MACADAM_TEST_INTERRUPT_HELPER"
+
+// TestStartInterrupt sends SIGINT to a process starting a machine, to check
+// that the start is cancelled instead of exiting the process from the
+// signal handlers of shim.Start
+func TestStartInterrupt(t *testing.T) {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestInterruptedStartHelper$", "-test.v")
+	cmd.Env = append(os.Environ(), interruptHelperEnv+"=1")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	output := make(chan string)
+	polling := make(chan struct{})
+	go func() {
+		var lines []string
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+			if scanner.Text() == "polling" {
+				close(polling)
+			}
+		}
+		output <- strings.Join(lines, "\n")
+		exited <- cmd.Wait()
+	}()
+
+	select {
+	case <-polling:
+	case <-time.After(20 * time.Second):
+		_ = cmd.Process.Kill()
+		t.Fatalf("the machine did not start\n%s\n%s", <-output, stderr.String())
+	}
+	if err := cmd.Process.Signal(os.Interrupt); err != nil {
+		t.Fatal(err)
+	}
+
+	var out string
+	select {
+	case out = <-output:
+	case <-time.After(20 * time.Second):
+		_ = cmd.Process.Kill()
+		t.Fatalf("the start was not interrupted\n%s", stderr.String())
+	}
+	if err := <-exited; err != nil {
+		t.Fatalf("the interrupted process failed: %v\n%s\n%s", err, out, stderr.String())
+	}
+	if !strings.Contains(out, "interrupted") {
+		t.Errorf("the start was not cancelled\n%s\n%s", out, stderr.String())
+	}
+}
+
+// TestInterruptedStartHelper starts a machine which never becomes ready,
+// until SIGINT is sent by TestStartInterrupt
+func TestInterruptedStartHelper(t *testing.T) {
+	if os.Getenv(interruptHelperEnv) == "" {
+		t.Skip("run by TestStartInterrupt")
+	}
+	provider := newHangingProvider(t)
+	mc := createTestMachine(t, provider)
+
+	// like the commands of macadam
+	ctx, stop := signals.NotifyContext(context.Background())
+	defer stop()
+	go func() {
+		<-provider.polled
+		fmt.Println("polling")
+	}()
+
+	startErr := Start(ctx, mc, provider, machine.StartOptions{NoInfo: true, Quiet: true}, func(_, _ string) {})
+	if !errors.Is(startErr, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", startErr)
+	}
+
+	provider.mu.Lock()
+	helpers := map[string]*helperProcess{"VM": provider.vm, "gvproxy": provider.gvproxy, "virtiofsd": provider.virtiofsd}
+	provider.mu.Unlock()
+	for name, p := range helpers {
+		if !p.waitExit(5 * time.Second) {
+			t.Errorf("%s is still running", name)
+		}
+	}
+	reloaded, err := vmconfigs.LoadMachineByName(mc.Name, provider.dirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.Starting {
+		t.Error("machine is still marked as starting")
+	}
+	fmt.Println("interrupted")
+}
+
+func TestStartCancelledContext(t *testing.T) {
+	provider := newHangingProvider(t)
+	mc := createTestMachine(t, provider)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := Start(ctx, mc, provider, machine.StartOptions{NoInfo: true, Quiet: true}, func(_, _ string) {})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	select {
+	case <-provider.vmStarted:
+		t.Error("the VM was started with a cancelled context")
+	default:
+	}
+}
+
+func TestStopVirtiofsdIgnoresOtherRuntimeDirs(t *testing.T) {
+	runtimeDir := t.TempDir()
+	other, err := startHelperProcess(t, "sh", "-c", "read x", "virtiofsd", "--socket-path", filepath.Join(t.TempDir(), "virtiofschar0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	own, err := startHelperProcess(t, "sh", "-c", "read x", "virtiofsd", "--socket-path", filepath.Join(runtimeDir, "virtiofschar0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := stopVirtiofsd(runtimeDir); err != nil {
+		t.Fatal(err)
+	}
+	if !own.waitExit(5 * time.Second) {
+		t.Error("virtiofsd using the runtime directory is still running")
+	}
+	if !other.running() {
+		t.Error("virtiofsd using another runtime directory was stopped")
+	}
+}
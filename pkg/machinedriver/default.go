@@ -0,0 +1,49 @@
+package macadam
+
+import (
+	"github.com/containers/podman/v5/pkg/machine/env"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	"github.com/crc-org/macadam/pkg/metadata"
+)
+
+// DefaultMachineName returns the name of the machine to use when none is
+// specified. This is the machine set with SetDefaultMachine if it still
+// exists, or the only existing machine, or fallback otherwise.
+func DefaultMachineName(provider vmconfigs.VMProvider, fallback string) (string, error) {
+	dirs, err := env.GetMachineDirs(provider.VMType())
+	if err != nil {
+		return "", err
+	}
+	mcs, err := vmconfigs.LoadMachinesInDir(dirs)
+	if err != nil {
+		return "", err
+	}
+
+	name, err := metadata.GetDefaultMachine(provider.VMType())
+	if err != nil {
+		return "", err
+	}
+	if _, exists := mcs[name]; exists {
+		return name, nil
+	}
+
+	if len(mcs) == 1 {
+		for name := range mcs {
+			return name, nil
+		}
+	}
+
+	return fallback, nil
+}
+
+// SetDefaultMachine makes machineName the machine used when none is specified
+func SetDefaultMachine(provider vmconfigs.VMProvider, machineName string) error {
+	dirs, err := env.GetMachineDirs(provider.VMType())
+	if err != nil {
+		return err
+	}
+	if _, err := vmconfigs.LoadMachineByName(machineName, dirs); err != nil {
+		return err
+	}
+	return metadata.SetDefaultMachine(provider.VMType(), machineName)
+}
@@ -17,6 +17,7 @@ limitations under the License.
 package macadam
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -29,6 +30,11 @@ import (
 	"github.com/containers/podman/v5/pkg/machine/env"
 	"github.com/containers/podman/v5/pkg/machine/shim"
 	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	macadamenv "github.com/crc-org/macadam/pkg/env"
+	"github.com/crc-org/macadam/pkg/events"
+	"github.com/crc-org/macadam/pkg/metadata"
+	"github.com/crc-org/macadam/pkg/signals"
+	"github.com/crc-org/macadam/pkg/sshkeys"
 	"github.com/crc-org/machine/libmachine/drivers"
 	"github.com/crc-org/machine/libmachine/state"
 )
@@ -36,10 +42,6 @@ import (
 const (
 	DriverName    = "macadam"
 	DriverVersion = "0.0.1"
-
-	DefaultMemory  = 8192
-	DefaultCPUs    = 4
-	DefaultSSHUser = "core"
 )
 
 const (
@@ -58,6 +60,22 @@ type Driver struct {
 
 	vmConfig   *vmconfigs.MachineConfig
 	vmProvider vmconfigs.VMProvider
+	progress   ProgressFunc
+	defaults   macadamenv.MachineDefaults
+}
+
+// ProgressFunc receives the progress messages of long running operations
+// on the machine called machineName
+type ProgressFunc func(machineName, message string)
+
+// Report sends a progress message to progress, or logs it when progress is nil
+func (progress ProgressFunc) Report(machineName, format string, args ...any) {
+	message := fmt.Sprintf(format, args...)
+	if progress == nil {
+		slog.Info(message, "machine", machineName)
+		return
+	}
+	progress(machineName, message)
 }
 
 // this func should return the driver by using the provider and machineName
@@ -77,8 +95,8 @@ func GetDriverByProviderAndMachineName(provider vmconfigs.VMProvider, machineNam
 			BaseDriver: &drivers.BaseDriver{
 				MachineName: machineName,
 			},
-			CPU:    DefaultCPUs,
-			Memory: DefaultMemory,
+			CPU:    macadamenv.DefaultCPUs,
+			Memory: macadamenv.DefaultMemory,
 		},
 		// needed when loading a VM which was created before
 		// DaemonVsockPort was introduced
@@ -89,6 +107,19 @@ func GetDriverByProviderAndMachineName(provider vmconfigs.VMProvider, machineNam
 	}, nil
 }
 
+// SetMachineDefaults sets the values used by Create for the resources which
+// are not set in the driver, usually from env.Config.MachineDefaults. When
+// unset, the built-in defaults of the env package are used.
+func (d *Driver) SetMachineDefaults(defaults macadamenv.MachineDefaults) {
+	d.defaults = defaults
+}
+
+// SetProgressFunc sets the function receiving the progress messages of the
+// driver operations. When unset, these messages are logged with slog.
+func (d *Driver) SetProgressFunc(progress ProgressFunc) {
+	d.progress = progress
+}
+
 // DriverName returns the name of the driver
 func (d *Driver) DriverName() string {
 	return DriverName
@@ -120,14 +151,20 @@ func (d *Driver) getDiskPath() string {
 	return d.ResolveStorePath(fmt.Sprintf("%s.img", d.MachineName))
 }
 
+// DefaultInitOpts returns the options to create a machine with the built-in
+// defaults of the env package
 func DefaultInitOpts(machineName string) *define.InitOptions {
+	return defaultInitOpts(machineName, macadamenv.BuiltinMachineDefaults())
+}
+
+func defaultInitOpts(machineName string, defaults macadamenv.MachineDefaults) *define.InitOptions {
 	initOpts := define.InitOptions{}
 	// defaults from cmd/podman/machine/init.go
 	initOpts.Name = machineName
 
-	initOpts.CPUS = uint64(DefaultCPUs)
-	//initOpts.DiskSize = uint64(???)
-	initOpts.Memory = uint64(DefaultMemory)
+	initOpts.CPUS = defaults.CPUs
+	initOpts.DiskSize = defaults.DiskSize
+	initOpts.Memory = defaults.Memory
 	initOpts.TimeZone = ""
 	initOpts.ReExec = false
 	/*
@@ -135,7 +172,7 @@ func DefaultInitOpts(machineName string) *define.InitOptions {
 		initOpts.Image = defaultConfig.Machine.Image
 		initOpts.Volumes = defaultConfig.Machine.Volumes.Get()
 	*/
-	initOpts.Username = DefaultSSHUser
+	initOpts.Username = defaults.Username
 	//initOpts.SSHIdentityPath = d.VMDriver.SSHConfig.IdentityPath
 	/* if d.VMDriver.SSHConfig.RemoteUsername != "" {
 		initOpts.Username = d.VMDriver.SSHConfig.RemoteUsername
@@ -152,11 +189,23 @@ func DefaultInitOpts(machineName string) *define.InitOptions {
 	return &initOpts
 }
 
+// initOpts returns the options to create the machine of the driver, the
+// resources which are not set in the driver come from its machine defaults
 func (d *Driver) initOpts() *define.InitOptions {
-	initOpts := DefaultInitOpts(d.MachineName)
-	initOpts.CPUS = uint64(d.CPU)
-	initOpts.DiskSize = uint64(strongunits.ToGiB(strongunits.B(d.DiskCapacity)))
-	initOpts.Memory = uint64(d.Memory)
+	defaults := d.defaults
+	if defaults == (macadamenv.MachineDefaults{}) {
+		defaults = macadamenv.BuiltinMachineDefaults()
+	}
+	initOpts := defaultInitOpts(d.MachineName, defaults)
+	if d.CPU != 0 {
+		initOpts.CPUS = uint64(d.CPU)
+	}
+	if d.DiskCapacity != 0 {
+		initOpts.DiskSize = uint64(strongunits.ToGiB(strongunits.B(d.DiskCapacity)))
+	}
+	if d.Memory != 0 {
+		initOpts.Memory = uint64(d.Memory)
+	}
 	initOpts.Image = d.getDiskPath()
 
 	return initOpts
@@ -227,15 +276,31 @@ func (d *Driver) Create() error {
 	// 	return err
 	// }
 
+	// same preparation as client.Init
+	cleanupIdentity, err := PrepareIdentity(initOpts, d.vmProvider.VMType())
+	if err != nil {
+		return err
+	}
+	cleanupHostKey, err := PrepareHostKey(initOpts, d.vmProvider.VMType())
+	if err != nil {
+		cleanupIdentity()
+		return err
+	}
 	err = shim.Init(*initOpts, d.vmProvider)
 	if err != nil {
+		cleanupHostKey()
+		cleanupIdentity()
+		events.EmitError(events.Init, d.vmProvider.VMType(), initOpts.Name, err)
 		return err
 	}
 
-	/*
-		newMachineEvent(events.Init, events.Event{Name: initOpts.Name})
-	*/
-	fmt.Println("Machine init complete")
+	events.Emit(events.Init, d.vmProvider.VMType(), initOpts.Name)
+	d.progress.Report(d.MachineName, "Machine init complete")
+
+	// the resources which were not set come from the defaults
+	d.CPU = uint(initOpts.CPUS)
+	d.Memory = uint(initOpts.Memory)
+	d.DiskCapacity = uint64(strongunits.GiB(initOpts.DiskSize).ToBytes())
 
 	// most likely not needed as libmachine must already be doing this check somehow
 	vmConfig, _, err = shim.VMExists(initOpts.Name, []vmconfigs.VMProvider{d.vmProvider})
@@ -247,7 +312,14 @@ func (d *Driver) Create() error {
 	return nil
 }
 
-func Start(vmConfig *vmconfigs.MachineConfig, vmProvider vmconfigs.VMProvider) error {
+// Start starts the machine described by vmConfig. When ctx is cancelled
+// before the machine is running, the VM and its helper processes are
+// forcefully stopped. SIGINT and SIGTERM cancel the start in the same way,
+// instead of exiting the process as podman does, see the signals package.
+func Start(ctx context.Context, vmConfig *vmconfigs.MachineConfig, vmProvider vmconfigs.VMProvider, opts machine.StartOptions, progress ProgressFunc) error {
+	ctx, stop := signals.NotifyContext(ctx)
+	defer stop()
+
 	machineName := vmConfig.Name
 	dirs, err := env.GetMachineDirs(vmProvider.VMType())
 	if err != nil {
@@ -260,21 +332,35 @@ func Start(vmConfig *vmconfigs.MachineConfig, vmProvider vmconfigs.VMProvider) e
 		}
 	*/
 
-	fmt.Printf("Starting machine %q\n", machineName)
+	progress.Report(machineName, "Starting machine %q", machineName)
 
 	startOpts := machine.StartOptions{
 		// The ForwardSockets capabilities roughly indicates if we have a podman machine or a generic VM.
 		// For generic VMs, we don’t want to print these `info` messages as they are podman-centric.
-		NoInfo: !vmConfig.Capabilities.GetForwardSockets(),
-		Quiet:  false,
+		NoInfo: opts.NoInfo || !vmConfig.Capabilities.GetForwardSockets(),
+		Quiet:  opts.Quiet,
 	}
 	slog.Debug("SSH config", "port", vmConfig.SSH.Port, "username", vmConfig.SSH.RemoteUsername, "identity-path", vmConfig.SSH.IdentityPath)
 
-	if err := shim.Start(vmConfig, vmProvider, dirs, startOpts); err != nil {
+	events.Emit(events.Start, vmProvider.VMType(), machineName)
+	stopIntercepting := signals.InterceptEvery(signalInterceptInterval)
+	err = runWithContext(ctx, machineName, vmProvider, dirs, func(vmProvider vmconfigs.VMProvider) error {
+		return shim.Start(vmConfig, vmProvider, dirs, startOpts)
+	})
+	stopIntercepting()
+	if err != nil {
+		if ctx.Err() != nil {
+			err = fmt.Errorf("failed to start machine %q: %w", machineName, err)
+		}
+		events.EmitError(events.Start, vmProvider.VMType(), machineName, err)
 		return err
 	}
-	fmt.Printf("Machine %q started successfully\n", machineName)
-	//newMachineEvent(events.Start, events.Event{Name: vmName})
+	if err := verifyHostKey(ctx, vmConfig, dirs); err != nil {
+		events.EmitError(events.Start, vmProvider.VMType(), machineName, err)
+		return err
+	}
+	events.Emit(events.Ready, vmProvider.VMType(), machineName)
+	progress.Report(machineName, "Machine %q started successfully", machineName)
 	return nil
 	/*
 		if err := d.recoverFromUncleanShutdown(); err != nil {
@@ -413,7 +499,13 @@ func Start(vmConfig *vmconfigs.MachineConfig, vmProvider vmconfigs.VMProvider) e
 
 // Start a host
 func (d *Driver) Start() error {
-	return Start(d.vmConfig, d.vmProvider)
+	return d.StartContext(context.Background())
+}
+
+// StartContext starts a host, the host is forcefully stopped if ctx is
+// cancelled before it is running
+func (d *Driver) StartContext(ctx context.Context) error {
+	return Start(ctx, d.vmConfig, d.vmProvider, machine.StartOptions{}, d.progress)
 }
 
 func (d *Driver) GetSharedDirs() ([]drivers.SharedDir, error) {
@@ -452,40 +544,56 @@ func (d *Driver) GetState() (state.State, error) {
 
 // Kill stops a host forcefully
 func (d *Driver) Kill() error {
-	fmt.Printf("Forcefully stopping machine %q\n", d.vmConfig.Name)
-	if err := d.stop(false); err != nil {
+	d.progress.Report(d.vmConfig.Name, "Forcefully stopping machine %q", d.vmConfig.Name)
+	if err := d.stop(context.Background(), false); err != nil {
+		events.EmitError(events.Stop, d.vmProvider.VMType(), d.vmConfig.Name, err)
 		return err
 	}
-	//newMachineEvent(events.Stop, events.Event{Name: vmName})
-	fmt.Printf("Machine %q forcefully stopped\n", d.vmConfig.Name)
+	events.Emit(events.Stop, d.vmProvider.VMType(), d.vmConfig.Name)
+	d.progress.Report(d.vmConfig.Name, "Machine %q forcefully stopped", d.vmConfig.Name)
 	return nil
 }
 
 // Remove a host
 func (d *Driver) Remove() error {
-	return d.RemoveWithOptions(machine.RemoveOptions{})
+	return d.RemoveWithOptions(context.Background(), machine.RemoveOptions{})
 }
 
-func (d *Driver) RemoveWithOptions(opts machine.RemoveOptions) error {
+// RemoveWithOptions stops and removes a host. ctx is checked before the
+// removal starts, the stop step is bounded by ctx like StopContext.
+func (d *Driver) RemoveWithOptions(ctx context.Context, opts machine.RemoveOptions) error {
 	machineName := d.vmConfig.Name
-	fmt.Printf("Removing machine %q\n", machineName)
-	dirs, err := env.GetMachineDirs(d.vmProvider.VMType())
-	if err != nil {
-		return err
-	}
-	if err := shim.Stop(d.vmConfig, d.vmProvider, dirs, true); err != nil {
-		return err
-	}
-
-	if err := shim.Remove(d.vmConfig, d.vmProvider, dirs, opts); err != nil {
+	d.progress.Report(machineName, "Removing machine %q", machineName)
+	if err := d.remove(ctx, opts); err != nil {
 		/* don’t print anything if the user cancelled the removal */
 		if errors.Is(err, shim.ErrRemoveUserCancelled) {
 			return nil
 		}
+		events.EmitError(events.Remove, d.vmProvider.VMType(), machineName, err)
 		return err
 	}
-	//newMachineEvent(events.Remove, events.Event{Name: vmName})
-	fmt.Printf("Machine %q removed successfully\n", machineName)
+	if err := metadata.Remove(d.vmProvider.VMType(), machineName); err != nil {
+		slog.Warn("failed to remove machine metadata", "machine", machineName, "error", err)
+	}
+	if dirs, err := env.GetMachineDirs(d.vmProvider.VMType()); err == nil {
+		if err := removeHostKey(dirs.DataDir.GetPath(), machineName); err != nil {
+			slog.Warn("failed to remove the SSH host key", "machine", machineName, "error", err)
+		}
+		// the keys given with --ssh-identity-path, or shared with podman,
+		// belong to the user
+		if identityPath := sshkeys.IdentityPath(dirs.DataDir.GetPath(), machineName); d.vmConfig.SSH.IdentityPath == identityPath {
+			if err := sshkeys.RemoveIdentity(identityPath); err != nil {
+				slog.Warn("failed to remove the SSH key", "machine", machineName, "error", err)
+			}
+		}
+	}
+	if defaultName, err := metadata.GetDefaultMachine(d.vmProvider.VMType()); err == nil && defaultName == machineName {
+		if err := metadata.SetDefaultMachine(d.vmProvider.VMType(), ""); err != nil {
+			slog.Warn("failed to unset default machine", "machine", machineName, "error", err)
+		}
+	}
+	events.Emit(events.Remove, d.vmProvider.VMType(), machineName)
+	d.progress.Report(machineName, "Machine %q removed successfully", machineName)
 	return nil
 	/*
 		s, err := d.GetState()
@@ -501,13 +609,28 @@ func (d *Driver) RemoveWithOptions(opts machine.RemoveOptions) error {
 	*/
 }
 
+func (d *Driver) remove(ctx context.Context, opts machine.RemoveOptions) error {
+	dirs, err := env.GetMachineDirs(d.vmProvider.VMType())
+	if err != nil {
+		return err
+	}
+	if err := d.stop(ctx, true); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return shim.Remove(d.vmConfig, d.vmProvider, dirs, opts)
+}
+
 // UpdateConfigRaw allows to change the state (memory, ...) of an already created machine
 func (d *Driver) UpdateConfigRaw(rawConfig []byte) error {
 	var newDriver Driver
 	if err := json.Unmarshal(rawConfig, &newDriver); err != nil {
 		return err
 	}
-	// or copy the pointer to podman structs from `d`?
+	// the provider is not serialized
+	newDriver.vmProvider = d.vmProvider
 	if err := newDriver.Reload(); err != nil {
 		return err
 	}
@@ -522,13 +645,17 @@ func (d *Driver) UpdateConfigRaw(rawConfig []byte) error {
 		setOpts.Memory = &newMemory
 	}
 	if d.DiskCapacity != newDriver.DiskCapacity {
-		newDiskSizeGB := strongunits.GiB(newDriver.DiskCapacity)
+		// DiskCapacity is in bytes
+		newDiskSizeGB := strongunits.ToGiB(strongunits.B(newDriver.DiskCapacity))
 		setOpts.DiskSize = &newDiskSizeGB
 	}
 
 	if err := shim.Set(newDriver.vmConfig, newDriver.vmProvider, setOpts); err != nil {
+		events.EmitError(events.Set, d.vmProvider.VMType(), d.MachineName, err)
 		return err
 	}
+	events.Emit(events.Set, d.vmProvider.VMType(), d.MachineName)
+	newDriver.progress = d.progress
 	*d = newDriver
 
 	return nil
@@ -536,25 +663,40 @@ func (d *Driver) UpdateConfigRaw(rawConfig []byte) error {
 
 // Stop a host gracefully
 func (d *Driver) Stop() error {
-	fmt.Printf("Stopping machine %q\n", d.vmConfig.Name)
-	if err := d.stop(false); err != nil {
+	return d.StopContext(context.Background())
+}
+
+// StopContext stops a host gracefully, the host is forcefully stopped if
+// ctx is cancelled before the graceful shutdown completes
+func (d *Driver) StopContext(ctx context.Context) error {
+	d.progress.Report(d.vmConfig.Name, "Stopping machine %q", d.vmConfig.Name)
+	if err := d.stop(ctx, false); err != nil {
+		events.EmitError(events.Stop, d.vmProvider.VMType(), d.vmConfig.Name, err)
 		return err
 	}
-	//newMachineEvent(events.Stop, events.Event{Name: vmName})
-	fmt.Printf("Machine %q stopped successfully\n", d.vmConfig.Name)
+	events.Emit(events.Stop, d.vmProvider.VMType(), d.vmConfig.Name)
+	d.progress.Report(d.vmConfig.Name, "Machine %q stopped successfully", d.vmConfig.Name)
 	return nil
 }
 
-func (d *Driver) stop(hardStop bool) error {
+func (d *Driver) stop(ctx context.Context, hardStop bool) error {
 	dirs, err := env.GetMachineDirs(d.vmProvider.VMType())
 	if err != nil {
 		return err
 	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-	if err := shim.Stop(d.vmConfig, d.vmProvider, dirs, hardStop); err != nil {
+	err = runWithContext(ctx, d.vmConfig.Name, d.vmProvider, dirs, func(vmProvider vmconfigs.VMProvider) error {
+		return shim.Stop(d.vmConfig, vmProvider, dirs, hardStop)
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("machine %q was forcefully stopped: %w", d.vmConfig.Name, err)
+		}
 		return err
 	}
-	//newMachineEvent(events.Remove, events.Event{Name: vmName})
 	return nil
 }
 
@@ -0,0 +1,380 @@
+package macadam
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containers/common/pkg/strongunits"
+	"github.com/containers/podman/v5/pkg/machine"
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/pkg/machine/env"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	macadamenv "github.com/crc-org/macadam/pkg/env"
+	"github.com/crc-org/macadam/pkg/machinedriver/provider/fake"
+	"github.com/crc-org/macadam/pkg/sshclient"
+	"github.com/crc-org/macadam/pkg/sshkeys"
+	"github.com/crc-org/machine/libmachine/drivers"
+	"github.com/crc-org/machine/libmachine/state"
+)
+
+var errInjected = errors.New("injected failure")
+
+// newFakeProvider returns a fake provider whose SSH servers are stopped at
+// the end of the test
+func newFakeProvider(t *testing.T) *fake.Provider {
+	p := fake.New(define.QemuVirt)
+	t.Cleanup(p.Close)
+	if err := macadamenv.SetupEnvironment(p); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// newTestDriver returns a driver for a new machine using a fake disk image
+func newTestDriver(t *testing.T, provider *fake.Provider) *Driver {
+	t.Helper()
+	// shim.Init runs ssh-keygen when the default key does not exist
+	identityPath, err := env.GetSSHIdentityPath(define.DefaultIdentityName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(identityPath); errors.Is(err, fs.ErrNotExist) {
+		if err := sshkeys.GenerateIdentity(identityPath, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	image := filepath.Join(t.TempDir(), "disk.qcow2")
+	if err := os.WriteFile(image, []byte("disk"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Driver{
+		VMDriver: &drivers.VMDriver{
+			BaseDriver: &drivers.BaseDriver{
+				MachineName: fmt.Sprintf("test-%d", time.Now().UnixNano()),
+			},
+			ImageSourcePath: image,
+			CPU:             macadamenv.DefaultCPUs,
+			Memory:          macadamenv.DefaultMemory,
+			DiskCapacity:    uint64(strongunits.GiB(macadamenv.DefaultDiskSize).ToBytes()),
+		},
+		DaemonVsockPort: DaemonVsockPort,
+		vmProvider:      provider,
+	}
+	d.SetProgressFunc(func(_, _ string) {})
+	return d
+}
+
+// createTestDriver creates a machine with Driver.Create
+func createTestDriver(t *testing.T, provider *fake.Provider) *Driver {
+	t.Helper()
+	d := newTestDriver(t, provider)
+	if err := d.Create(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := d.machineConfig(); err == nil {
+			_ = d.RemoveWithOptions(context.Background(), machine.RemoveOptions{Force: true})
+		}
+	})
+	return d
+}
+
+// machineConfig reads the configuration of the machine from its file
+func (d *Driver) machineConfig() (*vmconfigs.MachineConfig, error) {
+	dirs, err := env.GetMachineDirs(d.vmProvider.VMType())
+	if err != nil {
+		return nil, err
+	}
+	return vmconfigs.LoadMachineByName(d.MachineName, dirs)
+}
+
+func assertState(t *testing.T, d *Driver, expected state.State) {
+	t.Helper()
+	s, err := d.GetState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != expected {
+		t.Errorf("expected state %s, got %s", expected, s)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	provider := newFakeProvider(t)
+	d := createTestDriver(t, provider)
+
+	mc, err := d.machineConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mc.Resources.CPUs != macadamenv.DefaultCPUs || mc.Resources.Memory != macadamenv.DefaultMemory || mc.Resources.DiskSize != macadamenv.DefaultDiskSize {
+		t.Errorf("unexpected resources %+v", mc.Resources)
+	}
+	if provider.Calls(fake.OpCreateVM) != 1 {
+		t.Errorf("CreateVM was called %d times", provider.Calls(fake.OpCreateVM))
+	}
+	dirs, err := env.GetMachineDirs(provider.VMType())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identityPath := sshkeys.IdentityPath(dirs.DataDir.GetPath(), d.MachineName); mc.SSH.IdentityPath != identityPath {
+		t.Errorf("the machine uses the SSH key %s instead of its own key %s", mc.SSH.IdentityPath, identityPath)
+	}
+	assertState(t, d, state.Stopped)
+
+	if err := d.Create(); !errors.Is(err, define.ErrVMAlreadyExists) {
+		t.Errorf("expected ErrVMAlreadyExists, got %v", err)
+	}
+}
+
+func TestCreateDefaults(t *testing.T) {
+	custom := macadamenv.BuiltinMachineDefaults()
+	custom.CPUs = 3
+	custom.Memory = 2048
+	for _, tc := range []struct {
+		name     string
+		defaults *macadamenv.MachineDefaults
+		expected macadamenv.MachineDefaults
+	}{
+		{name: "built-in", expected: macadamenv.BuiltinMachineDefaults()},
+		{name: "machine defaults", defaults: &custom, expected: custom},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			provider := newFakeProvider(t)
+			d := newTestDriver(t, provider)
+			d.CPU, d.Memory, d.DiskCapacity = 0, 0, 0
+			if tc.defaults != nil {
+				d.SetMachineDefaults(*tc.defaults)
+			}
+			if err := d.Create(); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				_ = d.RemoveWithOptions(context.Background(), machine.RemoveOptions{Force: true})
+			})
+
+			mc, err := d.machineConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mc.Resources.CPUs != tc.expected.CPUs || uint64(mc.Resources.Memory) != tc.expected.Memory || uint64(mc.Resources.DiskSize) != tc.expected.DiskSize {
+				t.Errorf("unexpected resources %+v", mc.Resources)
+			}
+			if d.CPU != uint(tc.expected.CPUs) || d.Memory != uint(tc.expected.Memory) {
+				t.Errorf("the driver was not updated: %d CPUs, %d MiB", d.CPU, d.Memory)
+			}
+		})
+	}
+}
+
+func TestCreateFailure(t *testing.T) {
+	provider := newFakeProvider(t)
+	provider.Fail(fake.OpCreateVM, errInjected)
+
+	d := newTestDriver(t, provider)
+	if err := d.Create(); !errors.Is(err, errInjected) {
+		t.Fatalf("expected the injected failure, got %v", err)
+	}
+	if _, err := d.machineConfig(); err == nil {
+		t.Error("the configuration of the machine was written")
+	}
+}
+
+func TestStartStop(t *testing.T) {
+	provider := newFakeProvider(t)
+	provider.SetExec(func(_, command string, stdout, _ io.Writer) int {
+		if command != "uptime" {
+			return 0
+		}
+		fmt.Fprintln(stdout, "up 1 min")
+		return 0
+	})
+	d := createTestDriver(t, provider)
+
+	if err := d.StartContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	assertState(t, d, state.Running)
+
+	var stdout strings.Builder
+	target := SSHTarget(d.GetVmConfig())
+	if err := sshclient.Run(context.Background(), target, sshclient.Options{Command: []string{"uptime"}, Stdout: &stdout}); err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != "up 1 min\n" {
+		t.Errorf("unexpected output %q", stdout.String())
+	}
+
+	if err := d.StopContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	assertState(t, d, state.Stopped)
+}
+
+func TestStartFailure(t *testing.T) {
+	provider := newFakeProvider(t)
+	d := createTestDriver(t, provider)
+	provider.Fail(fake.OpStartVM, errInjected)
+
+	if err := d.StartContext(context.Background()); !errors.Is(err, errInjected) {
+		t.Fatalf("expected the injected failure, got %v", err)
+	}
+	assertState(t, d, state.Stopped)
+	mc, err := d.machineConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mc.Starting {
+		t.Error("machine is still marked as starting")
+	}
+
+	provider.Fail(fake.OpStartVM, nil)
+	if err := d.StartContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	assertState(t, d, state.Running)
+}
+
+func TestStopFailure(t *testing.T) {
+	provider := newFakeProvider(t)
+	d := createTestDriver(t, provider)
+	if err := d.StartContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	provider.Fail(fake.OpStopVM, errInjected)
+
+	if err := d.StopContext(context.Background()); !errors.Is(err, errInjected) {
+		t.Fatalf("expected the injected failure, got %v", err)
+	}
+	assertState(t, d, state.Running)
+
+	provider.Fail(fake.OpStopVM, nil)
+	if err := d.StopContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	assertState(t, d, state.Stopped)
+}
+
+func TestRemove(t *testing.T) {
+	provider := newFakeProvider(t)
+	d := createTestDriver(t, provider)
+	if err := d.StartContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	mc := d.GetVmConfig()
+
+	if err := d.RemoveWithOptions(context.Background(), machine.RemoveOptions{Force: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.machineConfig(); err == nil {
+		t.Error("the configuration of the machine was not removed")
+	}
+	if _, err := os.Stat(mc.ImagePath.GetPath()); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("the disk of the machine was not removed: %v", err)
+	}
+	if exists, err := provider.Exists(mc.Name); err != nil || exists {
+		t.Errorf("the machine still exists in the provider: %v", err)
+	}
+}
+
+func TestRemoveFailure(t *testing.T) {
+	provider := newFakeProvider(t)
+	d := createTestDriver(t, provider)
+	provider.Fail(fake.OpRemove, errInjected)
+
+	if err := d.RemoveWithOptions(context.Background(), machine.RemoveOptions{Force: true}); !errors.Is(err, errInjected) {
+		t.Fatalf("expected the injected failure, got %v", err)
+	}
+	if _, err := d.machineConfig(); err != nil {
+		t.Errorf("the configuration of the machine was removed: %v", err)
+	}
+	provider.Fail(fake.OpRemove, nil)
+}
+
+func TestRemoveCancelled(t *testing.T) {
+	provider := newFakeProvider(t)
+	d := createTestDriver(t, provider)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := d.RemoveWithOptions(ctx, machine.RemoveOptions{Force: true}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if provider.Calls(fake.OpRemove) != 0 {
+		t.Error("the machine was removed from the provider")
+	}
+}
+
+// updatedConfig returns the JSON configuration of d with other resources,
+// as given to UpdateConfigRaw
+func updatedConfig(t *testing.T, d *Driver, cpus, memory uint, diskSize strongunits.GiB) []byte {
+	t.Helper()
+	newDriver := *d
+	vmDriver := *d.VMDriver
+	newDriver.VMDriver = &vmDriver
+	newDriver.CPU = cpus
+	newDriver.Memory = memory
+	newDriver.DiskCapacity = uint64(diskSize.ToBytes())
+	b, err := json.Marshal(newDriver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestUpdateConfigRaw(t *testing.T) {
+	provider := newFakeProvider(t)
+	d := createTestDriver(t, provider)
+
+	if err := d.UpdateConfigRaw(updatedConfig(t, d, 4, 8192, 30)); err != nil {
+		t.Fatal(err)
+	}
+	mc, err := d.machineConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mc.Resources.CPUs != 4 || mc.Resources.Memory != 8192 || mc.Resources.DiskSize != 30 {
+		t.Errorf("unexpected resources %+v", mc.Resources)
+	}
+	if d.CPU != 4 || d.Memory != 8192 {
+		t.Errorf("the driver was not updated: %d CPUs, %d MiB", d.CPU, d.Memory)
+	}
+	if provider.Calls(fake.OpSetProviderAttrs) != 1 {
+		t.Errorf("SetProviderAttrs was called %d times", provider.Calls(fake.OpSetProviderAttrs))
+	}
+
+	// disks cannot shrink
+	if err := d.UpdateConfigRaw(updatedConfig(t, d, 4, 8192, 10)); err == nil {
+		t.Error("the disk size was decreased")
+	}
+}
+
+func TestUpdateConfigRawFailure(t *testing.T) {
+	provider := newFakeProvider(t)
+	d := createTestDriver(t, provider)
+	provider.Fail(fake.OpSetProviderAttrs, errInjected)
+
+	if err := d.UpdateConfigRaw(updatedConfig(t, d, 4, macadamenv.DefaultMemory, macadamenv.DefaultDiskSize)); !errors.Is(err, errInjected) {
+		t.Fatalf("expected the injected failure, got %v", err)
+	}
+	mc, err := d.machineConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mc.Resources.CPUs != macadamenv.DefaultCPUs {
+		t.Errorf("the configuration was written with %d CPUs", mc.Resources.CPUs)
+	}
+	if d.CPU != macadamenv.DefaultCPUs {
+		t.Errorf("the driver was updated to %d CPUs", d.CPU)
+	}
+}
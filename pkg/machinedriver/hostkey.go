@@ -0,0 +1,223 @@
+package macadam
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/podman/v5/pkg/machine"
+	"github.com/containers/podman/v5/pkg/machine/cloudinit"
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/pkg/machine/env"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	"github.com/crc-org/macadam/pkg/sshkeys"
+	"gopkg.in/yaml.v3"
+)
+
+const cloudConfigHeader = "#cloud-config\n"
+
+// userData is podman's default cloud-init user-data, with the host keys
+type userData struct {
+	cloudinit.UserData `yaml:",inline"`
+	SSHKeys            map[string]string `yaml:"ssh_keys"`
+}
+
+func userDataPath(dataDir, name string) string {
+	return filepath.Join(dataDir, name+"-user-data")
+}
+
+// PrepareHostKey generates the SSH host key of a new machine, and a
+// cloud-init user-data file installing it in the machine. The user-data
+// file replaces the one from initOpts.CloudInitPaths, it is a copy of it
+// with the host key. The host key is not pinned when the user-data file is
+// not a cloud-config file, when it already sets the host keys, or when the
+// machine is provisioned with ignition instead of cloud-init. The returned
+// function deletes the generated files, for init failures.
+func PrepareHostKey(initOpts *define.InitOptions, vmType define.VMType) (func(), error) {
+	noop := func() {}
+	// WSL machines do not use cloud-init
+	if vmType == define.WSLVirt || !initOpts.CloudInit {
+		return noop, nil
+	}
+	dirs, err := env.GetMachineDirs(vmType)
+	if err != nil {
+		return nil, err
+	}
+	dataDir := dirs.DataDir.GetPath()
+
+	hostKey, err := sshkeys.GenerateHostKey(initOpts.Name)
+	if err != nil {
+		return nil, err
+	}
+	sshKeys := map[string]string{
+		"ed25519_private": string(hostKey.PrivateKey),
+		"ed25519_public":  hostKey.AuthorizedKey(),
+	}
+
+	var content []byte
+	cloudInitPaths := make([]string, 0, len(initOpts.CloudInitPaths)+1)
+	userDataFile, hasMetaData := "", false
+	for _, param := range initOpts.CloudInitPaths {
+		// same parsing as podman's shim.CmdLineCloudInitToConfig
+		kind, file, found := strings.Cut(param, "=")
+		if !found {
+			kind, file = filepath.Base(param), param
+		}
+		switch kind {
+		case "user-data":
+			userDataFile = file
+			continue
+		case "meta-data":
+			hasMetaData = true
+		}
+		cloudInitPaths = append(cloudInitPaths, param)
+	}
+
+	switch {
+	case userDataFile != "":
+		content, err = addHostKeyToUserData(userDataFile, sshKeys)
+		if err != nil {
+			return nil, err
+		}
+		if content == nil {
+			slog.Debug("the SSH host key is not pinned, as the cloud-init user-data cannot be changed", "machine", initOpts.Name, "user-data", userDataFile)
+			return noop, nil
+		}
+	case hasMetaData:
+		// podman only generates a user-data when there is no meta-data
+		content, err = marshalCloudConfig(map[string]any{"ssh_keys": sshKeys})
+	default:
+		content, err = defaultUserData(initOpts, sshKeys)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cleanup := func() {
+		if err := removeHostKey(dataDir, initOpts.Name); err != nil {
+			slog.Warn("failed to remove the SSH host key", "machine", initOpts.Name, "error", err)
+		}
+	}
+	generatedUserData := userDataPath(dataDir, initOpts.Name)
+	// the user-data holds the private host key
+	if err := os.WriteFile(generatedUserData, content, 0600); err != nil {
+		cleanup()
+		return nil, err
+	}
+	if err := sshkeys.WriteHostKey(dataDir, initOpts.Name, hostKey); err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	initOpts.CloudInitPaths = append(cloudInitPaths, "user-data="+generatedUserData)
+	return cleanup, nil
+}
+
+// defaultUserData returns the user-data podman generates when no cloud-init
+// file is given, with the host keys
+func defaultUserData(initOpts *define.InitOptions, sshKeys map[string]string) ([]byte, error) {
+	identityPath := initOpts.SSHIdentityPath
+	if identityPath == "" {
+		var err error
+		identityPath, err = env.GetSSHIdentityPath(define.DefaultIdentityName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// creates the key if needed, as shim.Init does
+	authorizedKey, err := machine.GetSSHKeys(identityPath)
+	if err != nil {
+		return nil, err
+	}
+
+	data := userData{
+		UserData: cloudinit.UserData{
+			Users: []cloudinit.User{
+				{
+					Name:    initOpts.Username,
+					Sudo:    "ALL=(ALL) NOPASSWD:ALL",
+					Shell:   "/bin/bash",
+					Groups:  []string{"users"},
+					SSHKeys: []string{authorizedKey},
+				},
+			},
+		},
+		SSHKeys: sshKeys,
+	}
+	return marshalCloudConfig(data)
+}
+
+// addHostKeyToUserData returns a copy of the user-data file with the host
+// keys, or nil if it is not a cloud-config file or already has host keys
+func addHostKeyToUserData(path string, sshKeys map[string]string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cloud-init: failed to read %s: %w", path, err)
+	}
+	if !bytes.HasPrefix(b, []byte(cloudConfigHeader)) {
+		return nil, nil
+	}
+	data := map[string]any{}
+	if err := yaml.Unmarshal(b, &data); err != nil {
+		return nil, fmt.Errorf("cloud-init: invalid user-data %s: %w", path, err)
+	}
+	if _, ok := data["ssh_keys"]; ok {
+		return nil, nil
+	}
+	data["ssh_keys"] = sshKeys
+	return marshalCloudConfig(data)
+}
+
+func marshalCloudConfig(data any) ([]byte, error) {
+	b, err := yaml.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(cloudConfigHeader), b...), nil
+}
+
+// removeHostKey deletes the host key files and the generated user-data of
+// the machine called name
+func removeHostKey(dataDir, name string) error {
+	var errs []error
+	if err := os.Remove(userDataPath(dataDir, name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		errs = append(errs, err)
+	}
+	if err := sshkeys.RemoveHostKey(dataDir, name); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// verifyHostKey checks that the started machine presents its pinned host
+// key, so that a machine answering on the same port is not mistaken for it
+func verifyHostKey(ctx context.Context, mc *vmconfigs.MachineConfig, dirs *define.MachineDirs) error {
+	hostKey, err := sshkeys.LoadHostKey(dirs.DataDir.GetPath(), mc.Name)
+	if err != nil || hostKey == nil {
+		return err
+	}
+	target := SSHTarget(mc)
+	target.HostKey = hostKey
+	return sshkeys.VerifyHostKey(ctx, target)
+}
+
+// SSHTarget returns the SSH server of the machine, without its host key
+func SSHTarget(mc *vmconfigs.MachineConfig) sshkeys.Target {
+	address := "localhost"
+	if mc.IPAddress != "" {
+		address = mc.IPAddress
+	}
+	return sshkeys.Target{
+		Name:         mc.Name,
+		Address:      address,
+		Port:         mc.SSH.Port,
+		User:         mc.SSH.RemoteUsername,
+		IdentityPath: mc.SSH.IdentityPath,
+	}
+}
@@ -0,0 +1,32 @@
+package macadam
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/pkg/machine/env"
+	"github.com/crc-org/macadam/pkg/sshkeys"
+)
+
+// PrepareIdentity generates the key pair of a new machine when no key is
+// given in initOpts. The returned function deletes it, for init failures.
+func PrepareIdentity(initOpts *define.InitOptions, vmType define.VMType) (func(), error) {
+	if initOpts.SSHIdentityPath != "" {
+		return func() {}, nil
+	}
+	dirs, err := env.GetMachineDirs(vmType)
+	if err != nil {
+		return nil, err
+	}
+	identityPath := sshkeys.IdentityPath(dirs.DataDir.GetPath(), initOpts.Name)
+	if err := sshkeys.GenerateIdentity(identityPath, sshkeys.HostKeyAlias(initOpts.Name)); err != nil {
+		return nil, fmt.Errorf("failed to generate the SSH key of machine %q: %w", initOpts.Name, err)
+	}
+	initOpts.SSHIdentityPath = identityPath
+	return func() {
+		if err := sshkeys.RemoveIdentity(identityPath); err != nil {
+			slog.Warn("failed to remove the SSH key", "machine", initOpts.Name, "error", err)
+		}
+	}, nil
+}
@@ -0,0 +1,18 @@
+package macadam
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/crc-org/macadam/internal/testenv"
+)
+
+func TestMain(m *testing.M) {
+	testenv.Main(m, func(dir string) (func(), error) {
+		// Driver.Create copies the image to the crc directory of the home
+		// directory
+		MachineInstanceDir = filepath.Join(dir, "crc", "machines")
+		return nil, os.MkdirAll(filepath.Join(MachineInstanceDir, "crc"), 0o700)
+	})
+}
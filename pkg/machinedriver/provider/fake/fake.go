@@ -0,0 +1,316 @@
+// Package fake provides an in-memory VMProvider, so that the driver and the
+// commands can be tested without a hypervisor. Its machines have no VM: they
+// only have a state, which the tests can script, and an SSH server when they
+// are running, which runs the commands with a function set by the tests.
+package fake
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	gvproxy "github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/pkg/machine/ignition"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+)
+
+// Op is a VMProvider method for which a failure can be injected
+type Op string
+
+const (
+	OpCreateVM         Op = "CreateVM"
+	OpExists           Op = "Exists"
+	OpRemove           Op = "Remove"
+	OpSetProviderAttrs Op = "SetProviderAttrs"
+	OpStartNetworking  Op = "StartNetworking"
+	OpStartVM          Op = "StartVM"
+	OpState            Op = "State"
+	OpStopVM           Op = "StopVM"
+)
+
+// ExecFunc runs command in the machine called name, and returns its exit
+// status
+type ExecFunc func(name, command string, stdout, stderr io.Writer) int
+
+// Provider is a VMProvider keeping its machines in memory. The machine
+// configurations and disks are still written by podman's shim to the
+// directories of the provider.
+type Provider struct {
+	vmType define.VMType
+
+	mu         sync.Mutex
+	machines   map[string]*machine
+	failures   map[Op]error
+	calls      map[Op]int
+	startState define.Status
+	exec       ExecFunc
+}
+
+type machine struct {
+	state define.Status
+	ssh   *sshServer
+}
+
+// New creates a Provider using the directories of vmType. The QEMU type
+// is needed by Driver.Create, which generates an ignition ready unit. The
+// commands can use UnknownVirt, for which there are no preflight checks nor
+// helper binaries, and whose directories are the ones of QEMU.
+func New(vmType define.VMType) *Provider {
+	return &Provider{
+		vmType:     vmType,
+		machines:   map[string]*machine{},
+		failures:   map[Op]error{},
+		calls:      map[Op]int{},
+		startState: define.Running,
+	}
+}
+
+// Fail makes op return err until it is called again with a nil err
+func (p *Provider) Fail(op Op, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err == nil {
+		delete(p.failures, op)
+		return
+	}
+	p.failures[op] = err
+}
+
+// Calls returns how many times op was called
+func (p *Provider) Calls(op Op) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.calls[op]
+}
+
+// SetState sets the state of the machine called name. Setting a state other
+// than Running stops its SSH server.
+func (p *Provider) SetState(name string, state define.Status) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m := p.machine(name)
+	m.state = state
+	if state != define.Running {
+		m.stopSSH()
+	}
+}
+
+// SetStartState sets the state of the machines after StartVM, Running by
+// default. With Starting, the machines never become ready.
+func (p *Provider) SetStartState(state define.Status) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.startState = state
+}
+
+// SetExec sets the function running the commands received by the SSH
+// servers of the machines. By default, the commands succeed without output.
+func (p *Provider) SetExec(exec ExecFunc) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.exec = exec
+}
+
+// Close stops the SSH servers of the running machines
+func (p *Provider) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, m := range p.machines {
+		m.stopSSH()
+	}
+}
+
+// call records a call to op, and returns the injected failure. p.mu must be
+// held.
+func (p *Provider) call(op Op) error {
+	p.calls[op]++
+	if err := p.failures[op]; err != nil {
+		return fmt.Errorf("fake %s failure: %w", op, err)
+	}
+	return nil
+}
+
+// machine returns the machine called name, which is stopped when it is not
+// known. p.mu must be held.
+func (p *Provider) machine(name string) *machine {
+	m, ok := p.machines[name]
+	if !ok {
+		m = &machine{state: define.Stopped}
+		p.machines[name] = m
+	}
+	return m
+}
+
+func (m *machine) stopSSH() {
+	if m.ssh != nil {
+		m.ssh.close()
+		m.ssh = nil
+	}
+}
+
+func (p *Provider) CreateVM(opts define.CreateVMOpts, _ *vmconfigs.MachineConfig, _ *ignition.IgnitionBuilder) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.call(OpCreateVM); err != nil {
+		return err
+	}
+	p.machine(opts.Name)
+	return nil
+}
+
+func (p *Provider) PrepareIgnition(_ *vmconfigs.MachineConfig, _ *ignition.IgnitionBuilder) (*ignition.ReadyUnitOpts, error) {
+	return nil, nil
+}
+
+// Exists tells if the machine called name was created with this provider
+func (p *Provider) Exists(name string) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.call(OpExists); err != nil {
+		return false, err
+	}
+	_, ok := p.machines[name]
+	return ok, nil
+}
+
+func (p *Provider) MountType() vmconfigs.VolumeMountType {
+	return vmconfigs.VirtIOFS
+}
+
+func (p *Provider) MountVolumesToVM(_ *vmconfigs.MachineConfig, _ bool) error {
+	return nil
+}
+
+// Remove forgets the machine when the returned function is called, after
+// podman's shim removed its files
+func (p *Provider) Remove(mc *vmconfigs.MachineConfig) ([]string, func() error, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.call(OpRemove); err != nil {
+		return nil, nil, err
+	}
+	return nil, func() error {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if m, ok := p.machines[mc.Name]; ok {
+			m.stopSSH()
+			delete(p.machines, mc.Name)
+		}
+		return nil
+	}, nil
+}
+
+func (p *Provider) RemoveAndCleanMachines(_ *define.MachineDirs) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for name, m := range p.machines {
+		m.stopSSH()
+		delete(p.machines, name)
+	}
+	return nil
+}
+
+func (p *Provider) SetProviderAttrs(_ *vmconfigs.MachineConfig, _ define.SetOptions) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.call(OpSetProviderAttrs)
+}
+
+func (p *Provider) StartNetworking(_ *vmconfigs.MachineConfig, _ *gvproxy.GvproxyCommand) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.call(OpStartNetworking)
+}
+
+func (p *Provider) PostStartNetworking(_ *vmconfigs.MachineConfig, _ bool) error {
+	return nil
+}
+
+// StartVM sets the machine in the start state, and starts its SSH server
+// when the machine is running
+func (p *Provider) StartVM(mc *vmconfigs.MachineConfig) (func() error, func() error, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.call(OpStartVM); err != nil {
+		return nil, nil, err
+	}
+	m := p.machine(mc.Name)
+	m.state = p.startState
+	if m.state == define.Running {
+		server, err := startSSHServer(mc, p.runCommand)
+		if err != nil {
+			m.state = define.Stopped
+			return nil, nil, err
+		}
+		m.ssh = server
+	}
+	noop := func() error { return nil }
+	return noop, noop, nil
+}
+
+func (p *Provider) runCommand(name, command string, stdout, stderr io.Writer) int {
+	p.mu.Lock()
+	exec := p.exec
+	p.mu.Unlock()
+	if exec == nil {
+		return 0
+	}
+	return exec(name, command, stdout, stderr)
+}
+
+func (p *Provider) State(mc *vmconfigs.MachineConfig, _ bool) (define.Status, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.call(OpState); err != nil {
+		return "", err
+	}
+	if m, ok := p.machines[mc.Name]; ok {
+		return m.state, nil
+	}
+	return define.Stopped, nil
+}
+
+// StopVM stops the SSH server of the machine, hard stops cannot fail
+func (p *Provider) StopVM(mc *vmconfigs.MachineConfig, hardStop bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.call(OpStopVM); err != nil && !hardStop {
+		return err
+	}
+	m := p.machine(mc.Name)
+	m.state = define.Stopped
+	m.stopSSH()
+	return nil
+}
+
+func (p *Provider) StopHostNetworking(_ *vmconfigs.MachineConfig, _ define.VMType) error {
+	return nil
+}
+
+func (p *Provider) VMType() define.VMType {
+	return p.vmType
+}
+
+func (p *Provider) UserModeNetworkEnabled(_ *vmconfigs.MachineConfig) bool {
+	return false
+}
+
+// UseProviderNetworkSetup is true so that podman does not start gvproxy
+func (p *Provider) UseProviderNetworkSetup(_ *vmconfigs.MachineConfig) bool {
+	return true
+}
+
+func (p *Provider) SetExclusiveActive(_ bool) {}
+
+func (p *Provider) RequireExclusiveActive() bool {
+	return false
+}
+
+func (p *Provider) UpdateSSHPort(_ *vmconfigs.MachineConfig, _ int) error {
+	return nil
+}
+
+func (p *Provider) GetRosetta(_ *vmconfigs.MachineConfig) (bool, error) {
+	return false, nil
+}
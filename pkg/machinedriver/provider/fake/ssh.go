@@ -0,0 +1,146 @@
+package fake
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v3"
+)
+
+// sshServer stands for the SSH server of a running machine. It accepts any
+// key, and runs the exec requests with a commandFunc.
+type sshServer struct {
+	name     string
+	listener net.Listener
+	config   *ssh.ServerConfig
+	run      commandFunc
+	wg       sync.WaitGroup
+}
+
+type commandFunc func(name, command string, stdout, stderr io.Writer) int
+
+// startSSHServer listens on the SSH port of the machine. Its host key is
+// the one macadam pinned in the cloud-init user-data of the machine, or a
+// generated key when there is none.
+func startSSHServer(mc *vmconfigs.MachineConfig, run commandFunc) (*sshServer, error) {
+	hostKey, err := hostKey(mc)
+	if err != nil {
+		return nil, err
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, _ ssh.PublicKey) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", mc.SSH.Port))
+	if err != nil {
+		return nil, err
+	}
+	s := &sshServer{
+		name:     mc.Name,
+		listener: listener,
+		config:   config,
+		run:      run,
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// hostKey returns the host key set in the user-data of the machine
+func hostKey(mc *vmconfigs.MachineConfig) (ssh.Signer, error) {
+	if mc.CloudInitConfig.UserData != nil {
+		b, err := os.ReadFile(mc.CloudInitConfig.UserData.GetPath())
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		var userData struct {
+			SSHKeys map[string]string `yaml:"ssh_keys"`
+		}
+		if err := yaml.Unmarshal(b, &userData); err == nil && userData.SSHKeys["ed25519_private"] != "" {
+			return ssh.ParsePrivateKey([]byte(userData.SSHKeys["ed25519_private"]))
+		}
+	}
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.NewSignerFromKey(privateKey)
+}
+
+func (s *sshServer) close() {
+	s.listener.Close()
+	s.wg.Wait()
+}
+
+func (s *sshServer) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handleConn(conn)
+	}
+}
+
+func (s *sshServer) handleConn(conn net.Conn) {
+	defer conn.Close()
+	_, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go s.handleSession(channel, requests)
+	}
+}
+
+// handleSession runs the command of an exec request, a shell exits right
+// away. The pty and env requests are accepted and ignored.
+func (s *sshServer) handleSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	for req := range requests {
+		switch req.Type {
+		case "exec", "shell":
+			var command string
+			if req.Type == "exec" {
+				var payload struct{ Command string }
+				if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+					_ = req.Reply(false, nil)
+					continue
+				}
+				command = payload.Command
+			}
+			_ = req.Reply(true, nil)
+			status := s.run(s.name, command, channel, channel.Stderr())
+			exitStatus := make([]byte, 4)
+			binary.BigEndian.PutUint32(exitStatus, uint32(status)) //nolint:gosec
+			_, _ = channel.SendRequest("exit-status", false, exitStatus)
+			return
+		case "pty-req", "env", "window-change":
+			_ = req.Reply(true, nil)
+		default:
+			_ = req.Reply(false, nil)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package macadam
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// stopVirtiofsd kills the virtiofsd processes spawned by this process for
+// the sockets in runtimeDir. The runtime directory is shared by all the
+// machines, so processes started by other macadam instances are left alone.
+func stopVirtiofsd(runtimeDir string) error {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		if !isOwnVirtiofsd(pid, runtimeDir) {
+			continue
+		}
+		if err := syscall.Kill(pid, syscall.SIGKILL); err != nil && !errors.Is(err, syscall.ESRCH) {
+			return err
+		}
+	}
+	return nil
+}
+
+func isOwnVirtiofsd(pid int, runtimeDir string) bool {
+	stat, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return false
+	}
+	// the command name is between parentheses and can contain spaces,
+	// the parent pid is the second field after it
+	idx := bytes.LastIndexByte(stat, ')')
+	if idx < 0 {
+		return false
+	}
+	fields := strings.Fields(string(stat[idx+1:]))
+	if len(fields) < 2 || fields[1] != strconv.Itoa(os.Getpid()) {
+		return false
+	}
+
+	cmdline, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cmdline"))
+	if err != nil {
+		return false
+	}
+	args := strings.Split(string(cmdline), "\x00")
+	for i, arg := range args[:len(args)-1] {
+		if arg != "--socket-path" {
+			continue
+		}
+		socketPath := args[i+1]
+		if filepath.Dir(socketPath) == filepath.Clean(runtimeDir) && strings.HasPrefix(filepath.Base(socketPath), "virtiofschar") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package macadam
+
+// stopVirtiofsd is a no-op, virtiofsd is only used by the QEMU provider
+func stopVirtiofsd(_ string) error {
+	return nil
+}
@@ -0,0 +1,155 @@
+package metadata
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/storage/pkg/ioutils"
+	"github.com/containers/storage/pkg/lockfile"
+	"github.com/crc-org/macadam/pkg/env"
+)
+
+const (
+	machinesDir        = "machines"
+	defaultMachineFile = "default-machine"
+)
+
+// Metadata holds the macadam-specific information about a machine, which
+// cannot be stored in podman's machine configuration file
+type Metadata struct {
+	// Profile is the name of the profile the machine was created from
+	Profile string `json:",omitempty"`
+	// Image is the path to the disk image the machine was created from
+	Image string `json:",omitempty"`
+	// Labels are the key=value labels given at init, to select machines
+	Labels map[string]string `json:",omitempty"`
+
+	path string
+}
+
+// Path returns the path of the metadata file of the machine called name
+func Path(vmType define.VMType, name string) (string, error) {
+	dir, err := Dir(vmType)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name+".json"), nil
+}
+
+// Load returns the metadata of the machine called name. Empty metadata is
+// returned if none was stored for this machine.
+func Load(vmType define.VMType, name string) (*Metadata, error) {
+	path, err := Path(vmType, name)
+	if err != nil {
+		return nil, err
+	}
+
+	md := &Metadata{path: path}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return md, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(b, md); err != nil {
+		return nil, fmt.Errorf("unable to load machine metadata file %q: %w", path, err)
+	}
+
+	return md, nil
+}
+
+// Write stores the metadata on disk
+func (md *Metadata) Write() error {
+	if md.path == "" {
+		return errors.New("no metadata file associated with machine")
+	}
+	if err := os.MkdirAll(filepath.Dir(md.path), 0755); err != nil {
+		return err
+	}
+	b, err := json.Marshal(md)
+	if err != nil {
+		return err
+	}
+	return ioutils.AtomicWriteFile(md.path, b, 0644)
+}
+
+// Remove deletes the metadata of the machine called name
+func Remove(vmType define.VMType, name string) error {
+	path, err := Path(vmType, name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// InitLock returns the lock serializing the creation of the machine called
+// name. podman's machine lock only covers the writing of the machine
+// configuration, this lock also covers the files macadam prepares before it
+// and the metadata written after it.
+func InitLock(vmType define.VMType, name string) (*lockfile.LockFile, error) {
+	dir, err := Dir(vmType)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return lockfile.GetLockFile(filepath.Join(dir, name+".init.lock"))
+}
+
+// Dir returns the directory holding the metadata of the machines of the
+// provider
+func Dir(vmType define.VMType) (string, error) {
+	configDir, err := env.GetConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, machinesDir, vmType.String()), nil
+}
+
+// GetDefaultMachine returns the name of the machine set as default with
+// SetDefaultMachine, or an empty string if there is none
+func GetDefaultMachine(vmType define.VMType) (string, error) {
+	dir, err := Dir(vmType)
+	if err != nil {
+		return "", err
+	}
+	b, err := os.ReadFile(filepath.Join(dir, defaultMachineFile))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", nil
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// SetDefaultMachine persists name as the default machine for this provider,
+// an empty name unsets the default machine
+func SetDefaultMachine(vmType define.VMType, name string) error {
+	dir, err := Dir(vmType)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, defaultMachineFile)
+	if name == "" {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return ioutils.AtomicWriteFile(path, []byte(name+"\n"), 0644)
+}
@@ -0,0 +1,55 @@
+package preflights
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/containers/podman/v5/pkg/machine"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	"github.com/crc-org/macadam/pkg/helperbinaries"
+)
+
+func init() {
+	// macadam/podman needs a gvproxy version which supports the --services
+	// argument
+	registerHelperBinaryCheck("gvproxy-version", machine.ForwarderBinaryName, SeverityError, "please update to gvproxy v%s or newer")
+	// macadam/podman needs a vfkit binary which supports the --cloud-init
+	// argument to inject ssh keys in RHEL cloud images
+	registerHelperBinaryCheck("vfkit-version", "vfkit", SeverityError, "please update to vfkit v%s or newer")
+	registerHelperBinaryCheck("krunkit", "krunkit", SeverityError, "please install krunkit")
+}
+
+// registerHelperBinaryCheck registers a check that the helper binary called
+// binaryName is installed, with its minimum version. The remediation can
+// contain a %s verb for the minimum version.
+func registerHelperBinaryCheck(name, binaryName string, severity Severity, remediation string) {
+	binary, err := helperbinaries.Get(binaryName)
+	if err != nil {
+		panic(err)
+	}
+	description := fmt.Sprintf("%s is installed", binary.Name)
+	if binary.MinVersion != "" {
+		description = fmt.Sprintf("%s %s or newer is installed", binary.Name, binary.MinVersion)
+		remediation = fmt.Sprintf(remediation, binary.MinVersion)
+	}
+	Register(Check{
+		Name:        name,
+		Description: description,
+		Severity:    severity,
+		Providers:   binary.Providers,
+		Run: func(_ vmconfigs.VMProvider, _ *Options) error {
+			info, err := binary.Lookup()
+			if err != nil {
+				return err
+			}
+			err = info.CheckMinVersion()
+			if errors.Is(err, helperbinaries.ErrUnknownVersion) {
+				// builds without a version may support the needed
+				// features, they must not block the creation of machines
+				return Warning(err)
+			}
+			return err
+		},
+		Remediation: remediation,
+	})
+}
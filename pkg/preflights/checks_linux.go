@@ -0,0 +1,170 @@
+package preflights
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/pkg/machine/env"
+	"github.com/containers/podman/v5/pkg/machine/qemu"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	"golang.org/x/sys/unix"
+)
+
+const kvmDevice = "/dev/kvm"
+
+func init() {
+	Register(Check{
+		Name:        "kvm-device",
+		Description: "the KVM device exists",
+		Severity:    SeverityError,
+		Providers:   []define.VMType{define.QemuVirt},
+		Run: func(_ vmconfigs.VMProvider, _ *Options) error {
+			if _, err := os.Stat(kvmDevice); err != nil {
+				return fmt.Errorf("KVM is not available: %w", err)
+			}
+			return nil
+		},
+		Remediation: "enable virtualization in the firmware settings, and load the kvm_intel or kvm_amd kernel module",
+	})
+
+	Register(Check{
+		Name:        "kvm-access",
+		Description: "the user can access the KVM device",
+		Severity:    SeverityError,
+		Providers:   []define.VMType{define.QemuVirt},
+		Run:         checkKvmAccess,
+		Remediation: "add the user to the kvm group with 'sudo usermod -aG kvm $USER', then log out and log in again",
+	})
+
+	registerHelperBinaryCheck("qemu-version", qemu.QemuCommand, SeverityError, "please install QEMU %s or newer")
+	registerHelperBinaryCheck("qemu-img", "qemu-img", SeverityError, "please install qemu-img")
+	// virtiofsd is only used to mount volumes
+	registerHelperBinaryCheck("virtiofsd", "virtiofsd", SeverityWarning, "please install virtiofsd, it is needed to mount volumes")
+
+	Register(Check{
+		Name:        "disk-space",
+		Description: "the data directory has enough free space for the disk of the machine",
+		Severity:    SeverityWarning,
+		Run:         checkDiskSpace,
+		Remediation: "free some disk space, or use a smaller --disk-size",
+	})
+
+	Register(Check{
+		Name:        "memory",
+		Description: "the host has enough available memory for the machine",
+		Severity:    SeverityWarning,
+		Run:         checkMemory,
+		Remediation: "close some applications, or use a smaller --memory",
+	})
+}
+
+func checkKvmAccess(_ vmconfigs.VMProvider, _ *Options) error {
+	err := unix.Access(kvmDevice, unix.R_OK|unix.W_OK)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, unix.EACCES) {
+		return fmt.Errorf("cannot access %s: %w", kvmDevice, err)
+	}
+
+	var stat syscall.Stat_t
+	if err := syscall.Stat(kvmDevice, &stat); err != nil {
+		return fmt.Errorf("cannot access %s: %w", kvmDevice, err)
+	}
+	gid := strconv.FormatUint(uint64(stat.Gid), 10)
+	group := gid
+	if g, err := user.LookupGroupId(gid); err == nil {
+		group = g.Name
+	}
+	u, err := user.Current()
+	if err != nil {
+		return fmt.Errorf("%s is owned by the %s group, and cannot be accessed", kvmDevice, group)
+	}
+	// the groups of the session are only updated at login
+	if groups, err := u.GroupIds(); err == nil && slices.Contains(groups, gid) {
+		return fmt.Errorf("%s cannot be accessed, %s is a member of the %s group but the current session was started before it was added", kvmDevice, u.Username, group)
+	}
+	return fmt.Errorf("%s is owned by the %s group, and %s is not a member of it", kvmDevice, group, u.Username)
+}
+
+func checkDiskSpace(provider vmconfigs.VMProvider, opts *Options) error {
+	if opts.DiskSize == 0 {
+		return nil
+	}
+	dataDir, err := env.GetDataDir(provider.VMType())
+	if err != nil {
+		return err
+	}
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dataDir, &stat); err != nil {
+		return fmt.Errorf("cannot get the free space of %s: %w", dataDir, err)
+	}
+	freeGiB := stat.Bavail * uint64(stat.Bsize) / (1024 * 1024 * 1024)
+	if freeGiB < opts.DiskSize {
+		return fmt.Errorf("%s has %d GiB of free space, the disk of the machine can grow up to %d GiB", dataDir, freeGiB, opts.DiskSize)
+	}
+	return nil
+}
+
+func checkMemory(_ vmconfigs.VMProvider, opts *Options) error {
+	if opts.Memory == 0 {
+		return nil
+	}
+	total, available, err := readMeminfo()
+	if err != nil {
+		return err
+	}
+	if opts.Memory > total {
+		return fmt.Errorf("the machine needs %d MiB of memory, the host only has %d MiB", opts.Memory, total)
+	}
+	if opts.Memory > available {
+		return fmt.Errorf("the machine needs %d MiB of memory, only %d MiB are available", opts.Memory, available)
+	}
+	return nil
+}
+
+// readMeminfo returns the total and available memory of the host, in MiB
+func readMeminfo() (total uint64, available uint64, err error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		var dest *uint64
+		switch fields[0] {
+		case "MemTotal:":
+			dest = &total
+		case "MemAvailable:":
+			dest = &available
+		default:
+			continue
+		}
+		kib, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("cannot parse /proc/meminfo: %w", err)
+		}
+		*dest = kib / 1024
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, 0, err
+	}
+	if total == 0 || available == 0 {
+		return 0, 0, errors.New("cannot find the memory size in /proc/meminfo")
+	}
+	return total, available, nil
+}
@@ -1,86 +1,209 @@
+// Package preflights checks that the host can run macadam machines. The
+// checks are registered with Register, and run by Run for the provider in
+// use.
 package preflights
 
 import (
-	"bytes"
+	"errors"
 	"fmt"
 	"log/slog"
-	"os/exec"
+	"slices"
+	"strings"
 
-	"github.com/containers/common/pkg/config"
-	"github.com/containers/podman/v5/pkg/machine"
 	"github.com/containers/podman/v5/pkg/machine/define"
 	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
 )
 
-func RunPreflights(provider vmconfigs.VMProvider) error {
-	if err := checkGvproxyVersion(provider); err != nil {
-		return fmt.Errorf("invalid gvproxy binary: %w", err)
-	}
+// Severity is the impact of a failed check
+type Severity string
 
-	if err := checkVfkitVersion(provider); err != nil {
-		return fmt.Errorf("invalid vfkit binary: %w", err)
-	}
+const (
+	// SeverityError checks must pass to create machines
+	SeverityError Severity = "error"
+	// SeverityWarning checks only print a warning when they fail
+	SeverityWarning Severity = "warning"
+)
 
-	if err := checkKrunKitAvailability(provider); err != nil {
-		return fmt.Errorf("missing krunkit binary: %w", err)
-	}
+// Status is the outcome of a check
+type Status string
 
-	return nil
+const (
+	StatusPassed Status = "passed"
+	StatusFailed Status = "failed"
+	// StatusSkipped is used for the checks skipped by the user
+	StatusSkipped Status = "skipped"
+	// StatusNotApplicable is used for the checks of other providers
+	StatusNotApplicable Status = "not_applicable"
+)
+
+// Options are the options of Run
+type Options struct {
+	// Skip lists the names of the checks to skip
+	Skip []string
+	// Memory is the memory of the machine to create, in MiB
+	Memory uint64
+	// DiskSize is the disk size of the machine to create, in GiB
+	DiskSize uint64
 }
 
-// macadam/podman needs a gvproxy version which supports the --services
-// argument
-func checkGvproxyVersion(provider vmconfigs.VMProvider) error {
-	if provider.VMType() == define.WSLVirt || provider.VMType() == define.HyperVVirt {
+// Check is a preflight check
+type Check struct {
+	// Name identifies the check, for example to skip it
+	Name        string
+	Description string
+	Severity    Severity
+	// Providers lists the providers the check applies to, it applies to
+	// all the providers when empty
+	Providers []define.VMType
+	// Run returns an error describing the problem when the check fails
+	Run func(provider vmconfigs.VMProvider, opts *Options) error
+	// Remediation tells how to fix the problem found by the check
+	Remediation string
+}
+
+// AppliesTo returns true if the check must be run for vmType
+func (check *Check) AppliesTo(vmType define.VMType) bool {
+	return len(check.Providers) == 0 || slices.Contains(check.Providers, vmType)
+}
+
+// Result is the outcome of a check
+type Result struct {
+	Name        string
+	Description string
+	Severity    Severity
+	Status      Status
+	// Message describes the problem when the check failed
+	Message string `json:",omitempty"`
+	// Remediation is only set when the check failed
+	Remediation string `json:",omitempty"`
+}
+
+// Err returns the error of a failed check, or nil
+func (res *Result) Err() error {
+	if res.Status != StatusFailed {
 		return nil
 	}
-	if err := checkBinaryArg(machine.ForwarderBinaryName, "-services"); err != nil {
-		return fmt.Errorf("%w, please update to gvproxy v0.8.3 or newer", err)
+	if res.Remediation == "" {
+		return fmt.Errorf("%s: %s", res.Name, res.Message)
 	}
-	return nil
+	return fmt.Errorf("%s: %s, %s", res.Name, res.Message, res.Remediation)
 }
 
-// macadam/podman needs a vfkit binary which supports the --cloud-init
-// argument to inject ssh keys in RHEL cloud images
-func checkVfkitVersion(provider vmconfigs.VMProvider) error {
-	if provider.VMType() != define.AppleHvVirt {
-		return nil
+// warningError is a failure which must not block the creation of machines,
+// even for a check of error severity
+type warningError struct {
+	err error
+}
+
+func (w *warningError) Error() string {
+	return w.err.Error()
+}
+
+func (w *warningError) Unwrap() error {
+	return w.err
+}
+
+// Warning is returned by a check of error severity when it cannot tell if
+// the host is supported. The check fails with the warning severity.
+func Warning(err error) error {
+	return &warningError{err: err}
+}
+
+var checks []Check
+
+// Register adds check to the checks run by Run. It must be called from
+// init functions, and panics if a check with the same name exists.
+func Register(check Check) {
+	if slices.ContainsFunc(checks, func(c Check) bool { return c.Name == check.Name }) {
+		panic(fmt.Sprintf("preflight check %q is already registered", check.Name))
 	}
-	if err := checkBinaryArg("vfkit", "--cloud-init"); err != nil {
-		return fmt.Errorf("%w, please update to vfkit v0.6.1 or newer", err)
+	checks = append(checks, check)
+}
+
+// Checks returns the registered checks, in registration order
+func Checks() []Check {
+	return slices.Clone(checks)
+}
+
+// ValidateSkip returns an error if one of the names is not a registered
+// check
+func ValidateSkip(skip []string) error {
+	for _, name := range skip {
+		if !slices.ContainsFunc(checks, func(c Check) bool { return c.Name == name }) {
+			names := make([]string, 0, len(checks))
+			for _, check := range checks {
+				names = append(names, check.Name)
+			}
+			return fmt.Errorf("unknown preflight check %q, valid checks are %s", name, strings.Join(names, ", "))
+		}
 	}
 	return nil
 }
 
-func checkKrunKitAvailability(provider vmconfigs.VMProvider) error {
-	if provider.VMType() != define.LibKrun {
-		return nil
+// Run runs the checks which apply to provider, except the ones named in
+// opts.Skip, and returns the results of all the registered checks. Unlike
+// RunPreflights, it neither logs the failed warnings nor turns the failures
+// into an error, the caller decides what to do with the results.
+func Run(provider vmconfigs.VMProvider, opts Options) ([]Result, error) {
+	if err := ValidateSkip(opts.Skip); err != nil {
+		return nil, err
 	}
-	if err := checkBinaryArg("krunkit", "--version"); err != nil {
-		return fmt.Errorf("%w, please install krunkit", err)
+	results := make([]Result, 0, len(checks))
+	for _, check := range checks {
+		res := Result{
+			Name:        check.Name,
+			Description: check.Description,
+			Severity:    check.Severity,
+		}
+		switch {
+		case !check.AppliesTo(provider.VMType()):
+			res.Status = StatusNotApplicable
+		case slices.Contains(opts.Skip, check.Name):
+			res.Status = StatusSkipped
+		default:
+			if err := check.Run(provider, &opts); err != nil {
+				var warning *warningError
+				if errors.As(err, &warning) {
+					res.Severity = SeverityWarning
+				}
+				res.Status = StatusFailed
+				res.Message = err.Error()
+				res.Remediation = check.Remediation
+			} else {
+				res.Status = StatusPassed
+			}
+		}
+		results = append(results, res)
 	}
-	return nil
+	return results, nil
 }
 
-func checkBinaryArg(binaryName, arg string) error {
-	cfg, err := config.Default()
-	if err != nil {
-		return err
+// Err returns an error listing the failed checks of error severity, or nil
+// if there are none
+func Err(results []Result) error {
+	var errs []error
+	for _, res := range results {
+		if res.Severity == SeverityError {
+			if err := res.Err(); err != nil {
+				errs = append(errs, err)
+			}
+		}
 	}
+	return errors.Join(errs...)
+}
 
-	binary, err := cfg.FindHelperBinary(binaryName, false)
+// RunPreflights runs the checks which apply to provider, except the ones
+// named in opts.Skip. The failed checks of warning severity are logged, an
+// error is returned if a check of error severity failed.
+func RunPreflights(provider vmconfigs.VMProvider, opts Options) error {
+	results, err := Run(provider, opts)
 	if err != nil {
 		return err
 	}
-
-	cmd := exec.Command(binary, "--help")
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		slog.Error("failed to run binary", "path", binary, "error", err)
-	}
-	if !bytes.Contains(out, []byte(arg)) {
-		return fmt.Errorf("%s does not have support for the %s argument", binary, arg)
+	for _, res := range results {
+		if res.Severity == SeverityWarning && res.Status == StatusFailed {
+			slog.Warn("preflight check failed", "check", res.Name, "error", res.Message, "remediation", res.Remediation)
+		}
 	}
-
-	return nil
+	return Err(results)
 }
@@ -0,0 +1,36 @@
+package preflights
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	"github.com/crc-org/macadam/pkg/machinedriver/provider/fake"
+)
+
+func TestRunWarning(t *testing.T) {
+	Register(Check{
+		Name:     "test-unknown-version",
+		Severity: SeverityError,
+		Run: func(_ vmconfigs.VMProvider, _ *Options) error {
+			return Warning(errors.New("unknown version"))
+		},
+	})
+	t.Cleanup(func() { checks = checks[:len(checks)-1] })
+
+	results, err := Run(fake.New(define.UnknownVirt), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := results[len(results)-1]
+	if res.Status != StatusFailed || res.Severity != SeverityWarning {
+		t.Errorf("expected a failed warning, got %+v", res)
+	}
+	if res.Message != "unknown version" {
+		t.Errorf("unexpected message %q", res.Message)
+	}
+	if err := Err(results[len(results)-1:]); err != nil {
+		t.Errorf("a warning was returned as an error: %v", err)
+	}
+}
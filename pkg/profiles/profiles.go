@@ -0,0 +1,197 @@
+package profiles
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	ldefine "github.com/containers/podman/v5/libpod/define"
+	"github.com/containers/storage/pkg/ioutils"
+	"github.com/crc-org/macadam/pkg/env"
+)
+
+const (
+	profilesDir   = "profiles"
+	profileSuffix = ".toml"
+)
+
+var ErrProfileDoesNotExist = errors.New("profile does not exist")
+
+// Profile is a named set of values used to create a machine. Zero values
+// mean the macadam defaults are used.
+type Profile struct {
+	Name string `toml:"-"`
+
+	CPUs     uint64 `toml:"cpus,omitzero"`
+	Memory   uint64 `toml:"memory,omitzero"`
+	DiskSize uint64 `toml:"disk_size,omitzero"`
+	Username string `toml:"username,omitempty"`
+	// Image is the path to the disk image used when none is given to init
+	Image string `toml:"image,omitempty"`
+	// CloudInit lists user-data, meta-data and network-config cloud-init files,
+	// using the same syntax as the --cloud-init flag
+	CloudInit []string `toml:"cloud_init,omitempty"`
+	// Volumes lists the volumes to mount in the machine, source:target
+	Volumes []string `toml:"volumes,omitempty"`
+}
+
+// Dir returns the directory where profiles are stored
+// e.g. /home/user/.config/macadam/profiles
+func Dir() (string, error) {
+	configDir, err := env.GetConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, profilesDir), nil
+}
+
+func profilePath(name string) (string, error) {
+	if err := ValidateName(name); err != nil {
+		return "", err
+	}
+	dir, err := Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name+profileSuffix), nil
+}
+
+// ValidateName checks name can be used as a profile name
+func ValidateName(name string) error {
+	if !ldefine.NameRegex.MatchString(name) {
+		return fmt.Errorf("invalid profile name %q: %w", name, ldefine.RegexError)
+	}
+	return nil
+}
+
+// Load reads the profile called name
+func Load(name string) (*Profile, error) {
+	path, err := profilePath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	profile := &Profile{Name: name}
+	md, err := toml.DecodeFile(path, profile)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("%s: %w", name, ErrProfileDoesNotExist)
+		}
+		return nil, fmt.Errorf("failed to parse profile %s: %w", path, err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("failed to parse profile %s: unknown key %q", path, undecoded[0].String())
+	}
+
+	// relative cloud-init paths are relative to the profiles directory
+	for i, param := range profile.CloudInit {
+		kind, file, found := strings.Cut(param, "=")
+		if !found {
+			kind, file = "", param
+		}
+		if file == "" || filepath.IsAbs(file) {
+			continue
+		}
+		file = filepath.Join(filepath.Dir(path), file)
+		if found {
+			file = kind + "=" + file
+		}
+		profile.CloudInit[i] = file
+	}
+
+	return profile, nil
+}
+
+// List returns all the profiles sorted by name
+func List() ([]*Profile, error) {
+	dir, err := Dir()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return []*Profile{}, nil
+		}
+		return nil, err
+	}
+
+	profiles := []*Profile{}
+	for _, entry := range entries {
+		name, found := strings.CutSuffix(entry.Name(), profileSuffix)
+		if !found || entry.IsDir() {
+			continue
+		}
+		profile, err := Load(name)
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, profile)
+	}
+	sort.Slice(profiles, func(i, j int) bool {
+		return profiles[i].Name < profiles[j].Name
+	})
+
+	return profiles, nil
+}
+
+// Exists returns true if a profile called name has been created
+func Exists(name string) (bool, error) {
+	path, err := profilePath(name)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Write stores the profile in the profiles directory, replacing any existing
+// profile with the same name
+func (profile *Profile) Write() error {
+	path, err := profilePath(profile.Name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	b, err := profile.Marshal()
+	if err != nil {
+		return err
+	}
+	return ioutils.AtomicWriteFile(path, b, 0644)
+}
+
+// Marshal returns the TOML representation of the profile
+func (profile *Profile) Marshal() ([]byte, error) {
+	var b strings.Builder
+	enc := toml.NewEncoder(&b)
+	enc.Indent = ""
+	if err := enc.Encode(profile); err != nil {
+		return nil, err
+	}
+	return []byte(b.String()), nil
+}
+
+// Remove deletes the profile called name
+func Remove(name string) error {
+	path, err := profilePath(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("%s: %w", name, ErrProfileDoesNotExist)
+		}
+		return err
+	}
+	return nil
+}
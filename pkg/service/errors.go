@@ -0,0 +1,73 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/crc-org/macadam/pkg/client"
+)
+
+// ErrorResponse is the body of the responses of failed requests
+type ErrorResponse struct {
+	// Cause is the category of the error, such as "machine does not exist"
+	Cause string
+	// Code is the stable identifier of the error, see client.ErrorCode
+	Code string
+	// Message is the full error message
+	Message string
+	// Response is the HTTP status code
+	Response int
+}
+
+// badRequestError is returned for invalid request parameters or bodies
+type badRequestError struct {
+	message string
+}
+
+func newBadRequestError(format string, args ...any) error {
+	return &badRequestError{message: fmt.Sprintf(format, args...)}
+}
+
+func (err *badRequestError) Error() string {
+	return err.message
+}
+
+// errorStatuses maps the client errors to HTTP status codes, other errors
+// are internal server errors
+var errorStatuses = []struct {
+	err    error
+	status int
+}{
+	{client.ErrMachineNotFound, http.StatusNotFound},
+	{client.ErrMachineExists, http.StatusConflict},
+	{client.ErrMachineNotRunning, http.StatusConflict},
+	{client.ErrMachineRunning, http.StatusConflict},
+	{client.ErrInvalidName, http.StatusBadRequest},
+	{client.ErrInvalidImage, http.StatusBadRequest},
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	resp := ErrorResponse{
+		Cause:    "internal error",
+		Code:     client.ErrorCode(err),
+		Message:  err.Error(),
+		Response: http.StatusInternalServerError,
+	}
+
+	var badRequest *badRequestError
+	if errors.As(err, &badRequest) {
+		resp.Cause = "bad request"
+		resp.Code = "bad_request"
+		resp.Response = http.StatusBadRequest
+	}
+	for _, e := range errorStatuses {
+		if errors.Is(err, e.err) {
+			resp.Cause = e.err.Error()
+			resp.Response = e.status
+			break
+		}
+	}
+
+	writeJSON(w, resp.Response, resp)
+}
@@ -0,0 +1,78 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/pkg/machine/env"
+)
+
+// DefaultURI returns the URI the API is served on when none is specified:
+// a named pipe on Windows, a unix socket in the provider runtime directory
+// otherwise
+func DefaultURI(vmType define.VMType) (string, error) {
+	if runtime.GOOS == "windows" {
+		return "npipe:////./pipe/macadam-" + vmType.String(), nil
+	}
+	dirs, err := env.GetMachineDirs(vmType)
+	if err != nil {
+		return "", err
+	}
+	return "unix://" + filepath.Join(dirs.RuntimeDir.GetPath(), "api.sock"), nil
+}
+
+// Listen creates a listener for uri, which is either unix:///path/to/socket
+// or, on Windows, npipe:////./pipe/name
+func Listen(uri string) (net.Listener, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid service URI %q: %w", uri, err)
+	}
+	switch u.Scheme {
+	case "unix":
+		if u.Path == "" {
+			return nil, fmt.Errorf("invalid service URI %q: missing socket path", uri)
+		}
+		return listenUnix(u.Path)
+	case "npipe":
+		return listenPipe(filepath.FromSlash(u.Path))
+	default:
+		return nil, fmt.Errorf("invalid service URI %q: the scheme must be unix or npipe", uri)
+	}
+}
+
+func listenUnix(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	// remove the socket left by a service which did not exit cleanly, but
+	// do not take over the socket of a running service
+	if _, err := os.Stat(path); err == nil {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("a service is already listening on %s", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
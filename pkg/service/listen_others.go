@@ -0,0 +1,12 @@
+//go:build !windows
+
+package service
+
+import (
+	"errors"
+	"net"
+)
+
+func listenPipe(_ string) (net.Listener, error) {
+	return nil, errors.New("named pipes are only supported on Windows")
+}
@@ -0,0 +1,50 @@
+//go:build !windows
+
+package service
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api.sock")
+	listener, err := Listen("unix://" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Errorf("the socket permissions are %o", perm)
+	}
+
+	if _, err := Listen("unix://" + path); err == nil {
+		t.Error("listening on the socket of a running service succeeded")
+	}
+
+	go func() {
+		_ = http.Serve(listener, server.Config.Handler)
+	}()
+	httpClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := httpClient.Get("http://d/v1/version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,20 @@
+package service
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/Microsoft/go-winio"
+	"golang.org/x/sys/windows"
+)
+
+// listenPipe creates a named pipe which can only be used by the current
+// user, the administrators and the system account
+func listenPipe(path string) (net.Listener, error) {
+	user, err := windows.GetCurrentProcessToken().GetTokenUser()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the current user: %w", err)
+	}
+	securityDescriptor := fmt.Sprintf("D:P(A;;GA;;;SY)(A;;GA;;;BA)(A;;GA;;;%s)", user.User.Sid.String())
+	return winio.ListenPipe(path, &winio.PipeConfig{SecurityDescriptor: securityDescriptor})
+}
@@ -0,0 +1,164 @@
+package service
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const openAPIVersion = "3.0.3"
+
+// OpenAPI returns the OpenAPI document of the API. It is generated from the
+// routes, and from the Go types of their request and response bodies.
+func (s *Server) OpenAPI() map[string]any {
+	schemas := map[string]any{}
+	paths := map[string]map[string]any{}
+	errorSchema := schemaFor(reflect.TypeOf(ErrorResponse{}), schemas)
+
+	for _, rt := range s.routes {
+		operation := map[string]any{
+			"operationId": rt.operationID,
+			"summary":     rt.summary,
+		}
+
+		if len(rt.params) > 0 {
+			params := make([]map[string]any, 0, len(rt.params))
+			for _, p := range rt.params {
+				var schema map[string]any
+				if p.repeated {
+					schema = map[string]any{"type": "array", "items": map[string]any{"type": p.typ}}
+				} else {
+					schema = map[string]any{"type": p.typ}
+				}
+				params = append(params, map[string]any{
+					"name":        p.name,
+					"in":          p.in,
+					"description": p.description,
+					"required":    p.in == "path",
+					"schema":      schema,
+				})
+			}
+			operation["parameters"] = params
+		}
+
+		if rt.request != nil {
+			operation["requestBody"] = map[string]any{
+				"content": map[string]any{
+					"application/json": map[string]any{
+						"schema": schemaFor(reflect.TypeOf(rt.request), schemas),
+					},
+				},
+			}
+		}
+
+		response := map[string]any{
+			"description": http.StatusText(rt.status),
+		}
+		if rt.response != nil {
+			contentType := rt.contentType
+			if contentType == "" {
+				contentType = "application/json"
+			}
+			response["content"] = map[string]any{
+				contentType: map[string]any{
+					"schema": schemaFor(reflect.TypeOf(rt.response), schemas),
+				},
+			}
+		}
+		operation["responses"] = map[string]any{
+			strconv.Itoa(rt.status): response,
+			"default": map[string]any{
+				"description": "Error",
+				"content": map[string]any{
+					"application/json": map[string]any{
+						"schema": errorSchema,
+					},
+				},
+			},
+		}
+
+		if paths[rt.path] == nil {
+			paths[rt.path] = map[string]any{}
+		}
+		paths[rt.path][strings.ToLower(rt.method)] = operation
+	}
+
+	return map[string]any{
+		"openapi": openAPIVersion,
+		"info": map[string]any{
+			"title":   "macadam API",
+			"version": APIVersion,
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": schemas,
+		},
+	}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaFor returns the JSON schema of t. Named structs are added to
+// schemas, and referenced from the returned schema.
+func schemaFor(t reflect.Type, schemas map[string]any) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == timeType {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": schemaFor(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaFor(t.Elem(), schemas)}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return structSchema(t, schemas)
+		}
+		if _, exists := schemas[t.Name()]; !exists {
+			// registered before the fields for recursive types
+			schemas[t.Name()] = nil
+			schemas[t.Name()] = structSchema(t, schemas)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	default:
+		// interfaces can hold any value
+		return map[string]any{}
+	}
+}
+
+func structSchema(t reflect.Type, schemas map[string]any) map[string]any {
+	properties := map[string]any{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := field.Name
+		if tag, ok := field.Tag.Lookup("json"); ok {
+			tagName, _, _ := strings.Cut(tag, ",")
+			if tagName == "-" {
+				continue
+			}
+			if tagName != "" {
+				name = tagName
+			}
+		}
+		properties[name] = schemaFor(field.Type, schemas)
+	}
+	return map[string]any{"type": "object", "properties": properties}
+}
@@ -0,0 +1,345 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/crc-org/macadam/pkg/client"
+	"github.com/crc-org/macadam/pkg/cmdline"
+	"github.com/crc-org/macadam/pkg/events"
+)
+
+// param is a path or query parameter of a route
+type param struct {
+	name        string
+	in          string // "path" or "query"
+	typ         string // JSON schema type
+	description string
+	repeated    bool
+}
+
+// route describes an API endpoint. The OpenAPI document is generated from
+// the routes, so they must be kept accurate.
+type route struct {
+	method      string
+	path        string
+	operationID string
+	summary     string
+	params      []param
+	// request is a value of the type of the JSON request body, nil if the
+	// route has no body
+	request any
+	// response is a value of the type of the response body, nil if the
+	// route has no body
+	response any
+	// contentType is the content type of the response, application/json
+	// when empty
+	contentType string
+	status      int
+	handler     func(w http.ResponseWriter, r *http.Request) error
+}
+
+var (
+	nameParam = param{
+		name:        "name",
+		in:          "path",
+		typ:         "string",
+		description: "Name of the machine",
+	}
+	timeoutParam = param{
+		name:        "timeout",
+		in:          "query",
+		typ:         "string",
+		description: "Forcefully stop the machine if the operation takes longer than this duration, for example 2m",
+	}
+)
+
+func (s *Server) apiRoutes() []route {
+	prefix := "/" + APIVersion
+	return []route{
+		{
+			method:      http.MethodGet,
+			path:        prefix + "/version",
+			operationID: "Version",
+			summary:     "Get the version of macadam and of the API",
+			response:    VersionResponse{},
+			status:      http.StatusOK,
+			handler:     s.version,
+		},
+		{
+			method:      http.MethodGet,
+			path:        prefix + "/openapi.json",
+			operationID: "OpenAPI",
+			summary:     "Get the OpenAPI document of the API",
+			response:    map[string]any{},
+			status:      http.StatusOK,
+			handler:     s.openAPIDocument,
+		},
+		{
+			method:      http.MethodGet,
+			path:        prefix + "/machines",
+			operationID: "MachineList",
+			summary:     "List the machines",
+			response:    []Machine{},
+			status:      http.StatusOK,
+			handler:     s.listMachines,
+		},
+		{
+			method:      http.MethodPost,
+			path:        prefix + "/machines",
+			operationID: "MachineInit",
+			summary:     "Create a machine",
+			request:     client.InitOptions{},
+			response:    Machine{},
+			status:      http.StatusCreated,
+			handler:     s.initMachine,
+		},
+		{
+			method:      http.MethodGet,
+			path:        prefix + "/machines/{name}",
+			operationID: "MachineInspect",
+			summary:     "Inspect a machine",
+			params:      []param{nameParam},
+			response:    Machine{},
+			status:      http.StatusOK,
+			handler:     s.inspectMachine,
+		},
+		{
+			method:      http.MethodDelete,
+			path:        prefix + "/machines/{name}",
+			operationID: "MachineRemove",
+			summary:     "Remove a machine, it is stopped first if it is running",
+			params:      []param{nameParam},
+			status:      http.StatusNoContent,
+			handler:     s.removeMachine,
+		},
+		{
+			method:      http.MethodPost,
+			path:        prefix + "/machines/{name}/start",
+			operationID: "MachineStart",
+			summary:     "Start a machine",
+			params:      []param{nameParam, timeoutParam},
+			request:     client.StartOptions{},
+			status:      http.StatusNoContent,
+			handler:     s.startMachine,
+		},
+		{
+			method:      http.MethodPost,
+			path:        prefix + "/machines/{name}/stop",
+			operationID: "MachineStop",
+			summary:     "Stop a machine",
+			params:      []param{nameParam, timeoutParam},
+			status:      http.StatusNoContent,
+			handler:     s.stopMachine,
+		},
+		{
+			method:      http.MethodPost,
+			path:        prefix + "/machines/{name}/set",
+			operationID: "MachineSet",
+			summary:     "Change the settings of a machine, they are used at the next start",
+			params:      []param{nameParam},
+			request:     client.SetOptions{},
+			response:    Machine{},
+			status:      http.StatusOK,
+			handler:     s.setMachine,
+		},
+		{
+			method:      http.MethodGet,
+			path:        prefix + "/events",
+			operationID: "Events",
+			summary:     "Stream the machine events as server-sent events",
+			params: []param{
+				{name: "follow", in: "query", typ: "boolean", description: "Wait for new events after sending the past events, true by default"},
+				{name: "filter", in: "query", typ: "string", repeated: true, description: "Only send the events matching event=TYPE, machine=NAME or provider=NAME"},
+				{name: "since", in: "query", typ: "string", description: "Only send the events more recent than this RFC 3339 time. The Last-Event-ID header is used when it is not set."},
+			},
+			response:    events.Event{},
+			contentType: "text/event-stream",
+			status:      http.StatusOK,
+			handler:     s.streamEvents,
+		},
+	}
+}
+
+func (s *Server) version(w http.ResponseWriter, _ *http.Request) error {
+	writeJSON(w, http.StatusOK, VersionResponse{
+		APIVersion: APIVersion,
+		Version:    cmdline.Version(),
+	})
+	return nil
+}
+
+func (s *Server) openAPIDocument(w http.ResponseWriter, _ *http.Request) error {
+	writeJSON(w, http.StatusOK, s.OpenAPI())
+	return nil
+}
+
+func (s *Server) listMachines(w http.ResponseWriter, r *http.Request) error {
+	machines, err := s.client.List(r.Context())
+	if err != nil {
+		return err
+	}
+	resp := make([]*Machine, 0, len(machines))
+	for _, m := range machines {
+		resp = append(resp, toMachine(m))
+	}
+	writeJSON(w, http.StatusOK, resp)
+	return nil
+}
+
+func (s *Server) initMachine(w http.ResponseWriter, r *http.Request) error {
+	opts := client.InitOptions{}
+	if err := decodeBody(r, &opts); err != nil {
+		return err
+	}
+	m, err := s.client.Init(r.Context(), opts)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusCreated, toMachine(m))
+	return nil
+}
+
+func (s *Server) inspectMachine(w http.ResponseWriter, r *http.Request) error {
+	m, err := s.client.Inspect(r.Context(), r.PathValue("name"))
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, toMachine(m))
+	return nil
+}
+
+func (s *Server) removeMachine(w http.ResponseWriter, r *http.Request) error {
+	// there is no terminal to confirm the removal
+	if err := s.client.Remove(r.Context(), r.PathValue("name"), client.RemoveOptions{Force: true}); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (s *Server) startMachine(w http.ResponseWriter, r *http.Request) error {
+	opts := client.StartOptions{}
+	if err := decodeBody(r, &opts); err != nil {
+		return err
+	}
+	ctx, cancel, err := contextWithTimeout(r)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	if err := s.client.Start(ctx, r.PathValue("name"), opts); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (s *Server) stopMachine(w http.ResponseWriter, r *http.Request) error {
+	ctx, cancel, err := contextWithTimeout(r)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	if err := s.client.Stop(ctx, r.PathValue("name")); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (s *Server) setMachine(w http.ResponseWriter, r *http.Request) error {
+	opts := client.SetOptions{}
+	if err := decodeBody(r, &opts); err != nil {
+		return err
+	}
+	name := r.PathValue("name")
+	if err := s.client.Set(r.Context(), name, opts); err != nil {
+		return err
+	}
+	m, err := s.client.Inspect(r.Context(), name)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, toMachine(m))
+	return nil
+}
+
+func (s *Server) streamEvents(w http.ResponseWriter, r *http.Request) error {
+	query := r.URL.Query()
+	follow := true
+	if value := query.Get("follow"); value != "" {
+		var err error
+		follow, err = strconv.ParseBool(value)
+		if err != nil {
+			return newBadRequestError("invalid follow value %q", value)
+		}
+	}
+	filter, err := events.ParseFilter(query["filter"])
+	if err != nil {
+		return newBadRequestError("%v", err)
+	}
+	var since time.Time
+	sinceValue := query.Get("since")
+	if sinceValue == "" {
+		// set by EventSource clients when reconnecting
+		sinceValue = r.Header.Get("Last-Event-ID")
+	}
+	if sinceValue != "" {
+		since, err = time.Parse(time.RFC3339Nano, sinceValue)
+		if err != nil {
+			return newBadRequestError("invalid since value %q: %v", sinceValue, err)
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return errors.New("streaming is not supported by the connection")
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	err = events.Read(r.Context(), events.ReadOptions{Follow: follow, Filter: filter}, func(event *events.Event) error {
+		if !event.Time.After(since) {
+			return nil
+		}
+		b, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.Time.Format(time.RFC3339Nano), event.Type, b); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	})
+	// the response has started, errors can only be logged
+	if err != nil && !errors.Is(err, context.Canceled) {
+		slog.Warn("events stream failed", "error", err)
+	}
+	return nil
+}
+
+// contextWithTimeout returns the request context, with the deadline set by
+// the timeout query parameter
+func contextWithTimeout(r *http.Request) (context.Context, context.CancelFunc, error) {
+	value := r.URL.Query().Get("timeout")
+	if value == "" {
+		ctx, cancel := context.WithCancel(r.Context())
+		return ctx, cancel, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		return nil, nil, newBadRequestError("invalid timeout %q: %v", value, err)
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	return ctx, cancel, nil
+}
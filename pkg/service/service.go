@@ -0,0 +1,105 @@
+// Package service serves the macadam REST API: a versioned JSON HTTP API
+// over a unix socket, or a named pipe on Windows. It is a thin layer over
+// the client package, so that the API and the command line tool share the
+// same code paths.
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/crc-org/macadam/pkg/client"
+)
+
+const (
+	// APIVersion is the version of the API, it is the prefix of all the paths
+	APIVersion = "v1"
+
+	shutdownTimeout = 5 * time.Second
+)
+
+// Server serves the API for the machines of a client
+type Server struct {
+	client *client.Client
+	routes []route
+}
+
+// New creates a Server for the machines managed by c
+func New(c *client.Client) *Server {
+	s := &Server{client: c}
+	s.routes = s.apiRoutes()
+	return s
+}
+
+// Handler returns the HTTP handler serving the API
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	for _, rt := range s.routes {
+		mux.Handle(rt.method+" "+rt.path, s.handle(rt))
+	}
+	return mux
+}
+
+// Serve serves the API on listener until ctx is done. The operations in
+// progress are cancelled when ctx is done.
+func (s *Server) Serve(ctx context.Context, listener net.Listener) error {
+	server := &http.Server{
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil && !errors.Is(err, context.DeadlineExceeded) {
+			return err
+		}
+		return nil
+	}
+}
+
+// handle converts the errors returned by the route handler to API errors
+func (s *Server) handle(rt route) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slog.Debug("API request", "method", r.Method, "path", r.URL.Path)
+		if err := rt.handler(w, r); err != nil {
+			writeError(w, err)
+		}
+	})
+}
+
+// decodeBody decodes the JSON request body into v, an empty body leaves v
+// unchanged
+func decodeBody(r *http.Request, v any) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil && !errors.Is(err, io.EOF) {
+		return newBadRequestError("invalid request body: %v", err)
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Debug("failed to write API response", "error", err)
+	}
+}
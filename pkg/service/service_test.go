@@ -0,0 +1,330 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/crc-org/macadam/internal/testenv"
+	"github.com/crc-org/macadam/pkg/client"
+	"github.com/crc-org/macadam/pkg/events"
+)
+
+// server serves the API over the machines of the fake provider
+var server *httptest.Server
+
+func TestMain(m *testing.M) {
+	testenv.Main(m, func(string) (func(), error) {
+		fakeProvider := testenv.FakeProvider()
+		c, err := client.New(client.Options{VMProvider: fakeProvider})
+		if err != nil {
+			fakeProvider.Close()
+			return nil, err
+		}
+		server = httptest.NewServer(New(c).Handler())
+		return func() {
+			server.Close()
+			fakeProvider.Close()
+		}, nil
+	})
+}
+
+// do sends a request with body encoded in JSON, and returns the response
+// with its body
+func do(t *testing.T, method, path string, body any) (*http.Response, []byte) {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, server.URL+path, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, b
+}
+
+// mustDo is do failing the test when the response status is not status
+func mustDo(t *testing.T, method, path string, body any, status int) []byte {
+	t.Helper()
+	resp, b := do(t, method, path, body)
+	if resp.StatusCode != status {
+		t.Fatalf("%s %s: got status %d, expected %d\n%s", method, path, resp.StatusCode, status, b)
+	}
+	return b
+}
+
+// checkError checks that the response is a JSON error with status and the code
+// of err
+func checkError(t *testing.T, resp *http.Response, b []byte, status int, err error) {
+	t.Helper()
+	if resp.StatusCode != status {
+		t.Fatalf("got status %d, expected %d\n%s", resp.StatusCode, status, b)
+	}
+	var errResp ErrorResponse
+	if err := json.Unmarshal(b, &errResp); err != nil {
+		t.Fatalf("invalid error response: %v\n%s", err, b)
+	}
+	if errResp.Response != status || errResp.Code != client.ErrorCode(err) || errResp.Message == "" {
+		t.Errorf("unexpected error response %+v", errResp)
+	}
+}
+
+func writeImage(t *testing.T) string {
+	t.Helper()
+	image := filepath.Join(t.TempDir(), "disk.qcow2")
+	if err := os.WriteFile(image, []byte("disk"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return image
+}
+
+// createMachine creates a machine from a fake disk image, which is removed at
+// the end of the test
+func createMachine(t *testing.T, name string) *Machine {
+	t.Helper()
+	b := mustDo(t, http.MethodPost, "/v1/machines", client.InitOptions{Name: name, Image: writeImage(t)}, http.StatusCreated)
+	t.Cleanup(func() {
+		_, _ = do(t, http.MethodDelete, "/v1/machines/"+name, nil)
+	})
+	var m Machine
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	return &m
+}
+
+func inspectMachine(t *testing.T, name string) *Machine {
+	t.Helper()
+	var m Machine
+	if err := json.Unmarshal(mustDo(t, http.MethodGet, "/v1/machines/"+name, nil, http.StatusOK), &m); err != nil {
+		t.Fatal(err)
+	}
+	return &m
+}
+
+func listMachines(t *testing.T) map[string]*Machine {
+	t.Helper()
+	var machines []*Machine
+	if err := json.Unmarshal(mustDo(t, http.MethodGet, "/v1/machines", nil, http.StatusOK), &machines); err != nil {
+		t.Fatal(err)
+	}
+	byName := map[string]*Machine{}
+	for _, m := range machines {
+		byName[m.Name] = m
+	}
+	return byName
+}
+
+func TestLifecycle(t *testing.T) {
+	m := createMachine(t, "lifecycle")
+	if m.Name != "lifecycle" || m.State != string(define.Stopped) {
+		t.Errorf("unexpected created machine %+v", m)
+	}
+
+	if _, ok := listMachines(t)["lifecycle"]; !ok {
+		t.Fatal("the machine is not listed")
+	}
+
+	mustDo(t, http.MethodPost, "/v1/machines/lifecycle/start", nil, http.StatusNoContent)
+	if m := inspectMachine(t, "lifecycle"); m.State != string(define.Running) {
+		t.Errorf("the machine is %s after start", m.State)
+	}
+
+	mustDo(t, http.MethodPost, "/v1/machines/lifecycle/stop?timeout=1m", nil, http.StatusNoContent)
+	if m := inspectMachine(t, "lifecycle"); m.State != string(define.Stopped) {
+		t.Errorf("the machine is %s after stop", m.State)
+	}
+
+	mustDo(t, http.MethodDelete, "/v1/machines/lifecycle", nil, http.StatusNoContent)
+	if _, ok := listMachines(t)["lifecycle"]; ok {
+		t.Error("the machine is still listed")
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	for _, req := range []struct {
+		method string
+		path   string
+	}{
+		{http.MethodGet, "/v1/machines/missing"},
+		{http.MethodDelete, "/v1/machines/missing"},
+		{http.MethodPost, "/v1/machines/missing/start"},
+		{http.MethodPost, "/v1/machines/missing/stop"},
+	} {
+		t.Run(req.method+" "+req.path, func(t *testing.T) {
+			resp, b := do(t, req.method, req.path, nil)
+			checkError(t, resp, b, http.StatusNotFound, client.ErrMachineNotFound)
+		})
+	}
+}
+
+func TestInitExisting(t *testing.T) {
+	createMachine(t, "existing")
+	resp, b := do(t, http.MethodPost, "/v1/machines", client.InitOptions{Name: "existing", Image: writeImage(t)})
+	checkError(t, resp, b, http.StatusConflict, client.ErrMachineExists)
+}
+
+func TestBadRequest(t *testing.T) {
+	createMachine(t, "bad")
+	for _, req := range []struct {
+		method string
+		path   string
+	}{
+		{http.MethodPost, "/v1/machines/bad/stop?timeout=soon"},
+		{http.MethodGet, "/v1/events?follow=maybe"},
+		{http.MethodGet, "/v1/events?since=yesterday"},
+	} {
+		t.Run(req.method+" "+req.path, func(t *testing.T) {
+			resp, b := do(t, req.method, req.path, nil)
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Fatalf("got status %d\n%s", resp.StatusCode, b)
+			}
+			var errResp ErrorResponse
+			if err := json.Unmarshal(b, &errResp); err != nil || errResp.Code != "bad_request" {
+				t.Errorf("unexpected error response %s", b)
+			}
+		})
+	}
+}
+
+// sseEvent is an event of a text/event-stream response
+type sseEvent struct {
+	id    string
+	event *events.Event
+}
+
+// readEvents returns the events of the response of GET /v1/events
+func readEvents(t *testing.T, query, lastEventID string) []sseEvent {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/v1/events?"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected response %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	var result []sseEvent
+	var current sseEvent
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			result = append(result, current)
+			current = sseEvent{}
+		case strings.HasPrefix(line, "id: "):
+			current.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			current.event = &events.Event{}
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), current.event); err != nil {
+				t.Fatalf("invalid event %q: %v", line, err)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestEventsLastEventID(t *testing.T) {
+	createMachine(t, "events")
+	mustDo(t, http.MethodPost, "/v1/machines/events/start", nil, http.StatusNoContent)
+	mustDo(t, http.MethodPost, "/v1/machines/events/stop", nil, http.StatusNoContent)
+
+	query := "follow=false&filter=machine=events"
+	all := readEvents(t, query, "")
+	var types []events.Type
+	for _, e := range all {
+		types = append(types, e.event.Type)
+	}
+	if len(all) < 3 || types[0] != events.Init || types[len(types)-1] != events.Stop {
+		t.Fatalf("unexpected events %v", types)
+	}
+
+	// a client reconnecting after the first event only gets the next ones
+	resumed := readEvents(t, query, all[0].id)
+	if len(resumed) != len(all)-1 {
+		t.Fatalf("got %d events after %s, expected %d", len(resumed), all[0].id, len(all)-1)
+	}
+	for i, e := range resumed {
+		if e.id != all[i+1].id || e.event.Type != all[i+1].event.Type {
+			t.Errorf("event %d is %s %s, expected %s %s", i, e.id, e.event.Type, all[i+1].id, all[i+1].event.Type)
+		}
+	}
+
+	if last := readEvents(t, query, all[len(all)-1].id); len(last) != 0 {
+		t.Errorf("got %d events after the last one", len(last))
+	}
+}
+
+// TestInitConcurrent checks that concurrent requests creating the same machine
+// create it once, and that the others fail with a conflict
+func TestInitConcurrent(t *testing.T) {
+	body, err := json.Marshal(client.InitOptions{Name: "concurrent", Image: writeImage(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_, _ = do(t, http.MethodDelete, "/v1/machines/concurrent", nil)
+	})
+	statuses := make(chan string)
+	ready := make(chan struct{})
+	for range 8 {
+		go func() {
+			<-ready
+			resp, err := http.Post(server.URL+"/v1/machines", "application/json", bytes.NewReader(body))
+			if err != nil {
+				statuses <- err.Error()
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp.Status
+		}()
+	}
+	close(ready)
+	created := 0
+	for range 8 {
+		switch status := <-statuses; status {
+		case "201 Created":
+			created++
+		case "409 Conflict":
+		default:
+			t.Errorf("unexpected response %s", status)
+		}
+	}
+	if created != 1 {
+		t.Errorf("the machine was created %d times", created)
+	}
+}
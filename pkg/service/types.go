@@ -0,0 +1,68 @@
+package service
+
+import (
+	"time"
+
+	"github.com/crc-org/macadam/pkg/client"
+)
+
+// VersionResponse is the response of GET /v1/version
+type VersionResponse struct {
+	APIVersion string
+	Version    string
+}
+
+// Machine is the representation of a machine in the API
+type Machine struct {
+	Name      string
+	Provider  string
+	Image     string
+	Profile   string            `json:",omitempty"`
+	Labels    map[string]string `json:",omitempty"`
+	IsDefault bool
+	State     string
+	Starting  bool
+	Created   time.Time
+	// LastUp is omitted if the machine never ran
+	LastUp             *time.Time `json:",omitempty"`
+	CPUs               uint64
+	Memory             uint64 // MiB
+	DiskSize           uint64 // GiB
+	SSH                SSHConfig
+	UserModeNetworking bool
+}
+
+// SSHConfig is the SSH configuration of a machine
+type SSHConfig struct {
+	IdentityPath   string
+	Port           int
+	RemoteUsername string
+}
+
+func toMachine(m *client.Machine) *Machine {
+	machine := &Machine{
+		Name:      m.Name,
+		Provider:  m.VMType.String(),
+		Image:     m.Image,
+		Profile:   m.Profile,
+		Labels:    m.Labels,
+		IsDefault: m.IsDefault,
+		State:     string(m.State),
+		Starting:  m.Starting,
+		Created:   m.Created,
+		CPUs:      m.Resources.CPUs,
+		Memory:    uint64(m.Resources.Memory),
+		DiskSize:  uint64(m.Resources.DiskSize),
+		SSH: SSHConfig{
+			IdentityPath:   m.SSH.IdentityPath,
+			Port:           m.SSH.Port,
+			RemoteUsername: m.SSH.RemoteUsername,
+		},
+		UserModeNetworking: m.UserModeNetworking,
+	}
+	if !m.LastUp.IsZero() {
+		lastUp := m.LastUp
+		machine.LastUp = &lastUp
+	}
+	return machine
+}
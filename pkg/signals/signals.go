@@ -0,0 +1,132 @@
+// Package signals cancels contexts on SIGINT and SIGTERM, like
+// signal.NotifyContext, in a way which survives the start of a machine.
+//
+// podman's shim.Start handles these signals by exiting the process, without
+// stopping the processes it started. Its handlers cannot be unregistered one
+// by one, so Intercept replaces all the handlers of these signals with the
+// relay of this package, which cancels the contexts returned by
+// NotifyContext. The handlers registered directly with os/signal for these
+// signals do not survive the start of a machine, NotifyContext must be used
+// instead.
+package signals
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var stopSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+var relay struct {
+	mu sync.Mutex
+	// ch is registered for stopSignals while cancels is not empty
+	ch      chan os.Signal
+	cancels map[int]context.CancelFunc
+	nextID  int
+	// intercepted is true when other handlers may have been registered
+	// since Intercept removed them
+	intercepted bool
+}
+
+// NotifyContext returns a copy of parent which is done when SIGINT or SIGTERM
+// is received, or when stop is called. stop must be called once the context
+// is not used anymore.
+func NotifyContext(parent context.Context) (ctx context.Context, stop context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+
+	relay.mu.Lock()
+	defer relay.mu.Unlock()
+	if relay.ch == nil {
+		relay.ch = make(chan os.Signal, 1)
+		relay.cancels = map[int]context.CancelFunc{}
+		go forward()
+	}
+	if len(relay.cancels) == 0 {
+		signal.Notify(relay.ch, stopSignals...)
+	}
+	id := relay.nextID
+	relay.nextID++
+	relay.cancels[id] = cancel
+
+	var once sync.Once
+	return ctx, func() {
+		once.Do(func() {
+			cancel()
+			unsubscribe(id)
+		})
+	}
+}
+
+func forward() {
+	for range relay.ch {
+		relay.mu.Lock()
+		for _, cancel := range relay.cancels {
+			cancel()
+		}
+		relay.mu.Unlock()
+	}
+}
+
+func unsubscribe(id int) {
+	relay.mu.Lock()
+	defer relay.mu.Unlock()
+	delete(relay.cancels, id)
+	switch {
+	case !relay.intercepted && len(relay.cancels) == 0:
+		signal.Stop(relay.ch)
+	case !relay.intercepted:
+	case len(relay.cancels) == 0:
+		// removes the handlers registered since the last Intercept call,
+		// and restores the default behavior of the signals
+		signal.Reset(stopSignals...)
+		relay.intercepted = false
+	default:
+		replaceHandlers()
+		relay.intercepted = false
+	}
+}
+
+// Intercept replaces all the handlers of SIGINT and SIGTERM with the relay,
+// when a context returned by NotifyContext waits for these signals. It is
+// called while podman's shim.Start runs, after each point where it may have
+// registered its handlers.
+func Intercept() {
+	relay.mu.Lock()
+	defer relay.mu.Unlock()
+	if len(relay.cancels) == 0 {
+		return
+	}
+	replaceHandlers()
+	relay.intercepted = true
+}
+
+// InterceptEvery calls Intercept every interval until stop is called, for the
+// handlers registered from goroutines, at points which cannot be known
+func InterceptEvery(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				Intercept()
+			}
+		}
+	}()
+	return sync.OnceFunc(func() { close(done) })
+}
+
+func replaceHandlers() {
+	// Ignore removes all the handlers, including the relay. The signals
+	// received before the relay is registered again are lost, but they do
+	// not exit the process.
+	signal.Ignore(stopSignals...)
+	signal.Notify(relay.ch, stopSignals...)
+}
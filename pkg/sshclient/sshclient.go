@@ -0,0 +1,242 @@
+// Package sshclient runs commands and interactive shells in the macadam
+// machines with the golang.org/x/crypto/ssh client, so that no ssh binary
+// is needed on the host.
+package sshclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/crc-org/macadam/pkg/sshkeys"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/term"
+)
+
+// ErrInvalidEnv is returned for environment variables which are not K=V,
+// or K to use the value of the host
+var ErrInvalidEnv = errors.New("invalid environment variable")
+
+var envNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Options are the options of Run
+type Options struct {
+	// Command is the command to run, an interactive shell is opened when
+	// empty. As with the ssh binary, its elements are joined with spaces
+	// and run by the shell of the machine user.
+	Command []string
+	// Env lists K=V variables to set for the command, or K to use the
+	// value of the host
+	Env []string
+	// WorkDir is the directory the command runs in
+	WorkDir string
+	// TTY allocates a pseudo-terminal, Stdin and Stdout must then be
+	// terminals
+	TTY bool
+	// ForwardAgent forwards the SSH agent of the host to the machine
+	ForwardAgent bool
+
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// ExitError is returned by Run when the command does not exit with status 0
+type ExitError struct {
+	// Code is the exit status of the command, 128+N when it was killed by
+	// signal N, or 255 when the machine did not report it, as with the ssh
+	// binary
+	Code int
+	// Signal is the name of the signal which killed the command
+	Signal string
+}
+
+func (err *ExitError) Error() string {
+	if err.Signal != "" {
+		return fmt.Sprintf("command killed by signal %s", err.Signal)
+	}
+	return fmt.Sprintf("command exited with status %d", err.Code)
+}
+
+// RemoteCommand returns the shell command to run in the machine for
+// command, with the environment variables env, in the directory workDir. An
+// empty string means an interactive login shell.
+func RemoteCommand(command, env []string, workDir string) (string, error) {
+	var prefix strings.Builder
+	for _, variable := range env {
+		name, value, found := strings.Cut(variable, "=")
+		if !envNameRegex.MatchString(name) {
+			return "", fmt.Errorf("%w: %q", ErrInvalidEnv, variable)
+		}
+		if !found {
+			if value, found = os.LookupEnv(name); !found {
+				continue
+			}
+		}
+		fmt.Fprintf(&prefix, "export %s=%s; ", name, Quote(value))
+	}
+	if workDir != "" {
+		fmt.Fprintf(&prefix, "cd %s || exit 1; ", Quote(workDir))
+	}
+
+	switch {
+	case len(command) > 0:
+		return prefix.String() + strings.Join(command, " "), nil
+	case prefix.Len() > 0:
+		// the login shell sshd would have started
+		return prefix.String() + `exec "${SHELL:-/bin/sh}" -l`, nil
+	default:
+		return "", nil
+	}
+}
+
+// Quote quotes value for a POSIX shell
+func Quote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// Run runs a command or an interactive shell in the machine of target. The
+// connection is closed when ctx is done. An *ExitError is returned when the
+// command fails.
+func Run(ctx context.Context, target sshkeys.Target, opts Options) error {
+	command, err := RemoteCommand(opts.Command, opts.Env, opts.WorkDir)
+	if err != nil {
+		return err
+	}
+
+	client, err := sshkeys.Dial(ctx, target)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	stop := context.AfterFunc(ctx, func() {
+		// sshd only kills the command on disconnection when it has a
+		// pseudo-terminal
+		_ = session.Signal(ssh.SIGTERM)
+		client.Close()
+	})
+	defer stop()
+
+	if opts.ForwardAgent {
+		if err := forwardAgent(client, session); err != nil {
+			return err
+		}
+	}
+	if opts.TTY {
+		restore, err := requestPty(ctx, session, opts.Stdin, opts.Stdout)
+		if err != nil {
+			return err
+		}
+		defer restore()
+	}
+
+	session.Stdout = opts.Stdout
+	session.Stderr = opts.Stderr
+	// Session.Wait would wait for the end of Stdin, which never comes for
+	// a terminal, the copy is thus not waited for
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if command == "" {
+		err = session.Shell()
+	} else {
+		err = session.Start(command)
+	}
+	if err != nil {
+		return err
+	}
+	if opts.Stdin != nil {
+		go func() {
+			_, _ = io.Copy(stdin, opts.Stdin)
+			stdin.Close()
+		}()
+	} else {
+		stdin.Close()
+	}
+
+	err = session.Wait()
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	var exitErr *ssh.ExitError
+	var exitMissingErr *ssh.ExitMissingError
+	switch {
+	case errors.As(err, &exitErr):
+		return &ExitError{Code: exitErr.ExitStatus(), Signal: exitErr.Signal()}
+	case errors.As(err, &exitMissingErr):
+		return &ExitError{Code: 255}
+	}
+	return err
+}
+
+// forwardAgent makes the SSH agent of the host available in session
+func forwardAgent(client *ssh.Client, session *ssh.Session) error {
+	conn, err := dialAgent()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the SSH agent: %w", err)
+	}
+	if err := agent.ForwardToAgent(client, agent.NewClient(conn)); err != nil {
+		conn.Close()
+		return err
+	}
+	return agent.RequestAgentForwarding(session)
+}
+
+// requestPty allocates a pseudo-terminal of the size of the stdout
+// terminal, and puts the stdin terminal in raw mode. The returned function
+// restores the terminals.
+func requestPty(ctx context.Context, session *ssh.Session, stdin io.Reader, stdout io.Writer) (func(), error) {
+	stdinFile, ok := stdin.(*os.File)
+	if !ok || !term.IsTerminal(int(stdinFile.Fd())) {
+		return nil, errors.New("a terminal is required for stdin")
+	}
+	stdoutFile, ok := stdout.(*os.File)
+	if !ok || !term.IsTerminal(int(stdoutFile.Fd())) {
+		return nil, errors.New("a terminal is required for stdout")
+	}
+	inFd, outFd := int(stdinFile.Fd()), int(stdoutFile.Fd())
+
+	width, height, err := term.GetSize(outFd)
+	if err != nil {
+		width, height = 80, 24
+	}
+	termType := os.Getenv("TERM")
+	if termType == "" {
+		termType = "xterm-256color"
+	}
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          1,
+		ssh.TTY_OP_ISPEED: 14400,
+		ssh.TTY_OP_OSPEED: 14400,
+	}
+	if err := session.RequestPty(termType, height, width, modes); err != nil {
+		return nil, err
+	}
+
+	restoreOutput, err := enableVirtualTerminal(outFd)
+	if err != nil {
+		return nil, err
+	}
+	state, err := term.MakeRaw(inFd)
+	if err != nil {
+		restoreOutput()
+		return nil, err
+	}
+	stopWatching := watchWindowSize(ctx, outFd, session)
+	return func() {
+		stopWatching()
+		_ = term.Restore(inFd, state)
+		restoreOutput()
+	}, nil
+}
@@ -0,0 +1,55 @@
+//go:build !windows
+
+package sshclient
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// enableVirtualTerminal is needed on Windows only, terminals interpret the
+// escape sequences
+func enableVirtualTerminal(_ int) (func(), error) {
+	return func() {}, nil
+}
+
+// watchWindowSize resizes the pseudo-terminal of session when the terminal
+// fd is resized, until the returned function is called
+func watchWindowSize(ctx context.Context, fd int, session *ssh.Session) func() {
+	sigwinch := make(chan os.Signal, 1)
+	signal.Notify(sigwinch, syscall.SIGWINCH)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-sigwinch:
+				if width, height, err := term.GetSize(fd); err == nil {
+					_ = session.WindowChange(height, width)
+				}
+			case <-ctx.Done():
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(sigwinch)
+		close(done)
+	}
+}
+
+func dialAgent() (net.Conn, error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, errors.New("SSH_AUTH_SOCK is not set")
+	}
+	return net.Dial("unix", socket)
+}
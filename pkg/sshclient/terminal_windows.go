@@ -0,0 +1,75 @@
+package sshclient
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Microsoft/go-winio"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/windows"
+	"golang.org/x/term"
+)
+
+// agentPipe is the named pipe of the OpenSSH for Windows agent
+const agentPipe = `\\.\pipe\openssh-ssh-agent`
+
+// resizePollInterval is the interval between two checks of the console
+// size, as Windows has no SIGWINCH
+const resizePollInterval = 250 * time.Millisecond
+
+// enableVirtualTerminal makes the console interpret the escape sequences
+// sent by the machine
+func enableVirtualTerminal(fd int) (func(), error) {
+	var mode uint32
+	if err := windows.GetConsoleMode(windows.Handle(fd), &mode); err != nil {
+		return nil, err
+	}
+	if err := windows.SetConsoleMode(windows.Handle(fd), mode|windows.ENABLE_VIRTUAL_TERMINAL_PROCESSING); err != nil {
+		return nil, err
+	}
+	return func() {
+		_ = windows.SetConsoleMode(windows.Handle(fd), mode)
+	}, nil
+}
+
+// watchWindowSize resizes the pseudo-terminal of session when the console
+// fd is resized, until the returned function is called
+func watchWindowSize(ctx context.Context, fd int, session *ssh.Session) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(resizePollInterval)
+		defer ticker.Stop()
+		width, height, _ := term.GetSize(fd)
+		for {
+			select {
+			case <-ticker.C:
+				newWidth, newHeight, err := term.GetSize(fd)
+				if err != nil || (newWidth == width && newHeight == height) {
+					continue
+				}
+				width, height = newWidth, newHeight
+				_ = session.WindowChange(height, width)
+			case <-ctx.Done():
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+func dialAgent() (net.Conn, error) {
+	pipe := agentPipe
+	// SSH_AUTH_SOCK can point to another agent pipe
+	if socket := os.Getenv("SSH_AUTH_SOCK"); strings.HasPrefix(socket, `\\.\pipe\`) {
+		pipe = socket
+	}
+	timeout := 5 * time.Second
+	return winio.DialPipe(pipe, &timeout)
+}
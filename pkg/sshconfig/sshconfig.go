@@ -0,0 +1,203 @@
+// Package sshconfig generates OpenSSH client configuration for the macadam
+// machines, so that ssh, rsync or IDEs can connect to them using a host
+// alias.
+package sshconfig
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/storage/pkg/ioutils"
+	"github.com/crc-org/macadam/pkg/env"
+)
+
+const (
+	hostAliasPrefix = "macadam-"
+	// includeDir is relative to ~/.ssh, the directory of the user ssh config
+	includeDir = "config.d"
+	// includeLine makes ssh read the files of all the providers
+	includeLine = "Include " + includeDir + "/macadam-*"
+	header      = "# This file is generated by macadam, it is overwritten when machines are created, started or removed\n"
+)
+
+// Host is the ssh configuration of a machine
+type Host struct {
+	// Name is the machine name, the host alias is macadam-Name
+	Name         string
+	HostName     string
+	Port         int
+	User         string
+	IdentityFile string
+	// KnownHostsFile holds the host key of the machine, stored for the
+	// HostKeyAlias name. Host key checking is disabled when it is empty.
+	KnownHostsFile string
+	HostKeyAlias   string
+}
+
+// HostAlias returns the alias of the machine called name in the generated
+// configuration
+func HostAlias(name string) string {
+	return hostAliasPrefix + name
+}
+
+// Write writes a Host stanza for each of the hosts to w. The host key is
+// checked with the known_hosts file of the machine, the machines created by
+// older macadam versions do not have one and are not checked, as for
+// 'macadam ssh'.
+func Write(w io.Writer, hosts []Host) error {
+	for i, host := range hosts {
+		if i > 0 {
+			if _, err := fmt.Fprintln(w); err != nil {
+				return err
+			}
+		}
+		strictHostKeyChecking, knownHostsFile := "no", os.DevNull
+		if host.KnownHostsFile != "" {
+			strictHostKeyChecking, knownHostsFile = "yes", quote(host.KnownHostsFile)
+		}
+		options := [][2]string{
+			{"HostName", host.HostName},
+			{"Port", strconv.Itoa(host.Port)},
+			{"User", host.User},
+			{"IdentityFile", quote(host.IdentityFile)},
+			{"IdentitiesOnly", "yes"},
+			{"StrictHostKeyChecking", strictHostKeyChecking},
+			{"UserKnownHostsFile", knownHostsFile},
+			{"HostKeyAlias", host.HostKeyAlias},
+			{"CheckHostIP", "no"},
+			{"LogLevel", "ERROR"},
+		}
+		if _, err := fmt.Fprintf(w, "Host %s\n", HostAlias(host.Name)); err != nil {
+			return err
+		}
+		for _, option := range options {
+			if option[1] == "" {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "  %s %s\n", option[0], option[1]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// quote quotes paths with spaces, which are common on Windows
+func quote(value string) string {
+	if strings.ContainsAny(value, " \t") {
+		return `"` + value + `"`
+	}
+	return value
+}
+
+// sshDir returns ~/.ssh, or $MACADAM_HOME/.ssh so that the machines of a
+// separate macadam home do not replace the ones of the user
+func sshDir() (string, error) {
+	if home := env.Home(); home != "" {
+		return filepath.Join(home, ".ssh"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".ssh"), nil
+}
+
+// Path returns the path of the file holding the configuration of the
+// machines of vmType. Each provider has its own file, as a process can only
+// manage the machines of a single provider.
+func Path(vmType define.VMType) (string, error) {
+	dir, err := sshDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, includeDir, hostAliasPrefix+vmType.String()), nil
+}
+
+// IsInstalled returns true if Install was used for vmType, and the
+// configuration of its machines must be kept up to date with Update
+func IsInstalled(vmType define.VMType) bool {
+	p, err := Path(vmType)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(p)
+	return err == nil
+}
+
+// Install writes the configuration of hosts to the file of vmType under
+// ~/.ssh/config.d, and includes the macadam files from ~/.ssh/config
+func Install(vmType define.VMType, hosts []Host) error {
+	if err := Update(vmType, hosts); err != nil {
+		return err
+	}
+	return addInclude()
+}
+
+// Update overwrites the file of vmType with the configuration of hosts
+func Update(vmType define.VMType, hosts []Host) error {
+	p, err := Path(vmType)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+
+	buf := bytes.NewBufferString(header)
+	if len(hosts) > 0 {
+		buf.WriteString("\n")
+	}
+	if err := Write(buf, hosts); err != nil {
+		return err
+	}
+	return ioutils.AtomicWriteFile(p, buf.Bytes(), 0600)
+}
+
+// addInclude adds the Include directive at the top of ~/.ssh/config, as
+// Include directives after a Host line only apply to that host
+func addInclude() error {
+	dir, err := sshDir()
+	if err != nil {
+		return err
+	}
+	configPath := filepath.Join(dir, "config")
+
+	var mode fs.FileMode = 0600
+	// keep the symlinks of the dotfiles managers
+	if target, err := filepath.EvalSymlinks(configPath); err == nil {
+		configPath = target
+	}
+	content, err := os.ReadFile(configPath)
+	switch {
+	case err == nil:
+		for _, line := range strings.Split(string(content), "\n") {
+			if strings.TrimSpace(line) == includeLine {
+				return nil
+			}
+		}
+		if fi, err := os.Stat(configPath); err == nil {
+			mode = fi.Mode().Perm()
+		}
+	case errors.Is(err, fs.ErrNotExist):
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+
+	newContent := includeLine + "\n"
+	if len(content) > 0 {
+		newContent += "\n" + string(content)
+	}
+	return ioutils.AtomicWriteFile(configPath, []byte(newContent), mode)
+}
@@ -0,0 +1,122 @@
+package sshkeys
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const dialTimeout = 30 * time.Second
+
+// Target is the SSH server of a machine
+type Target struct {
+	// Name is the machine name
+	Name         string
+	Address      string
+	Port         int
+	User         string
+	IdentityPath string
+	// HostKey is the pinned host key of the machine, any host key is
+	// accepted when it is nil
+	HostKey ssh.PublicKey
+}
+
+// Dial connects to the SSH server of target, authenticating with its
+// identity. A *HostKeyMismatchError is returned when the machine does not
+// present its pinned host key.
+func Dial(ctx context.Context, target Target) (*ssh.Client, error) {
+	privateKey, err := os.ReadFile(target.IdentityPath)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SSH key %s: %w", target.IdentityPath, err)
+	}
+	config := &ssh.ClientConfig{
+		User:    target.User,
+		Auth:    []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		Timeout: dialTimeout,
+	}
+	if target.HostKey != nil {
+		config.HostKeyCallback = HostKeyCallback(target.Name, target.HostKey)
+		config.HostKeyAlgorithms = []string{target.HostKey.Type()}
+	} else {
+		// machines created before the host keys were pinned
+		config.HostKeyCallback = ssh.InsecureIgnoreHostKey() //nolint:gosec
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+	addr := net.JoinHostPort(target.Address, strconv.Itoa(target.Port))
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to machine %q: %w", target.Name, err)
+	}
+	// the handshake does not use ctx
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		var mismatch *HostKeyMismatchError
+		if errors.As(err, &mismatch) {
+			return nil, mismatch
+		}
+		return nil, fmt.Errorf("failed to connect to machine %q: %w", target.Name, err)
+	}
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// Run runs command in the machine of target, and returns its combined
+// output when it fails
+func Run(ctx context.Context, target Target, command string) error {
+	client, err := Dial(ctx, target)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	stop := context.AfterFunc(ctx, func() {
+		client.Close()
+	})
+	defer stop()
+	out, err := session.CombinedOutput(command)
+	if err != nil && len(bytes.TrimSpace(out)) > 0 {
+		return fmt.Errorf("failed to run %q in machine %q: %w: %s", command, target.Name, err, bytes.TrimSpace(out))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to run %q in machine %q: %w", command, target.Name, err)
+	}
+	return nil
+}
+
+// VerifyHostKey connects to the SSH server of target, and checks that it
+// presents the pinned host key of the machine. A *HostKeyMismatchError is
+// returned when another key is presented.
+func VerifyHostKey(ctx context.Context, target Target) error {
+	if target.HostKey == nil {
+		return fmt.Errorf("no host key is pinned for machine %q", target.Name)
+	}
+	client, err := Dial(ctx, target)
+	if err != nil {
+		return err
+	}
+	return client.Close()
+}
@@ -0,0 +1,136 @@
+// Package sshkeys manages the SSH keys of the macadam machines. Each
+// machine gets its own client key pair, and its host key is generated by
+// macadam and injected with cloud-init, so that the connections to the
+// machine can verify it instead of trusting any key.
+package sshkeys
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/containers/storage/pkg/ioutils"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// HostKeyAlias is the name under which the host key of the machine called
+// name is stored in its known_hosts file. The SSH port of a machine can
+// change, so the key is not stored for its address.
+func HostKeyAlias(name string) string {
+	return "macadam-" + name
+}
+
+// HostKey is a generated SSH host key
+type HostKey struct {
+	// PrivateKey is the private key in OpenSSH PEM format, as expected
+	// by the cloud-init ssh_keys module
+	PrivateKey []byte
+	PublicKey  ssh.PublicKey
+}
+
+// GenerateHostKey creates an ed25519 host key for the machine called name
+func GenerateHostKey(name string) (*HostKey, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	block, err := ssh.MarshalPrivateKey(privateKey, HostKeyAlias(name))
+	if err != nil {
+		return nil, err
+	}
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &HostKey{
+		PrivateKey: pem.EncodeToMemory(block),
+		PublicKey:  sshPublicKey,
+	}, nil
+}
+
+// AuthorizedKey returns the public key in the authorized_keys format
+func (key *HostKey) AuthorizedKey() string {
+	return string(ssh.MarshalAuthorizedKey(key.PublicKey))
+}
+
+// PublicKeyPath returns the path of the file holding the public host key of
+// the machine called name, in the machine data directory dataDir
+func PublicKeyPath(dataDir, name string) string {
+	return filepath.Join(dataDir, name+"-ssh_host_ed25519_key.pub")
+}
+
+// KnownHostsPath returns the path of the known_hosts file of the machine
+// called name, in the machine data directory dataDir
+func KnownHostsPath(dataDir, name string) string {
+	return filepath.Join(dataDir, name+"-known_hosts")
+}
+
+// WriteHostKey stores the public part of the host key of the machine called
+// name, and its known_hosts file
+func WriteHostKey(dataDir, name string, key *HostKey) error {
+	if err := ioutils.AtomicWriteFile(PublicKeyPath(dataDir, name), []byte(key.AuthorizedKey()), 0644); err != nil {
+		return err
+	}
+	line := knownhosts.Line([]string{HostKeyAlias(name)}, key.PublicKey) + "\n"
+	return ioutils.AtomicWriteFile(KnownHostsPath(dataDir, name), []byte(line), 0644)
+}
+
+// LoadHostKey returns the host key of the machine called name, or nil if it
+// was created by a macadam version which did not pin the host keys
+func LoadHostKey(dataDir, name string) (ssh.PublicKey, error) {
+	b, err := os.ReadFile(PublicKeyPath(dataDir, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid host key for machine %q: %w", name, err)
+	}
+	return key, nil
+}
+
+// RemoveHostKey deletes the host key files of the machine called name
+func RemoveHostKey(dataDir, name string) error {
+	var errs []error
+	for _, path := range []string{PublicKeyPath(dataDir, name), KnownHostsPath(dataDir, name)} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// HostKeyMismatchError is returned when a machine presents another host key
+// than the one generated for it, for example when another machine uses its
+// SSH port
+type HostKeyMismatchError struct {
+	Machine  string
+	Expected ssh.PublicKey
+	Actual   ssh.PublicKey
+}
+
+func (err *HostKeyMismatchError) Error() string {
+	return fmt.Sprintf("host key verification failed for machine %q: expected %s key %s, got %s key %s; another machine may be using its SSH port",
+		err.Machine, err.Expected.Type(), ssh.FingerprintSHA256(err.Expected), err.Actual.Type(), ssh.FingerprintSHA256(err.Actual))
+}
+
+// HostKeyCallback returns an ssh.HostKeyCallback accepting only expected
+func HostKeyCallback(name string, expected ssh.PublicKey) ssh.HostKeyCallback {
+	return func(_ string, _ net.Addr, key ssh.PublicKey) error {
+		if key.Type() != expected.Type() || !bytes.Equal(key.Marshal(), expected.Marshal()) {
+			return &HostKeyMismatchError{Machine: name, Expected: expected, Actual: key}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,92 @@
+package sshkeys
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// IdentityPath returns the path of the private key used to connect to the
+// machine called name, in the machine data directory dataDir, when no key
+// was given at init. Its public key is IdentityPath + ".pub".
+func IdentityPath(dataDir, name string) string {
+	return filepath.Join(dataDir, name+"-id_ed25519")
+}
+
+// GenerateIdentity creates an ed25519 key pair, and writes it to path and
+// path.pub, as ssh-keygen does
+func GenerateIdentity(path, comment string) error {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	block, err := ssh.MarshalPrivateKey(privateKey, comment)
+	if err != nil {
+		return err
+	}
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+	authorizedKey := strings.TrimSuffix(string(ssh.MarshalAuthorizedKey(sshPublicKey)), "\n")
+	if comment != "" {
+		authorizedKey += " " + comment
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	// ssh refuses private keys readable by other users
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".pub", []byte(authorizedKey+"\n"), 0644); err != nil {
+		_ = os.Remove(path)
+		return err
+	}
+	return nil
+}
+
+// RenameIdentity moves the key pair at oldPath to newPath. The private key
+// is moved first, and moved back if the public key cannot be moved, so that
+// a failure does not leave a private key without its public key.
+func RenameIdentity(oldPath, newPath string) error {
+	if err := os.Rename(oldPath, newPath); err != nil {
+		return err
+	}
+	if err := os.Rename(oldPath+".pub", newPath+".pub"); err != nil {
+		if undoErr := os.Rename(newPath, oldPath); undoErr != nil {
+			return errors.Join(err, undoErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// RemoveIdentity deletes the key pair at path
+func RemoveIdentity(path string) error {
+	var errs []error
+	for _, p := range []string{path, path + ".pub"} {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ReadAuthorizedKey returns the public key of the key pair at path
+func ReadAuthorizedKey(path string) (ssh.PublicKey, error) {
+	b, err := os.ReadFile(path + ".pub")
+	if err != nil {
+		return nil, err
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	return key, err
+}
@@ -15,6 +15,9 @@ import (
 // MacadamTestIntegration struct for command line options
 type MacadamTestIntegration struct {
 	MacadamBinary string
+	// Home is the MACADAM_HOME of the commands, so that they do not see the
+	// machines of the user running the tests
+	Home string
 }
 
 type MacadamExecOptions struct {
@@ -34,6 +37,7 @@ func MacadamTestCreate() *MacadamTestIntegration {
 
 	return &MacadamTestIntegration{
 		MacadamBinary: macadamBinary,
+		Home:          macadamHome,
 	}
 }
 
@@ -43,6 +47,7 @@ func (m *MacadamTestIntegration) Macadam(args []string) *MacadamSession {
 	macadamBinary := m.MacadamBinary
 
 	command = exec.Command(macadamBinary, args...)
+	command.Env = append(os.Environ(), "MACADAM_HOME="+m.Home)
 
 	session, err := Start(command, GinkgoWriter, GinkgoWriter)
 	if err != nil {
@@ -1,11 +1,14 @@
 package e2e
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"path/filepath"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"sync/atomic"
 
 	"github.com/crc-org/macadam/test/osprovider"
 	. "github.com/onsi/ginkgo/v2"
@@ -14,34 +17,91 @@ import (
 )
 
 var tempDir string
-var machineResponses []ListReporter
 var err error
 var image string
 var keypath string
 var cloudinitPath string
 
+// macadamHome is the MACADAM_HOME of the macadam commands, it is removed with
+// tempDir at the end of the run
+var macadamHome string
+
+// runID and machineCount make the machine names unique, across the parallel
+// processes of a run and across runs, as some providers have global names
+var runID string
+var machineCount atomic.Int32
+
+// userSSHConfig is the content of the ssh configuration files of the user
+// which macadam may write, the suite must not modify them
+var userSSHConfig map[string]string
+
+// readUserSSHConfig returns the content of ~/.ssh/config and of the files of
+// ~/.ssh/config.d written by 'macadam ssh-config --install'
+func readUserSSHConfig() map[string]string {
+	home, err := os.UserHomeDir()
+	Expect(err).NotTo(HaveOccurred())
+	paths, err := filepath.Glob(filepath.Join(home, ".ssh", "config.d", "macadam-*"))
+	Expect(err).NotTo(HaveOccurred())
+	paths = append(paths, filepath.Join(home, ".ssh", "config"))
+	files := map[string]string{}
+	for _, path := range paths {
+		if content, err := os.ReadFile(path); err == nil {
+			files[path] = string(content)
+		}
+	}
+	return files
+}
+
+// newMachineName returns a name which was not used by another spec
+func newMachineName() string {
+	return fmt.Sprintf("e2e-%s-%d", runID, machineCount.Add(1))
+}
+
+// findMachine returns the machine called name from the list command
+func findMachine(name string) (ListReporter, bool) {
+	session := macadamTest.Macadam([]string{"list", "--format", "json"})
+	session.WaitWithDefaultTimeout()
+	Expect(session).Should(gexec.Exit(0))
+	var machines []ListReporter
+	Expect(json.Unmarshal(session.Out.Contents(), &machines)).To(Succeed())
+	for _, m := range machines {
+		if m.Name == name {
+			return m, true
+		}
+	}
+	return ListReporter{}, false
+}
+
 var _ = BeforeSuite(func() {
-    tempDir, err = os.MkdirTemp("", "test-")
+	tempDir, err = os.MkdirTemp("", "test-")
 	Expect(err).NotTo(HaveOccurred())
 
-	// download CentOS image
-	centosProvider := osprovider.NewCentosProvider()
-	image, err = centosProvider.Fetch(tempDir)
+	macadamHome = filepath.Join(tempDir, "macadam")
+	id := make([]byte, 3)
+	_, err = rand.Read(id)
+	Expect(err).NotTo(HaveOccurred())
+	runID = hex.EncodeToString(id)
+	userSSHConfig = readUserSSHConfig()
+
+	// download CentOS image, unless a local image is given with
+	// MACADAM_E2E_IMAGE
+	osProvider := osprovider.NewOsProvider()
+	image, err = osProvider.Fetch(tempDir)
 	fmt.Println(image)
 	Expect(err).NotTo(HaveOccurred())
-	
-	keypath := filepath.Join(tempDir,"id_rsa")
-	cloudinitPath := filepath.Join(tempDir,"user-data")
+
+	keypath = filepath.Join(tempDir, "id_rsa")
+	cloudinitPath = filepath.Join(tempDir, "user-data")
 	//generate ssh key
 	cmd := exec.Command("ssh-keygen", "-t", "rsa", "-f", keypath, "-N", "")
-	err := cmd.Run()
+	err = cmd.Run()
 	Expect(err).ShouldNot(HaveOccurred())
 	//copy user-data
 	wd, err := os.Getwd()
 	if err != nil {
 		fmt.Printf("failed to get working directory: %v\n", err)
 	}
-	cloudinit := wd+"/../testdata/user-data"
+	cloudinit := wd + "/../testdata/user-data"
 	content, err := os.ReadFile(cloudinit)
 	if err != nil {
 		fmt.Printf("failed to read %s: %v\n", cloudinit, err)
@@ -53,72 +113,73 @@ var _ = BeforeSuite(func() {
 })
 
 var _ = AfterSuite(func() {
-    os.RemoveAll(tempDir)
+	// the runtime directory is not under MACADAM_HOME, but it is specific
+	// to it
+	session := MacadamTestCreate().Macadam([]string{"system", "info", "--format", "json"})
+	session.WaitWithDefaultTimeout()
+	var info struct {
+		Dirs struct {
+			RuntimeDir string
+		}
+	}
+	if err := json.Unmarshal(session.Out.Contents(), &info); err == nil && info.Dirs.RuntimeDir != "" {
+		os.RemoveAll(filepath.Dir(info.Dirs.RuntimeDir))
+	}
+	os.RemoveAll(tempDir)
+	Expect(readUserSSHConfig()).To(Equal(userSSHConfig))
 })
 
- 
 var _ = Describe("Macadam init setup test", Label("init"), func() {
+	var name string
+
 	BeforeEach(func() {
-		session := macadamTest.Macadam([]string{"list", "--format", "json"})
-		Eventually(session).Should(gexec.Exit(0))
-		err := json.Unmarshal(session.Out.Contents(), &machineResponses)
-		Expect(err).NotTo(HaveOccurred())
-		Expect(len(machineResponses)).Should(Equal(0))
+		name = newMachineName()
 	})
 
 	AfterEach(func() {
 		// stop the CentOS VM
-		session := macadamTest.Macadam([]string{"stop"})
+		session := macadamTest.Macadam([]string{"stop", name})
 		session.WaitWithDefaultTimeout()
 		Expect(session).Should(gexec.Exit())
 		Expect(session.OutputToString()).Should(ContainSubstring("stopped successfully"))
 
-		// rm the CentOS VM and verify that "list" does not return any vm
-		session = macadamTest.Macadam([]string{"rm", "-f"})
+		// rm the CentOS VM and verify that "list" does not return it
+		session = macadamTest.Macadam([]string{"rm", "-f", name})
 		session.WaitWithDefaultTimeout()
 		Expect(session).Should(gexec.Exit())
 
-		session = macadamTest.Macadam([]string{"list", "--format", "json"})
-		session.WaitWithDefaultTimeout()
-		Expect(session).Should(gexec.Exit())
-		err = json.Unmarshal(session.Out.Contents(), &machineResponses)
-		Expect(err).NotTo(HaveOccurred())
-		Expect(len(machineResponses)).Should(Equal(0))	
+		_, found := findMachine(name)
+		Expect(found).To(BeFalse())
 	})
 
 	It("init CentOS VM with cpu, disk and memory setup", Label("cpu"), func() {
 		// init a CentOS VM with cpu and disk-size setup
-		session := macadamTest.Macadam([]string{"init", "--cpus", "3", "--disk-size", "30", "--memory","2048", image})
+		session := macadamTest.Macadam([]string{"init", "--name", name, "--cpus", "3", "--disk-size", "30", "--memory", "2048", image})
 		session.WaitWithDefaultTimeout()
 		Expect(session).Should(gexec.Exit(0))
 
-
-		// check the list command returns one item
-		session = macadamTest.Macadam([]string{"list", "--format", "json"})
-		session.WaitWithDefaultTimeout()
-		Expect(session).Should(gexec.Exit())
-		err = json.Unmarshal(session.Out.Contents(), &machineResponses)
-		Expect(err).NotTo(HaveOccurred())
-		Expect(len(machineResponses)).Should(Equal(1))
+		// check the list command returns the VM
+		_, found := findMachine(name)
+		Expect(found).To(BeTrue())
 
 		// start the CentOS VM
-		session = macadamTest.Macadam([]string{"start"})
+		session = macadamTest.Macadam([]string{"start", name})
 		session.WaitWithDefaultTimeout()
 		Expect(session).Should(gexec.Exit())
 		Expect(session.OutputToString()).Should(ContainSubstring("started successfully"))
 
 		// ssh into the VM and prints user
-		session = macadamTest.Macadam([]string{"ssh", "nproc"})
+		session = macadamTest.Macadam([]string{"ssh", name, "nproc"})
 		session.WaitWithDefaultTimeout()
 		Expect(session).Should(gexec.Exit())
 		Expect(session.OutputToString()).Should(Equal("3"))
 
-		session = macadamTest.Macadam([]string{"ssh", "lsblk"})
+		session = macadamTest.Macadam([]string{"ssh", name, "lsblk"})
 		session.WaitWithDefaultTimeout()
 		Expect(session).Should(gexec.Exit())
 		Expect(session.OutputToString()).Should(ContainSubstring("30G"))
 
-		session = macadamTest.Macadam([]string{"ssh", "free", "-h"})
+		session = macadamTest.Macadam([]string{"ssh", name, "free", "-h"})
 		session.WaitWithDefaultTimeout()
 		Expect(session).Should(gexec.Exit())
 		fmt.Println(session.OutputToString())
@@ -127,26 +188,22 @@ var _ = Describe("Macadam init setup test", Label("init"), func() {
 
 	It("init CentOS VM with username and sshkey setup", Label("test"), func() {
 		// init a CentOS VM with cpu and disk-size setup
-		session := macadamTest.Macadam([]string{"init", "--username", "test","--ssh-identity-path", keypath, image})
+		session := macadamTest.Macadam([]string{"init", "--name", name, "--username", "test", "--ssh-identity-path", keypath, image})
 		session.WaitWithDefaultTimeout()
 		Expect(session).Should(gexec.Exit(0))
 
-		// check the list command returns one item
-		session = macadamTest.Macadam([]string{"list", "--format", "json"})
-		session.WaitWithDefaultTimeout()
-		Expect(session).Should(gexec.Exit())
-		err = json.Unmarshal(session.Out.Contents(), &machineResponses)
-		Expect(err).NotTo(HaveOccurred())
-		Expect(len(machineResponses)).Should(Equal(1))
+		// check the list command returns the VM
+		_, found := findMachine(name)
+		Expect(found).To(BeTrue())
 
 		// start the CentOS VM
-		session = macadamTest.Macadam([]string{"start"})
+		session = macadamTest.Macadam([]string{"start", name})
 		session.WaitWithDefaultTimeout()
 		Expect(session).Should(gexec.Exit())
 		Expect(session.OutputToString()).Should(ContainSubstring("started successfully"))
 
 		// ssh into the VM and prints user
-		session = macadamTest.Macadam([]string{"ssh","--username", "test", "whoami"})
+		session = macadamTest.Macadam([]string{"ssh", "--username", "test", name, "whoami"})
 		session.WaitWithDefaultTimeout()
 		Expect(session).Should(gexec.Exit())
 		Expect(session.OutputToString()).Should(Equal("test"))
@@ -154,30 +211,24 @@ var _ = Describe("Macadam init setup test", Label("init"), func() {
 
 	It("init CentOS VM with cloud-init setup", Label("cloudinit"), func() {
 		// init a CentOS VM with cpu and disk-size setup
-		session := macadamTest.Macadam([]string{"init", "--cloud-init", cloudinitPath,"--username", "macadamtest", "--ssh-identity-path", keypath, image})
+		session := macadamTest.Macadam([]string{"init", "--name", name, "--cloud-init", cloudinitPath, "--username", "macadamtest", "--ssh-identity-path", keypath, image})
 		session.WaitWithDefaultTimeout()
 		Expect(session).Should(gexec.Exit(0))
 
-
-		// check the list command returns one item
-		session = macadamTest.Macadam([]string{"list", "--format", "json"})
-		session.WaitWithDefaultTimeout()
-		Expect(session).Should(gexec.Exit())
-		err = json.Unmarshal(session.Out.Contents(), &machineResponses)
-		Expect(err).NotTo(HaveOccurred())
-		Expect(len(machineResponses)).Should(Equal(1))
+		// check the list command returns the VM
+		_, found := findMachine(name)
+		Expect(found).To(BeTrue())
 
 		// start the CentOS VM
-		session = macadamTest.Macadam([]string{"start"})
+		session = macadamTest.Macadam([]string{"start", name})
 		session.WaitWithDefaultTimeout()
 		Expect(session).Should(gexec.Exit())
 		Expect(session.OutputToString()).Should(ContainSubstring("started successfully"))
 
 		// ssh into the VM and prints user
-		session = macadamTest.Macadam([]string{"ssh", "whoami"})
+		session = macadamTest.Macadam([]string{"ssh", name, "whoami"})
 		session.WaitWithDefaultTimeout()
 		Expect(session).Should(gexec.Exit())
 		Expect(session.OutputToString()).Should(Equal("macadamtest"))
 	})
-
 })
@@ -1,16 +1,16 @@
 package e2e
 
 import (
-	"encoding/json"
 	"os"
+	"path/filepath"
 
-	"github.com/crc-org/macadam/test/osprovider"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/gexec"
 )
 
 type ListReporter struct {
+	Name           string
 	Image          string
 	Created        string
 	Running        bool
@@ -27,75 +27,54 @@ type ListReporter struct {
 
 var _ = Describe("Macadam", func() {
 
-	var tempDir string
-
-	BeforeEach(func() {
-		var err error
-		tempDir, err = os.MkdirTemp("", "test-")
-		Expect(err).NotTo(HaveOccurred())
-	})
-
-	AfterEach(func() {
-		os.RemoveAll(tempDir)
-	})
-
 	It("creates a new CentOS VM, starts it, ssh in and cleans", func() {
-		// verify there is no vm
-		var machineResponses []ListReporter
-		session := macadamTest.Macadam([]string{"list", "--format", "json"})
-		session.WaitWithDefaultTimeout()
-		Expect(session).Should(gexec.Exit())
-		err := json.Unmarshal(session.Out.Contents(), &machineResponses)
-		Expect(err).NotTo(HaveOccurred())
-		Expect(len(machineResponses)).Should(Equal(0))
-
-		// download CentOS image
-		centosProvider := osprovider.NewCentosProvider()
-		image, err := centosProvider.Fetch(tempDir)
-		Expect(err).NotTo(HaveOccurred())
+		name := newMachineName()
 
-		// init a CentOS VM
-		session = macadamTest.Macadam([]string{"init", image})
+		// init a CentOS VM from the image fetched by BeforeSuite
+		session := macadamTest.Macadam([]string{"init", "--name", name, image})
 		session.WaitWithDefaultTimeout()
 		Expect(session).Should(gexec.Exit())
 
-		// check the list command returns one item
-		session = macadamTest.Macadam([]string{"list", "--format", "json"})
+		// check the list command returns the VM
+		_, found := findMachine(name)
+		Expect(found).To(BeTrue())
+
+		// install the ssh configuration, it is kept up to date in
+		// MACADAM_HOME and not in ~/.ssh
+		session = macadamTest.Macadam([]string{"ssh-config", "--install"})
 		session.WaitWithDefaultTimeout()
-		Expect(session).Should(gexec.Exit())
-		err = json.Unmarshal(session.Out.Contents(), &machineResponses)
+		Expect(session).Should(gexec.Exit(0))
+		sshConfigFiles, err := filepath.Glob(filepath.Join(macadamHome, ".ssh", "config.d", "macadam-*"))
 		Expect(err).NotTo(HaveOccurred())
-		Expect(len(machineResponses)).Should(Equal(1))
+		Expect(sshConfigFiles).To(HaveLen(1))
+		Expect(os.ReadFile(sshConfigFiles[0])).To(ContainSubstring("Host macadam-" + name))
 
 		// start the CentOS VM
-		session = macadamTest.Macadam([]string{"start"})
+		session = macadamTest.Macadam([]string{"start", name})
 		session.WaitWithTimeout(180)
 		Expect(session).Should(gexec.Exit())
 		Expect(session.OutputToString()).Should(ContainSubstring("started successfully"))
 
 		// ssh into the VM and prints user
-		session = macadamTest.Macadam([]string{"ssh", "whoami"})
+		session = macadamTest.Macadam([]string{"ssh", name, "whoami"})
 		session.WaitWithDefaultTimeout()
 		Expect(session).Should(gexec.Exit())
 		Expect(session.OutputToString()).Should(Equal("core"))
 
 		// stop the CentOS VM
-		session = macadamTest.Macadam([]string{"stop"})
+		session = macadamTest.Macadam([]string{"stop", name})
 		session.WaitWithDefaultTimeout()
 		Expect(session).Should(gexec.Exit())
 		Expect(session.OutputToString()).Should(ContainSubstring("stopped successfully"))
 
-		// rm the CentOS VM and verify that "list" does not return any vm
-		session = macadamTest.Macadam([]string{"rm", "-f"})
+		// rm the CentOS VM and verify that "list" does not return it
+		session = macadamTest.Macadam([]string{"rm", "-f", name})
 		session.WaitWithDefaultTimeout()
 		Expect(session).Should(gexec.Exit())
 
-		session = macadamTest.Macadam([]string{"list", "--format", "json"})
-		session.WaitWithDefaultTimeout()
-		Expect(session).Should(gexec.Exit())
-		err = json.Unmarshal(session.Out.Contents(), &machineResponses)
-		Expect(err).NotTo(HaveOccurred())
-		Expect(len(machineResponses)).Should(Equal(0))
+		_, found = findMachine(name)
+		Expect(found).To(BeFalse())
+		Expect(os.ReadFile(sshConfigFiles[0])).NotTo(ContainSubstring("Host macadam-" + name))
 	})
 
 })
@@ -0,0 +1,48 @@
+package osprovider
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// LocalImageEnv is the environment variable holding the path of the image
+// used instead of downloading CentOS, so that the e2e tests can run without
+// network access. The image is a qcow2 or raw disk image booting with
+// cloud-init, such as a CentOS image downloaded beforehand.
+const LocalImageEnv = "MACADAM_E2E_IMAGE"
+
+// LocalProvider provides a disk image which is already on the host
+type LocalProvider struct {
+	imagePath string
+	diskImage string
+}
+
+func NewLocalProvider(imagePath string) *LocalProvider {
+	return &LocalProvider{
+		imagePath: imagePath,
+	}
+}
+
+// Fetch returns the path of the image, macadam init copies it so it is not
+// modified by the tests
+func (local *LocalProvider) Fetch(_ string) (string, error) {
+	file, err := filepath.Abs(local.imagePath)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a disk image", file)
+	}
+	log.Infof("using the local image %s", file)
+
+	local.diskImage = file
+
+	return file, nil
+}
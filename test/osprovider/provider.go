@@ -1,13 +1,31 @@
 package osprovider
 
 import (
+	"os"
 	"runtime"
 
 	"github.com/cavaliergopher/grab/v3"
 )
 
+// OsProvider provides the disk image of the machines of the e2e tests
 type OsProvider interface {
-	Fetch(destDir string) error
+	// Fetch returns the path of the disk image, which is downloaded to
+	// destDir when needed
+	Fetch(destDir string) (string, error)
+}
+
+var (
+	_ OsProvider = &CentosProvider{}
+	_ OsProvider = &LocalProvider{}
+)
+
+// NewOsProvider returns a LocalProvider when the LocalImageEnv environment
+// variable is set, and a CentosProvider downloading the image otherwise
+func NewOsProvider() OsProvider {
+	if imagePath := os.Getenv(LocalImageEnv); imagePath != "" {
+		return NewLocalProvider(imagePath)
+	}
+	return NewCentosProvider()
 }
 
 func kernelArch() string {